@@ -1,6 +1,11 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	Addr             string
@@ -8,16 +13,146 @@ type Config struct {
 	WalletVendorAddr string
 	DatabaseUrl      string
 	SessionCacheDir  string
+	// SessionStore is badger, keeping sessions in SessionCacheDir, or redis
+	// to share them between instances
+	SessionStore  string
+	RedisAddr     string
+	RedisPassword string
+	RedisDb       int
+	// JwtKeys maps key IDs to the secrets access tokens are signed with,
+	// e.g 2020-06:secret. JwtKeyId names the one new tokens are signed with;
+	// the others are still accepted so keys can be rotated.
+	JwtKeys  map[string]string
+	JwtKeyId string
+	// AccessTokenTtl bounds how long a revoked session is remembered, and
+	// so how long an access token issued for it has to be refused.
+	AccessTokenTtl time.Duration
+	// StepUpThreshold is the payment, in USD, from which users with two
+	// factor authentication have to send a code. Zero disables it.
+	StepUpThreshold int64
+	// TrustedProxies lists the IPs or CIDRs of the load balancers in front
+	// of the API. X-Forwarded-For is only believed from them.
+	TrustedProxies   []string
 	BlockCypherToken string
 	PayStackKey      string
+	FlutterwaveKey   string
+	// FlutterwaveWebhookHash is the secret hash Flutterwave sends with
+	// every webhook.
+	FlutterwaveWebhookHash string
+	// PayoutProviders lists payout providers in order of preference.
+	PayoutProviders []string
+	// PayoutBankProviders pins bank codes to a provider, e.g 058:flutterwave
+	PayoutBankProviders map[string]string
+	// FxRates maps a currency pair such as USD-GHS to its rate
+	FxRates map[string]int64
+	// BankSyncInterval is how often the bank list is refreshed from Paystack
+	BankSyncInterval time.Duration
+	// ScheduleInterval is how often due scheduled payments are started
+	ScheduleInterval time.Duration
+	AdminKey         string
+	// PayoutBatchWindow is how long ready payouts are collected before being
+	// sent as one bulk transfer. Zero disables batching.
+	PayoutBatchWindow time.Duration
+	// PayoutBalanceFloor is the Paystack balance, in KOBO, below which
+	// payouts are paused.
+	PayoutBalanceFloor   int64
+	BalanceCheckInterval time.Duration
+	// ReconciliationInterval is how often the previous day is reconciled
+	// against Paystack and the blockchain
+	ReconciliationInterval time.Duration
+	AlertEmail             string
 }
 
 func New() Config {
 	return Config{
-		Addr:             os.Getenv("ADDR"),
-		DatabaseUrl:      os.Getenv("DATABASE_URL"),
-		SessionCacheDir:  os.Getenv("SESSION_CACHE"),
-		BlockCypherToken: os.Getenv("BC_TOKEN"),
-		PayStackKey:      os.Getenv("PS_KEY"),
+		Addr:                   os.Getenv("ADDR"),
+		DatabaseUrl:            os.Getenv("DATABASE_URL"),
+		SessionCacheDir:        os.Getenv("SESSION_CACHE"),
+		SessionStore:           os.Getenv("SESSION_STORE"),
+		RedisAddr:              os.Getenv("REDIS_ADDR"),
+		RedisPassword:          os.Getenv("REDIS_PASSWORD"),
+		RedisDb:                intEnv("REDIS_DB", 0),
+		JwtKeys:                mapEnv("JWT_KEYS"),
+		JwtKeyId:               os.Getenv("JWT_KEY_ID"),
+		AccessTokenTtl:         secondsEnv("ACCESS_TOKEN_TTL", 15*time.Minute),
+		StepUpThreshold:        int64(intEnv("STEP_UP_THRESHOLD", 500)),
+		TrustedProxies:         listEnv("TRUSTED_PROXIES", nil),
+		BlockCypherToken:       os.Getenv("BC_TOKEN"),
+		PayStackKey:            os.Getenv("PS_KEY"),
+		FlutterwaveKey:         os.Getenv("FLW_KEY"),
+		FlutterwaveWebhookHash: os.Getenv("FLW_WEBHOOK_HASH"),
+		PayoutProviders:        listEnv("PAYOUT_PROVIDERS", []string{"paystack"}),
+		PayoutBankProviders:    mapEnv("PAYOUT_BANK_PROVIDERS"),
+		FxRates:                ratesEnv("FX_RATES", map[string]int64{"USD-NGN": 490}),
+		BankSyncInterval:       secondsEnv("BANK_SYNC_INTERVAL", 24*time.Hour),
+		ScheduleInterval:       secondsEnv("SCHEDULE_INTERVAL", time.Minute),
+		AdminKey:               os.Getenv("ADMIN_KEY"),
+		PayoutBatchWindow:      secondsEnv("PAYOUT_BATCH_WINDOW", 0),
+		PayoutBalanceFloor:     int64(intEnv("PAYOUT_BALANCE_FLOOR", 0)),
+		BalanceCheckInterval:   secondsEnv("BALANCE_CHECK_INTERVAL", time.Minute),
+		ReconciliationInterval: secondsEnv("RECONCILIATION_INTERVAL", 24*time.Hour),
+		AlertEmail:             os.Getenv("ALERT_EMAIL"),
 	}
 }
+
+// intEnv reads key as an integer, returning fallback when it is unset or
+// malformed.
+func intEnv(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// secondsEnv reads key as a whole number of seconds, returning fallback when
+// it is unset or malformed.
+func secondsEnv(key string, fallback time.Duration) time.Duration {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return time.Duration(value) * time.Second
+}
+
+// listEnv reads key as a comma separated list.
+func listEnv(key string, fallback []string) []string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	values := make([]string, 0)
+	for _, next := range strings.Split(value, ",") {
+		if next = strings.TrimSpace(next); next != "" {
+			values = append(values, next)
+		}
+	}
+	return values
+}
+
+// mapEnv reads key as a comma separated list of key:value pairs.
+func mapEnv(key string) map[string]string {
+	values := make(map[string]string)
+	for _, next := range listEnv(key, nil) {
+		pair := strings.SplitN(next, ":", 2)
+		if len(pair) == 2 {
+			values[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+	}
+	return values
+}
+
+// ratesEnv reads key as a comma separated list of pair:rate values, e.g
+// USD-NGN:490,USD-GHS:12
+func ratesEnv(key string, fallback map[string]int64) map[string]int64 {
+	values := make(map[string]int64)
+	for pair, rate := range mapEnv(key) {
+		if value, err := strconv.ParseInt(rate, 10, 64); err == nil {
+			values[pair] = value
+		}
+	}
+	if len(values) == 0 {
+		return fallback
+	}
+	return values
+}
@@ -1,29 +1,138 @@
 package database
 
 import (
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/ledger"
 	"github.com/adigunhammedolalekan/cashtroops/types"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/postgres"
+	"time"
 )
 
+// SchemaMigration records a one-off migration that has run.
+type SchemaMigration struct {
+	Name  string `gorm:"primary_key"`
+	RanAt time.Time
+}
+
 func Open(connectUri string) (*gorm.DB, error) {
 	database, err := gorm.Open("postgres", connectUri)
 	if err != nil {
 		return nil, err
 	}
-	runMigration(database)
+	if err := runMigration(database); err != nil {
+		return nil, err
+	}
 	return database, nil
 }
 
-func runMigration(db *gorm.DB) {
+func runMigration(db *gorm.DB) error {
 	db.Debug().AutoMigrate(&types.User{},
 		&types.Verification{},
 		&types.PasswordResetToken{},
+		&types.BackupCode{},
+		&types.AttemptCounter{},
+		&types.RateCounter{},
 		&types.Beneficiary{},
 		&types.Balance{},
 		&types.Address{},
 		&types.Hook{},
 		&types.Rate{},
 		&types.Transfer{},
-		&types.Payment{})
+		&types.PayoutRecipient{},
+		&types.Bank{},
+		&types.Invoice{},
+		&types.Schedule{},
+		&types.Deposit{},
+		&types.Withdrawal{},
+		&ledger.Journal{},
+		&ledger.Entry{},
+		&types.Payment{},
+		&SchemaMigration{})
+
+	// beneficiaries created before last_paid_at existed
+	if err := runOnce(db, "backfill_beneficiaries_last_paid_at", `UPDATE beneficiaries SET last_paid_at = (
+		SELECT MAX(payments.ts) FROM payments WHERE payments.beneficiary_id = CAST(beneficiaries.id AS TEXT)
+			AND payments.status = 'DONE') WHERE last_paid_at IS NULL`); err != nil {
+		return err
+	}
+
+	// users who activated before activation was kept on the user
+	if err := runOnce(db, "backfill_users_activated", `UPDATE users SET activated = true WHERE activated = false
+		AND email IN (SELECT email FROM verifications WHERE activated = true)`); err != nil {
+		return err
+	}
+
+	// crediting a balance upserts on this index
+	if err := db.Model(&types.Balance{}).AddUniqueIndex("idx_balances_user_coin", "user_id", "coin").Error; err != nil {
+		return fmt.Errorf("idx_balances_user_coin: %v", err)
+	}
+	if err := mergeDuplicateBeneficiaries(db); err != nil {
+		return fmt.Errorf("merge duplicate beneficiaries: %v", err)
+	}
+	if err := db.Model(&types.Beneficiary{}).AddUniqueIndex("idx_beneficiaries_owner_bank_account",
+		"owner", "bank_code", "account_number").Error; err != nil {
+		return fmt.Errorf("idx_beneficiaries_owner_bank_account: %v", err)
+	}
+	return nil
+}
+
+// runOnce runs statement the first time a migration called name is seen.
+// Instances starting together wait on the one that claimed it.
+func runOnce(db *gorm.DB, name, statement string) error {
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	result := tx.Exec(`INSERT INTO schema_migrations (name, ran_at) VALUES (?, ?) ON CONFLICT (name) DO NOTHING`,
+		name, time.Now())
+	if result.Error != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: %v", name, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return tx.Rollback().Error
+	}
+	if err := tx.Exec(statement).Error; err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return tx.Commit().Error
+}
+
+// duplicateBeneficiaries pairs every duplicate beneficiary with the one kept
+// for its owner, bank and account number. Visible beneficiaries are kept
+// over removed or hidden ones, then ones that already have a transfer
+// recipient, then the most recently paid.
+const duplicateBeneficiaries = `WITH ranked AS (
+	SELECT CAST(id AS TEXT) AS id, FIRST_VALUE(CAST(id AS TEXT)) OVER (
+		PARTITION BY owner, bank_code, account_number
+		ORDER BY COALESCE(removed, false), COALESCE(hidden, false),
+			COALESCE(transfer_recipient_id, '') = '', last_paid_at DESC NULLS LAST, id) AS keep_id
+	FROM beneficiaries
+), duplicates AS (SELECT id, keep_id FROM ranked WHERE id <> keep_id)`
+
+// mergeDuplicateBeneficiaries moves payments and payout recipients of
+// duplicate beneficiaries onto the one being kept and deletes the rest so
+// the unique index can be created.
+func mergeDuplicateBeneficiaries(db *gorm.DB) error {
+	tx := db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	statements := []string{
+		duplicateBeneficiaries + ` UPDATE payments SET beneficiary_id = duplicates.keep_id
+			FROM duplicates WHERE payments.beneficiary_id = duplicates.id`,
+		duplicateBeneficiaries + ` UPDATE payout_recipients SET beneficiary_id = duplicates.keep_id
+			FROM duplicates WHERE payout_recipients.beneficiary_id = duplicates.id`,
+		duplicateBeneficiaries + ` DELETE FROM beneficiaries USING duplicates
+			WHERE CAST(beneficiaries.id AS TEXT) = duplicates.id`,
+	}
+	for _, next := range statements {
+		if err := tx.Exec(next).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit().Error
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 	"log"
 	"os"
+	"time"
 )
 
 func GenerateResetPasswordEmail(code string) (string, error) {
@@ -28,7 +29,7 @@ func GenerateResetPasswordEmail(code string) (string, error) {
 			},
 			Actions: []hermes.Action{
 				{
-					Instructions: "Please use the code below to reset your password:",
+					Instructions: "Please use the code below to reset your password. It expires in 15 minutes:",
 					Button: hermes.Button{
 						Text: code,
 					},
@@ -61,7 +62,7 @@ func GenerateWelcomeEmail(accountName, code string) (string, error) {
 			},
 			Actions: []hermes.Action{
 				{
-					Instructions: "Use the code below to activate your account",
+					Instructions: "Use the code below to activate your account. It expires in 24 hours",
 					Button: hermes.Button{
 						Text: code,
 						Link: fmt.Sprintf(""),
@@ -77,6 +78,73 @@ func GenerateWelcomeEmail(accountName, code string) (string, error) {
 	return h.GenerateHTML(e)
 }
 
+func GenerateActivationEmail(accountName, code string) (string, error) {
+	h := hermes.Hermes{
+		Product: hermes.Product{
+			Name:        "CashTroops",
+			Link:        "https://cashtroops.africa",
+			Logo:        "",
+			Copyright:   "cashtroops.africa",
+			TroubleText: "Contact: hello@cashtroops.africa",
+		},
+	}
+	e := hermes.Email{
+		Body: hermes.Body{
+			Name: accountName,
+			Intros: []string{
+				"You asked for a new code to activate your CashTroops account.",
+			},
+			Actions: []hermes.Action{
+				{
+					Instructions: "Use the code below to activate your account. It expires in 24 hours",
+					Button: hermes.Button{
+						Text: code,
+					},
+				},
+			},
+			Outros: []string{
+				"If you did not ask for this code, no further action is required on your part.",
+			},
+			Signature: "Thanks",
+		},
+	}
+	return h.GenerateHTML(e)
+}
+
+func GenerateAccountLockedEmail(accountName, unlockCode string, until time.Time) (string, error) {
+	h := hermes.Hermes{
+		Product: hermes.Product{
+			Name:        "CashTroops",
+			Link:        "https://cashtroops.africa",
+			Logo:        "",
+			Copyright:   "cashtroops.africa",
+			TroubleText: "Contact: hello@cashtroops.africa",
+		},
+	}
+	e := hermes.Email{
+		Body: hermes.Body{
+			Name: accountName,
+			Intros: []string{
+				"There have been too many failed attempts to sign in to your CashTroops account, or to use codes sent to it.",
+				fmt.Sprintf("To keep it safe, the account is locked until %s.", until.UTC().Format("Jan 2, 2006 15:04 MST")),
+			},
+			Actions: []hermes.Action{
+				{
+					Instructions: "If these attempts were yours, use the code below to unlock your account now:",
+					Button: hermes.Button{
+						Text: unlockCode,
+					},
+				},
+			},
+			Outros: []string{
+				"If they were not yours, someone may know your password. Please reset it, and consider enabling two factor authentication.",
+			},
+			Signature: "Thanks",
+		},
+	}
+	return h.GenerateHTML(e)
+}
+
 func GenerateCoinReceivedEmail() (string, error) {
 	panic("")
 }
@@ -95,7 +163,67 @@ func GeneratePaymentCompletedEmail(accountName string, beneficiary *types.Benefi
 		Body: hermes.Body{
 			Name: accountName,
 			Intros: []string{
-				fmt.Sprintf("N%d has been successfully sent to %s", payment.KoboAmount/100, beneficiary.AccountName),
+				fmt.Sprintf("%s has been successfully sent to %s", FormatAmount(payment.Currency, payment.KoboAmount), beneficiary.AccountName),
+			},
+			Outros: []string{
+				"Thanks for choosing CashTroops",
+			},
+			Signature: "Thanks",
+		},
+	}
+	return h.GenerateHTML(e)
+}
+
+func GeneratePaymentReversedEmail(accountName string, payment *types.Payment) (string, error) {
+	h := hermes.Hermes{
+		Product: hermes.Product{
+			Name:        "CashTroops",
+			Link:        "https://cashtroops.africa",
+			Logo:        "",
+			Copyright:   "cashtroops.africa",
+			TroubleText: "Contact: hello@cashtroops.africa",
+		},
+	}
+	intros := []string{
+		fmt.Sprintf("We could not complete your payment of %s.", FormatAmount(payment.Currency, payment.KoboAmount)),
+	}
+	if payment.FromBalance {
+		intros = append(intros, fmt.Sprintf("The %s it took has been returned to your balance.", payment.Coin))
+	} else if payment.RefundAddress == "" {
+		intros = append(intros, fmt.Sprintf("Please submit a %s address so we can refund the %s you sent to %s.",
+			payment.Coin, payment.Coin, payment.AddressUsed))
+	} else {
+		intros = append(intros, fmt.Sprintf("Your %s is being refunded to %s.", payment.Coin, payment.RefundAddress))
+	}
+	e := hermes.Email{
+		Body: hermes.Body{
+			Name:   accountName,
+			Intros: intros,
+			Outros: []string{
+				"Thanks for choosing CashTroops",
+			},
+			Signature: "Thanks",
+		},
+	}
+	return h.GenerateHTML(e)
+}
+
+func GenerateRefundEmail(accountName string, payment *types.Payment) (string, error) {
+	h := hermes.Hermes{
+		Product: hermes.Product{
+			Name:        "CashTroops",
+			Link:        "https://cashtroops.africa",
+			Logo:        "",
+			Copyright:   "cashtroops.africa",
+			TroubleText: "Contact: hello@cashtroops.africa",
+		},
+	}
+	e := hermes.Email{
+		Body: hermes.Body{
+			Name: accountName,
+			Intros: []string{
+				fmt.Sprintf("%d units of %s have been refunded to %s", payment.RefundAmount, payment.Coin, payment.RefundAddress),
+				fmt.Sprintf("Transaction hash: %s", payment.RefundTxHash),
 			},
 			Outros: []string{
 				"Thanks for choosing CashTroops",
@@ -106,10 +234,111 @@ func GeneratePaymentCompletedEmail(accountName string, beneficiary *types.Benefi
 	return h.GenerateHTML(e)
 }
 
+func GenerateInvoicePaidEmail(accountName string, beneficiary *types.Beneficiary, invoice *types.Invoice, payment *types.Payment) (string, error) {
+	h := hermes.Hermes{
+		Product: hermes.Product{
+			Name:        "CashTroops",
+			Link:        "https://cashtroops.africa",
+			Logo:        "",
+			Copyright:   "cashtroops.africa",
+			TroubleText: "Contact: hello@cashtroops.africa",
+		},
+	}
+	intros := []string{
+		fmt.Sprintf("Your payment request %s for %s has been paid.", invoice.Code, FormatAmount(invoice.Currency, invoice.Amount)),
+		fmt.Sprintf("%s has been sent to %s.", FormatAmount(payment.Currency, payment.KoboAmount), beneficiary.AccountName),
+	}
+	if invoice.Memo != "" {
+		intros = append(intros, fmt.Sprintf("Memo: %s", invoice.Memo))
+	}
+	e := hermes.Email{
+		Body: hermes.Body{
+			Name:   accountName,
+			Intros: intros,
+			Outros: []string{
+				"Thanks for choosing CashTroops",
+			},
+			Signature: "Thanks",
+		},
+	}
+	return h.GenerateHTML(e)
+}
+
+func GenerateInvoiceReceiptEmail(requesterName string, invoice *types.Invoice, payment *types.Payment) (string, error) {
+	h := hermes.Hermes{
+		Product: hermes.Product{
+			Name:        "CashTroops",
+			Link:        "https://cashtroops.africa",
+			Logo:        "",
+			Copyright:   "cashtroops.africa",
+			TroubleText: "Contact: hello@cashtroops.africa",
+		},
+	}
+	intros := []string{
+		fmt.Sprintf("You paid %s to %s for payment request %s.", FormatAmount(invoice.Currency, invoice.Amount), requesterName, invoice.Code),
+		fmt.Sprintf("%s was received at %s.", FormatCoinAmount(payment.Coin, payment.CoinAmount), payment.AddressUsed),
+	}
+	if invoice.Memo != "" {
+		intros = append(intros, fmt.Sprintf("Memo: %s", invoice.Memo))
+	}
+	e := hermes.Email{
+		Body: hermes.Body{
+			Intros: intros,
+			Outros: []string{
+				"Thanks for choosing CashTroops",
+			},
+			Signature: "Thanks",
+		},
+	}
+	return h.GenerateHTML(e)
+}
+
+func GenerateScheduledPaymentEmail(accountName string, beneficiary *types.Beneficiary, schedule *types.Schedule, quote *types.Quote, address string) (string, error) {
+	h := hermes.Hermes{
+		Product: hermes.Product{
+			Name:        "CashTroops",
+			Link:        "https://cashtroops.africa",
+			Logo:        "",
+			Copyright:   "cashtroops.africa",
+			TroubleText: "Contact: hello@cashtroops.africa",
+		},
+	}
+	e := hermes.Email{
+		Body: hermes.Body{
+			Name: accountName,
+			Intros: []string{
+				fmt.Sprintf("Your %s payment of %s to %s is due.", schedule.Cadence, FormatAmount(schedule.Currency, schedule.Amount), beneficiary.AccountName),
+				fmt.Sprintf("Send %s to %s to complete it.", FormatCoinAmount(quote.Coin, quote.CoinAmount), address),
+				fmt.Sprintf("This quote uses a %s price of USD %.2f. The amount paid out depends on the price when your %s is received.", quote.Coin, quote.CoinPrice, quote.Coin),
+			},
+			Outros: []string{
+				fmt.Sprintf("Your next payment is due on %s.", schedule.NextRunAt.Format("2 January 2006")),
+				"Thanks for choosing CashTroops",
+			},
+			Signature: "Thanks",
+		},
+	}
+	return h.GenerateHTML(e)
+}
+
 func GenerateDealCompletedEmail() (string, error) {
 	panic("")
 }
 
+// FormatAmount formats an amount in the currency's minor unit for display
+func FormatAmount(currency string, minor int64) string {
+	if currency == "" || currency == "NGN" {
+		return fmt.Sprintf("N%d", minor/100)
+	}
+	return fmt.Sprintf("%s %d", currency, minor/100)
+}
+
+// FormatCoinAmount formats an amount in the coin's smallest unit e.g SATOSHI
+// for display
+func FormatCoinAmount(coin string, amount int64) string {
+	return fmt.Sprintf("%.8f %s", float64(amount)/1e8, coin)
+}
+
 func SendEmail(req *types.MailRequest) error {
 	log.Println("sending mail to ", req.Email)
 	from := mail.NewEmail("CashTroops", "adigunhammed.lekan@gmail.com")
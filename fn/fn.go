@@ -2,33 +2,25 @@ package fn
 
 import (
 	"errors"
-	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
 	"golang.org/x/crypto/bcrypt"
-	"math/rand"
 	"regexp"
 	"strings"
-	"time"
+	"unicode"
 )
 
-var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 var ErrInvalidEmail = errors.New("invalid email address")
 var userRegexp = regexp.MustCompile("^[a-zA-Z0-9!#$%&'*+/=?^_`{|}~.-]+$")
 var hostRegexp = regexp.MustCompile("^[^\\s]+\\.[^\\s]+$")
 
-func init() { rand.Seed(time.Now().UnixNano()) }
-
-// GenerateRandomString returns a randomly generated string
+// GenerateRandomString returns n random letters from a secure source
 func GenerateRandomString(n int) string {
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
+	return secure.String(n, secure.Letters)
 }
 
+// GenRandomCode returns a random six digit code from a secure source
 func GenRandomCode() string {
-	code := rand.Intn(999999)
-	return fmt.Sprintf("%06d", code)
+	return secure.Code(6)
 }
 
 func ValidateEmail(email string) error {
@@ -94,3 +86,79 @@ func VerifyHashPassword(hashed, password string) bool {
 	}
 	return true
 }
+
+// NameSimilarity scores how closely two personal names match, from 0 to 1.
+// Names are compared word by word, ignoring case, punctuation and word
+// order, so "ADIGUN HAMMED O." and "Hammed Adigun" are a close match. Every
+// word of the shorter name is matched against its closest word in the
+// longer name.
+func NameSimilarity(a, b string) float64 {
+	wordsA, wordsB := nameWords(a), nameWords(b)
+	if len(wordsA) == 0 || len(wordsB) == 0 {
+		return 0
+	}
+	if len(wordsA) > len(wordsB) {
+		wordsA, wordsB = wordsB, wordsA
+	}
+	total := 0.0
+	for _, next := range wordsA {
+		best := 0.0
+		for _, other := range wordsB {
+			score := wordSimilarity(next, other)
+			if score > best {
+				best = score
+			}
+		}
+		total += best
+	}
+	return total / float64(len(wordsA))
+}
+
+func nameWords(name string) []string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	values := make([]string, 0, len(words))
+	for _, next := range words {
+		// initials carry too little information to match on
+		if len([]rune(next)) > 1 {
+			values = append(values, next)
+		}
+	}
+	return values
+}
+
+// wordSimilarity is 1 minus the normalised Levenshtein distance of a and b
+func wordSimilarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	return 1 - float64(prev[len(rb)])/float64(longest)
+}
@@ -23,3 +23,22 @@ func TestValidatePassword(t *testing.T) {
 		assert.Equal(t, next.pass, err == nil)
 	}
 }
+
+func TestNameSimilarity(t *testing.T) {
+	type testCases struct {
+		a, b  string
+		match bool
+	}
+
+	values := []testCases{
+		{"ADIGUN HAMMED OLALEKAN", "Hammed Adigun", true},
+		{"Adigun, Hammed O.", "adigun hammed", true},
+		{"ADIGUN HAMED", "Hammed Adigun", true},
+		{"Chukwuemeka Obi", "Hammed Adigun", false},
+		{"", "Hammed Adigun", false},
+	}
+	for _, next := range values {
+		score := NameSimilarity(next.a, next.b)
+		assert.Equal(t, next.match, score >= 0.8, "%s vs %s scored %f", next.a, next.b, score)
+	}
+}
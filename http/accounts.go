@@ -8,6 +8,7 @@ import (
 	"github.com/go-chi/render"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
 )
 
 type AccountHandler struct {
@@ -58,6 +59,45 @@ func (handler *AccountHandler) RemoveBeneficiary(w http.ResponseWriter, r *http.
 	render.Respond(w, r, &SuccessResponse{Error: false, Message: "beneficiary removed"})
 }
 
+func (handler *AccountHandler) UpdateBeneficiary(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	body := &types.UpdateBeneficiaryOpts{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	bf, err := handler.accountOps.UpdateBeneficiary(sess.ID.String(), chi.URLParam(r, "id"), body)
+	if err != nil {
+		handler.logger.WithError(err).Error("/beneficiary/id failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "beneficiary updated", Data: bf})
+}
+
+// ConfirmBeneficiaryName accepts the bank's name for a beneficiary whose
+// supplied name did not match it.
+func (handler *AccountHandler) ConfirmBeneficiaryName(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	bf, err := handler.accountOps.ConfirmBeneficiaryName(sess.ID.String(), chi.URLParam(r, "id"))
+	if err != nil {
+		handler.logger.WithError(err).Error("/beneficiary/id/confirm failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "beneficiary confirmed", Data: bf})
+}
+
 func (handler *AccountHandler) ListBeneficiaries(w http.ResponseWriter, r *http.Request) {
 	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
 	if err != nil {
@@ -65,12 +105,21 @@ func (handler *AccountHandler) ListBeneficiaries(w http.ResponseWriter, r *http.
 		return
 	}
 
-	data, err := handler.accountOps.ListBeneficiariesFor(sess.ID.String())
+	params := r.URL.Query()
+	page, _ := strconv.Atoi(params.Get("page"))
+	perPage, _ := strconv.Atoi(params.Get("per_page"))
+	data, total, err := handler.accountOps.ListBeneficiariesFor(sess.ID.String(), &types.BeneficiaryQuery{
+		Search:  params.Get("q"),
+		Sort:    params.Get("sort"),
+		Page:    page,
+		PerPage: perPage,
+	})
 	if err != nil {
 		handler.logger.WithError(err).Error("/me/beneficiaries failed")
 		InternalServerErrorResponse(w, r, "failed to fetch beneficiaries at the moment. please retry")
 		return
 	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 	render.Status(r, http.StatusOK)
 	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
 }
@@ -81,8 +130,37 @@ func (handler *AccountHandler) Banks(w http.ResponseWriter, r *http.Request) {
 		ForbiddenRequestResponse(w, r, err.Error())
 		return
 	}
+	corridor := r.URL.Query().Get("corridor")
 	handler.logger.WithField("account_id", sess.ID.String()).
-		Info("requesting bank list")
+		WithField("corridor", corridor).Info("requesting bank list")
+	banks, err := handler.accountOps.GetBanks(corridor)
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: banks})
+}
+
+func (handler *AccountHandler) Corridors(w http.ResponseWriter, r *http.Request) {
+	if _, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey)); err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: types.Corridors})
+}
+
+func (handler *AccountHandler) ResolveAccount(w http.ResponseWriter, r *http.Request) {
+	if _, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey)); err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	account, err := handler.accountOps.ResolveAccount(chi.URLParam(r, "account"), chi.URLParam(r, "code"))
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
 	render.Status(r, http.StatusOK)
-	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: handler.accountOps.GetBanks()})
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: account})
 }
@@ -0,0 +1,253 @@
+package http
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/ledger"
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/ops"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+var (
+	adminHeaderKey = "X-Admin-Key"
+)
+
+type AdminHandler struct {
+	paymentOps ops.PaymentOps
+	ledger     *ledger.Ledger
+	reconciler *ops.Reconciler
+	limiter    ops.AttemptLimiter
+	adminKey   string
+	logger     *logrus.Logger
+}
+
+func NewAdminHandler(paymentOps ops.PaymentOps, ledger *ledger.Ledger, reconciler *ops.Reconciler, limiter ops.AttemptLimiter, adminKey string, logger *logrus.Logger) *AdminHandler {
+	return &AdminHandler{paymentOps: paymentOps, ledger: ledger, reconciler: reconciler, limiter: limiter, adminKey: adminKey, logger: logger}
+}
+
+// authorized reports whether the request carries the operator key. Admin
+// endpoints are disabled entirely when no key is configured.
+func (handler *AdminHandler) authorized(r *http.Request) bool {
+	key := r.Header.Get(adminHeaderKey)
+	if handler.adminKey == "" || key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(handler.adminKey)) == 1
+}
+
+func (handler *AdminHandler) PendingOtpTransfers(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	data, err := handler.paymentOps.ListPendingOtpTransfers()
+	if err != nil {
+		handler.logger.WithError(err).Error("/admin/transfers/otp failed")
+		InternalServerErrorResponse(w, r, "failed to fetch pending transfers. please retry")
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *AdminHandler) FinalizeTransfer(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	var body struct {
+		Otp string `json:"otp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	transfer, err := handler.paymentOps.FinalizeTransfer(chi.URLParam(r, "code"), body.Otp)
+	if err != nil {
+		handler.logger.WithError(err).Error("/admin/transfers/code/finalize failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "transfer finalized", Data: transfer})
+}
+
+func (handler *AdminHandler) FinalizeTransfers(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	var body struct {
+		Transfers []*paystackclient.FinalizeTransferRequest `json:"transfers"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	if len(body.Transfers) == 0 {
+		BadRequestResponse(w, r, "no transfers supplied")
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: handler.paymentOps.FinalizeTransfers(body.Transfers)})
+}
+
+func (handler *AdminHandler) ResendTransferOtp(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	if err := handler.paymentOps.ResendTransferOtp(chi.URLParam(r, "code")); err != nil {
+		handler.logger.WithError(err).Error("/admin/transfers/code/resendotp failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "otp resent"})
+}
+
+func (handler *AdminHandler) PayoutBalance(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	data, err := handler.paymentOps.PayoutBalanceStatus()
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *AdminHandler) LedgerBalances(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	data, err := handler.ledger.Balances()
+	if err != nil {
+		handler.logger.WithError(err).Error("/admin/ledger/balances failed")
+		InternalServerErrorResponse(w, r, "failed to fetch ledger balances. please retry")
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+// LedgerCheck lists journals that do not balance. Any result means money
+// was recorded moving without a matching entry.
+func (handler *AdminHandler) LedgerCheck(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	data, err := handler.ledger.Check()
+	if err != nil {
+		handler.logger.WithError(err).Error("/admin/ledger/check failed")
+		InternalServerErrorResponse(w, r, "failed to check ledger. please retry")
+		return
+	}
+	message := "ledger balances"
+	if len(data) > 0 {
+		message = "ledger has unbalanced journals"
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: message, Data: data})
+}
+
+// Reconciliation reconciles the days from and to, given as YYYY-MM-DD, with
+// to included. Both default to yesterday. The report is CSV when format is
+// csv.
+func (handler *AdminHandler) Reconciliation(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	yesterday := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	from, to := yesterday, yesterday
+	var err error
+	if value := r.URL.Query().Get("from"); value != "" {
+		if from, err = time.Parse("2006-01-02", value); err != nil {
+			BadRequestResponse(w, r, "from must be a date e.g 2020-06-30")
+			return
+		}
+	}
+	if value := r.URL.Query().Get("to"); value != "" {
+		if to, err = time.Parse("2006-01-02", value); err != nil {
+			BadRequestResponse(w, r, "to must be a date e.g 2020-06-30")
+			return
+		}
+	}
+	if to.Before(from) {
+		BadRequestResponse(w, r, "to must not be before from")
+		return
+	}
+	report, err := handler.reconciler.Run(from, to.Add(24*time.Hour))
+	if err != nil {
+		handler.logger.WithError(err).Error("/admin/reconciliation failed")
+		InternalServerErrorResponse(w, r, "failed to reconcile. please retry")
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=reconciliation-%s-%s.csv",
+			from.Format("2006-01-02"), to.Format("2006-01-02")))
+		if err := report.WriteCSV(w); err != nil {
+			handler.logger.WithError(err).Error("failed to write reconciliation csv")
+		}
+		return
+	}
+	message := "records match"
+	if len(report.Issues) > 0 {
+		message = "reconciliation found mismatches"
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: message, Data: report})
+}
+
+// Lockouts lists the accounts and IPs currently locked out after too many
+// failed attempts.
+func (handler *AdminHandler) Lockouts(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	data, err := handler.limiter.ListLocked()
+	if err != nil {
+		handler.logger.WithError(err).Error("/admin/lockouts failed")
+		InternalServerErrorResponse(w, r, "failed to fetch lockouts. please retry")
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+// ClearLockout forgets the failed attempts counted under a key, lifting
+// its lockout.
+func (handler *AdminHandler) ClearLockout(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorized(r) {
+		ForbiddenRequestResponse(w, r, "operator access required")
+		return
+	}
+	var body struct {
+		Key string `json:"key"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Key == "" {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	if err := handler.limiter.Clear(body.Key); err != nil {
+		handler.logger.WithError(err).Error("/admin/lockouts/clear failed")
+		InternalServerErrorResponse(w, r, "failed to clear lockout. please retry")
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "lockout cleared"})
+}
@@ -8,6 +8,9 @@ import (
 
 var (
 	accountHeaderKey = "X-Account-Token"
+	// twoFactorHeaderKey carries the second factor of operations that
+	// need one
+	twoFactorHeaderKey = "X-Two-Factor-Code"
 )
 
 type SuccessResponse struct {
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/adigunhammedolalekan/cashtroops/ops"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type InvoiceHandler struct {
+	invoiceOps ops.InvoiceOps
+	userOps    ops.UserOps
+	logger     *logrus.Logger
+}
+
+func NewInvoiceHandler(invoiceOps ops.InvoiceOps, userOps ops.UserOps, logger *logrus.Logger) *InvoiceHandler {
+	return &InvoiceHandler{invoiceOps: invoiceOps, userOps: userOps, logger: logger}
+}
+
+func (handler *InvoiceHandler) CreateInvoice(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	body := &types.CreateInvoiceOpts{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	invoice, err := handler.invoiceOps.CreateInvoice(sess.ID.String(), body)
+	if err != nil {
+		handler.logger.WithError(err).Error("/invoice/new failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "invoice created", Data: invoice})
+}
+
+func (handler *InvoiceHandler) ListInvoices(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	data, err := handler.invoiceOps.ListInvoices(sess.ID.String())
+	if err != nil {
+		NotFoundResponse(w, r, err.Error())
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *InvoiceHandler) CancelInvoice(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	invoice, err := handler.invoiceOps.CancelInvoice(sess.ID.String(), chi.URLParam(r, "id"))
+	if err != nil {
+		handler.logger.WithError(err).Error("/invoice/id/cancel failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "invoice cancelled", Data: invoice})
+}
+
+// GetInvoice and PayInvoice are public so the invoice link can be shared
+// with people who do not have an account.
+func (handler *InvoiceHandler) GetInvoice(w http.ResponseWriter, r *http.Request) {
+	invoice, err := handler.invoiceOps.GetInvoice(chi.URLParam(r, "code"))
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: invoice})
+}
+
+func (handler *InvoiceHandler) PayInvoice(w http.ResponseWriter, r *http.Request) {
+	body := &types.PayInvoiceRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	resp, err := handler.invoiceOps.PayInvoice(chi.URLParam(r, "code"), body)
+	if err != nil {
+		handler.logger.WithError(err).Error("/invoice/code/pay failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "payment initialized", Data: resp})
+}
@@ -0,0 +1,154 @@
+package http
+
+import (
+	"context"
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/jwt"
+	"github.com/adigunhammedolalekan/cashtroops/ops"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// RequireAccessToken rejects requests without a valid access token in
+// X-Account-Token with 401, telling clients to refresh it. The token's
+// signature, expiry and session are checked without reading any storage;
+// revoked sessions are kept in memory.
+func RequireAccessToken(userOps ops.UserOps) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, err := userOps.VerifyAccessToken(r.Header.Get(accountHeaderKey))
+			if err != nil {
+				if _, ok := err.(*errors.Error); !ok {
+					err = errors.New(http.StatusUnauthorized, err.Error())
+				}
+				Respond(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+		})
+	}
+}
+
+// Authorize only lets users the policy allows to take action through. It
+// goes after RequireAccessToken.
+func Authorize(userOps ops.UserOps, policy ops.Policy, action ops.Action) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, err := userOps.GetSession(r.Header.Get(accountHeaderKey))
+			if err != nil {
+				ForbiddenRequestResponse(w, r, err.Error())
+				return
+			}
+			if err := policy.Authorize(user, action); err != nil {
+				Respond(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireStepUp makes users with two factor authentication send a code in
+// X-Two-Factor-Code. It goes after RequireAccessToken.
+func RequireStepUp(userOps ops.UserOps) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := userOps.VerifyStepUp(accessClaims(r).Subject, r.Header.Get(twoFactorHeaderKey)); err != nil {
+				Respond(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RateLimit lets at most limit requests through every window for each key
+// that key returns, e.g UserKey or IpKey. name keeps endpoints apart.
+func RateLimit(limiter ops.RateLimiter, name string, limit int, window time.Duration, key func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := limiter.Allow(name+":"+key(r), limit, window); err != nil {
+				Respond(w, r, err)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// TrustProxies makes requests relayed by one of proxies, given as IPs or
+// CIDRs, come from the client X-Forwarded-For names instead. Only the
+// addresses the proxies appended are believed, so clients cannot choose
+// their own IP. Without proxies requests come from their peer.
+func TrustProxies(proxies []string) (func(http.Handler) http.Handler, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, next := range proxies {
+		if !strings.Contains(next, "/") {
+			if ip := net.ParseIP(next); ip != nil && ip.To4() != nil {
+				next += "/32"
+			} else {
+				next += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(next)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	trusted := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		for _, next := range networks {
+			if ip != nil && next.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := deviceOf(r).IP
+			if trusted(client) {
+				forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+				// the nearest hop that is not a proxy is the client
+				for i := len(forwarded) - 1; i >= 0; i-- {
+					hop := strings.TrimSpace(forwarded[i])
+					if net.ParseIP(hop) == nil {
+						break
+					}
+					client = hop
+					if !trusted(hop) {
+						break
+					}
+				}
+				r.RemoteAddr = client
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// UserKey rate limits the user RequireAccessToken verified.
+func UserKey(r *http.Request) string {
+	return "user:" + accessClaims(r).Subject
+}
+
+// IpKey rate limits the client's IP.
+func IpKey(r *http.Request) string {
+	return "ip:" + deviceOf(r).IP
+}
+
+// accessClaims returns the claims RequireAccessToken verified for r.
+func accessClaims(r *http.Request) *jwt.Claims {
+	claims, _ := r.Context().Value(claimsContextKey).(*jwt.Claims)
+	if claims == nil {
+		return &jwt.Claims{}
+	}
+	return claims
+}
@@ -3,23 +3,28 @@ package http
 import (
 	"encoding/json"
 	"github.com/adigunhammedolalekan/cashtroops/libs/bc"
+	"github.com/adigunhammedolalekan/cashtroops/libs/rails"
 	"github.com/adigunhammedolalekan/cashtroops/ops"
 	"github.com/adigunhammedolalekan/cashtroops/types"
 	"github.com/blockcypher/gobcy"
+	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"net/http"
 )
 
 type PaymentHandler struct {
 	paymentOps ops.PaymentOps
+	walletOps  ops.WalletOps
 	userOps    ops.UserOps
 	logger     *logrus.Logger
 }
 
-func NewPaymentHandler(paymentOps ops.PaymentOps, userOps ops.UserOps, logger *logrus.Logger) *PaymentHandler {
+func NewPaymentHandler(paymentOps ops.PaymentOps, walletOps ops.WalletOps, userOps ops.UserOps, logger *logrus.Logger) *PaymentHandler {
 	return &PaymentHandler{
 		paymentOps: paymentOps,
+		walletOps:  walletOps,
 		userOps:    userOps,
 		logger:     logger,
 	}
@@ -42,6 +47,7 @@ func (handler *PaymentHandler) InitializePayment(w http.ResponseWriter, r *http.
 		BadRequestResponse(w, r, "The amount seems to be invalid")
 		return
 	}
+	body.TwoFactorCode = r.Header.Get(twoFactorHeaderKey)
 	resp, err := handler.paymentOps.InitializePayment(sess.ID.String(), body)
 	if err != nil {
 		Respond(w, r, err)
@@ -90,7 +96,17 @@ func (handler *PaymentHandler) TxnEventHandler(w http.ResponseWriter, r *http.Re
 		BadRequestResponse(w, r, "invalid transaction data")
 		return
 	}
-	err := handler.paymentOps.FinalizePayment(recvAddress, amount)
+	deposited, err := handler.walletOps.ReceiveDeposit(tx.Hash, recvAddress, amount)
+	if err != nil {
+		handler.logger.WithError(err).Error("failed to credit deposit")
+		InternalServerErrorResponse(w, r, "failed to credit deposit")
+		return
+	}
+	if deposited {
+		render.Status(r, http.StatusOK)
+		return
+	}
+	err = handler.paymentOps.FinalizePayment(recvAddress, amount)
 	if err != nil {
 		Respond(w, r, err)
 		return
@@ -114,15 +130,22 @@ func (handler *PaymentHandler) ListPayments(w http.ResponseWriter, r *http.Reque
 }
 
 func (handler *PaymentHandler) TransferEventHandler(w http.ResponseWriter, r *http.Request) {
-	var event struct {
-		Event string               `json:"event"`
-		Data  *types.TransferEvent `json:"data"`
+	provider := chi.URLParam(r, "provider")
+	if provider == "" {
+		provider = rails.Paystack
 	}
-	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
 		BadRequestResponse(w, r, "malformed json body")
 		return
 	}
-	err := handler.paymentOps.CompletePayment(event.Event, event.Data)
+	event, err := handler.paymentOps.ParsePayoutEvent(provider, r.Header, body)
+	if err != nil {
+		handler.logger.WithError(err).WithField("provider", provider).Error("failed to parse transfer event")
+		Respond(w, r, err)
+		return
+	}
+	err = handler.paymentOps.CompletePayment(event)
 	if err != nil {
 		handler.logger.WithError(err).Error("failed to complete transfer")
 		InternalServerErrorResponse(w, r, "failed to complete transfer")
@@ -131,3 +154,24 @@ func (handler *PaymentHandler) TransferEventHandler(w http.ResponseWriter, r *ht
 	render.Status(r, http.StatusOK)
 	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success"})
 }
+
+func (handler *PaymentHandler) RefundPayment(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	body := &types.RefundRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	payment, err := handler.paymentOps.RefundPayment(sess.ID.String(), chi.URLParam(r, "id"), body.Address)
+	if err != nil {
+		handler.logger.WithError(err).Error("/payment/id/refund failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "payment refunded", Data: payment})
+}
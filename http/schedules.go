@@ -0,0 +1,86 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/adigunhammedolalekan/cashtroops/ops"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type ScheduleHandler struct {
+	scheduleOps ops.ScheduleOps
+	userOps     ops.UserOps
+	logger      *logrus.Logger
+}
+
+func NewScheduleHandler(scheduleOps ops.ScheduleOps, userOps ops.UserOps, logger *logrus.Logger) *ScheduleHandler {
+	return &ScheduleHandler{scheduleOps: scheduleOps, userOps: userOps, logger: logger}
+}
+
+func (handler *ScheduleHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	body := &types.CreateScheduleOpts{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	schedule, err := handler.scheduleOps.CreateSchedule(sess.ID.String(), body)
+	if err != nil {
+		handler.logger.WithError(err).Error("/schedule/new failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "schedule created", Data: schedule})
+}
+
+func (handler *ScheduleHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	data, err := handler.scheduleOps.ListSchedules(sess.ID.String())
+	if err != nil {
+		NotFoundResponse(w, r, err.Error())
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *ScheduleHandler) PauseSchedule(w http.ResponseWriter, r *http.Request) {
+	handler.updateSchedule(w, r, handler.scheduleOps.PauseSchedule, "schedule paused")
+}
+
+func (handler *ScheduleHandler) ResumeSchedule(w http.ResponseWriter, r *http.Request) {
+	handler.updateSchedule(w, r, handler.scheduleOps.ResumeSchedule, "schedule resumed")
+}
+
+func (handler *ScheduleHandler) CancelSchedule(w http.ResponseWriter, r *http.Request) {
+	handler.updateSchedule(w, r, handler.scheduleOps.CancelSchedule, "schedule cancelled")
+}
+
+func (handler *ScheduleHandler) updateSchedule(w http.ResponseWriter, r *http.Request,
+	update func(userId, id string) (*types.Schedule, error), message string) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	schedule, err := update(sess.ID.String(), chi.URLParam(r, "id"))
+	if err != nil {
+		handler.logger.WithError(err).WithField("path", r.URL.Path).Error("failed to update schedule")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: message, Data: schedule})
+}
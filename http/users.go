@@ -7,6 +7,7 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 )
 
@@ -25,7 +26,7 @@ func (handler *UserHandler) CreateUser(w http.ResponseWriter, r *http.Request) {
 		BadRequestResponse(w, r, "malformed request body")
 		return
 	}
-	newUser, err := handler.userOps.CreateUser(body)
+	newUser, err := handler.userOps.CreateUser(body, deviceOf(r))
 	if err != nil {
 		handler.logger.WithError(err).Error("/user/new failed")
 		Respond(w, r, err)
@@ -39,12 +40,23 @@ func (handler *UserHandler) AuthenticateUser(w http.ResponseWriter, r *http.Requ
 	var body struct {
 		Email    string `json:"email"`
 		Password string `json:"password"`
+		// Code is the second factor of users with two factor
+		// authentication, sent again with the password once asked for
+		Code string `json:"code"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		BadRequestResponse(w, r, "malformed request body")
 		return
 	}
-	user, err := handler.userOps.AuthenticateUser(body.Email, body.Password)
+	user, err := handler.userOps.AuthenticateUser(body.Email, body.Password, body.Code, deviceOf(r))
+	if err == ops.ErrTwoFactorRequired {
+		type challenge struct {
+			TwoFactorRequired bool `json:"two_factor_required"`
+		}
+		render.Status(r, http.StatusOK)
+		render.Respond(w, r, &SuccessResponse{Error: false, Message: err.Error(), Data: &challenge{TwoFactorRequired: true}})
+		return
+	}
 	if err != nil {
 		handler.logger.WithError(err).Error("failed to authenticate user")
 		Respond(w, r, err)
@@ -55,11 +67,6 @@ func (handler *UserHandler) AuthenticateUser(w http.ResponseWriter, r *http.Requ
 }
 
 func (handler *UserHandler) ActivateAccount(w http.ResponseWriter, r *http.Request) {
-	_, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
-	if err != nil {
-		ForbiddenRequestResponse(w, r, err.Error())
-		return
-	}
 	var body struct {
 		Code  string `json:"code"`
 		Email string `json:"email"`
@@ -68,7 +75,7 @@ func (handler *UserHandler) ActivateAccount(w http.ResponseWriter, r *http.Reque
 		BadRequestResponse(w, r, "malformed request body")
 		return
 	}
-	err = handler.userOps.ActivateAccount(body.Code, body.Email)
+	err := handler.userOps.ActivateAccount(body.Code, body.Email, deviceOf(r).IP)
 	if err != nil {
 		handler.logger.WithError(err).Error("failed to activate account")
 		Respond(w, r, err)
@@ -78,16 +85,43 @@ func (handler *UserHandler) ActivateAccount(w http.ResponseWriter, r *http.Reque
 	render.Respond(w, r, &SuccessResponse{Error: false, Message: "account activated"})
 }
 
-func (handler *UserHandler) Me(w http.ResponseWriter, r *http.Request) {
-	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
-	if err != nil {
-		ForbiddenRequestResponse(w, r, err.Error())
+func (handler *UserHandler) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+		Code  string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	if err := handler.userOps.UnlockAccount(body.Email, body.Code); err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "account unlocked"})
+}
+
+func (handler *UserHandler) ResendActivation(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	if err := handler.userOps.ResendActivation(body.Email); err != nil {
+		Respond(w, r, err)
 		return
 	}
-	user, err := handler.userOps.GetUserByEmail(sess.Email)
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "if the account exists and is not yet activated, a new activation code has been sent"})
+}
+
+func (handler *UserHandler) Me(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
 	if err != nil {
-		handler.logger.WithError(err).Error("user account not found")
-		NotFoundResponse(w, r, "account does not exists")
+		ForbiddenRequestResponse(w, r, err.Error())
 		return
 	}
 	render.Status(r, http.StatusOK)
@@ -103,7 +137,7 @@ func (handler *UserHandler) RequestPasswordReset(w http.ResponseWriter, r *http.
 		return
 	}
 	render.Status(r, http.StatusOK)
-	render.Respond(w, r, &SuccessResponse{Error: false, Message: "password reset requested"})
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "if an account exists for this email, a password reset code has been sent"})
 }
 
 func (handler *UserHandler) VerifyPasswordResetRequest(w http.ResponseWriter, r *http.Request) {
@@ -115,7 +149,7 @@ func (handler *UserHandler) VerifyPasswordResetRequest(w http.ResponseWriter, r
 		BadRequestResponse(w, r, "malformed request body")
 		return
 	}
-	tk, err := handler.userOps.VerifyPasswordResetRequest(body.Code, body.Email)
+	tk, err := handler.userOps.VerifyPasswordResetRequest(body.Code, body.Email, deviceOf(r).IP)
 	if err != nil {
 		handler.logger.WithError(err).Error("cannot verify password reset details")
 		Respond(w, r, err)
@@ -164,7 +198,7 @@ func (handler *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	err = handler.userOps.ChangePassword(sess.ID.String(), body.OldPassword, body.NewPassword)
+	err = handler.userOps.ChangePassword(sess.ID.String(), body.OldPassword, body.NewPassword, accessClaims(r).Session)
 	if err != nil {
 		handler.logger.WithError(err).Error("user account not found")
 		Respond(w, r, err)
@@ -173,3 +207,122 @@ func (handler *UserHandler) ChangePassword(w http.ResponseWriter, r *http.Reques
 	render.Status(r, http.StatusOK)
 	render.Respond(w, r, &SuccessResponse{Error: false, Message: "password changed"})
 }
+
+func (handler *UserHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	if err := handler.userOps.Logout(sess.ID.String(), accessClaims(r).Session); err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "signed out"})
+}
+
+func (handler *UserHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	data, err := handler.userOps.ListSessions(sess.ID.String(), accessClaims(r).Session)
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *UserHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	if err := handler.userOps.RevokeSession(sess.ID.String(), chi.URLParam(r, "id")); err != nil {
+		handler.logger.WithError(err).Error("/me/sessions/id failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "session revoked"})
+}
+
+func (handler *UserHandler) SetupTwoFactor(w http.ResponseWriter, r *http.Request) {
+	setup, err := handler.userOps.SetupTwoFactor(accessClaims(r).Subject)
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "add the secret to your authenticator app, then confirm a code", Data: setup})
+}
+
+func (handler *UserHandler) ConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	codes, err := handler.userOps.ConfirmTwoFactor(accessClaims(r).Subject, body.Code)
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
+	type backupCodes struct {
+		BackupCodes []string `json:"backup_codes"`
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "two factor authentication enabled. keep the backup codes safe, they are only shown once",
+		Data: &backupCodes{BackupCodes: codes}})
+}
+
+func (handler *UserHandler) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	if err := handler.userOps.DisableTwoFactor(accessClaims(r).Subject, body.Password, body.Code); err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "two factor authentication disabled"})
+}
+
+// RefreshToken exchanges a refresh token for new access and refresh tokens.
+func (handler *UserHandler) RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	tokens, err := handler.userOps.RefreshToken(body.RefreshToken)
+	if err != nil {
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "token refreshed", Data: tokens})
+}
+
+// deviceOf describes the client making r, for listing sessions.
+func deviceOf(r *http.Request) *types.Device {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return &types.Device{UserAgent: r.UserAgent(), IP: ip}
+}
@@ -0,0 +1,126 @@
+package http
+
+import (
+	"encoding/json"
+	"github.com/adigunhammedolalekan/cashtroops/ops"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type WalletHandler struct {
+	walletOps ops.WalletOps
+	userOps   ops.UserOps
+	logger    *logrus.Logger
+}
+
+func NewWalletHandler(walletOps ops.WalletOps, userOps ops.UserOps, logger *logrus.Logger) *WalletHandler {
+	return &WalletHandler{walletOps: walletOps, userOps: userOps, logger: logger}
+}
+
+func (handler *WalletHandler) Balances(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	data, err := handler.walletOps.GetBalances(sess.ID.String())
+	if err != nil {
+		NotFoundResponse(w, r, err.Error())
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *WalletHandler) DepositAddress(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	addr, err := handler.walletOps.GetDepositAddress(sess.ID.String(), chi.URLParam(r, "coin"))
+	if err != nil {
+		handler.logger.WithError(err).Error("/wallet/coin/address failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: addr})
+}
+
+func (handler *WalletHandler) Deposits(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	data, err := handler.walletOps.ListDeposits(sess.ID.String())
+	if err != nil {
+		NotFoundResponse(w, r, err.Error())
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *WalletHandler) Withdrawals(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	data, err := handler.walletOps.ListWithdrawals(sess.ID.String())
+	if err != nil {
+		NotFoundResponse(w, r, err.Error())
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "success", Data: data})
+}
+
+func (handler *WalletHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	body := &types.WithdrawRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	body.TwoFactorCode = r.Header.Get(twoFactorHeaderKey)
+	withdrawal, err := handler.walletOps.Withdraw(sess.ID.String(), body)
+	if err != nil {
+		handler.logger.WithError(err).Error("/wallet/withdraw failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "withdrawal sent", Data: withdrawal})
+}
+
+func (handler *WalletHandler) PayFromBalance(w http.ResponseWriter, r *http.Request) {
+	sess, err := handler.userOps.GetSession(r.Header.Get(accountHeaderKey))
+	if err != nil {
+		ForbiddenRequestResponse(w, r, err.Error())
+		return
+	}
+	body := &types.BalancePaymentRequest{}
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		BadRequestResponse(w, r, "malformed request body")
+		return
+	}
+	body.TwoFactorCode = r.Header.Get(twoFactorHeaderKey)
+	payment, err := handler.walletOps.PayFromBalance(sess.ID.String(), body)
+	if err != nil {
+		handler.logger.WithError(err).Error("/wallet/pay failed")
+		Respond(w, r, err)
+		return
+	}
+	render.Status(r, http.StatusOK)
+	render.Respond(w, r, &SuccessResponse{Error: false, Message: "payment initialized", Data: payment})
+}
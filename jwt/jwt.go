@@ -0,0 +1,135 @@
+// Package jwt signs and verifies HS256 JSON Web Tokens. Every token names
+// the key it was signed with in its kid header, so keys can be rotated by
+// adding a new current key while still accepting tokens signed with the
+// previous ones until they expire.
+package jwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const algorithm = "HS256"
+
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrUnknownKey = errors.New("token is signed with an unknown key")
+	ErrSignature  = errors.New("token signature is invalid")
+	ErrExpired    = errors.New("token has expired")
+	ErrNoKey      = errors.New("current signing key is not configured")
+)
+
+var encoding = base64.RawURLEncoding
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyId     string `json:"kid"`
+}
+
+// Claims identify the user and session an access token was issued for.
+// Times are unix seconds.
+type Claims struct {
+	Subject   string `json:"sub"`
+	Session   string `json:"sid"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+type Signer struct {
+	keys    map[string][]byte
+	current string
+	now     func() time.Time
+}
+
+// NewSigner returns a Signer that signs with keys[current] and verifies
+// with any of keys.
+func NewSigner(keys map[string]string, current string) (*Signer, error) {
+	if keys[current] == "" {
+		return nil, ErrNoKey
+	}
+	signer := &Signer{keys: make(map[string][]byte), current: current, now: time.Now}
+	for kid, secret := range keys {
+		if secret != "" {
+			signer.keys[kid] = []byte(secret)
+		}
+	}
+	return signer, nil
+}
+
+// Sign returns a token for subject and session that expires ttl from now.
+func (s *Signer) Sign(subject, session string, ttl time.Duration) (string, error) {
+	now := s.now()
+	claims := &Claims{
+		Subject:   subject,
+		Session:   session,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	headerData, err := json.Marshal(&header{Algorithm: algorithm, Type: "JWT", KeyId: s.current})
+	if err != nil {
+		return "", err
+	}
+	claimsData, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encoding.EncodeToString(headerData) + "." + encoding.EncodeToString(claimsData)
+	return signed + "." + encoding.EncodeToString(sign(s.keys[s.current], signed)), nil
+}
+
+// Verify returns the claims of token if it was signed with one of the
+// signer's keys and has not expired.
+func (s *Signer) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	headerData, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	h := &header{}
+	if err := json.Unmarshal(headerData, h); err != nil {
+		return nil, ErrMalformed
+	}
+	// the algorithm is fixed rather than taken from the token, so a token
+	// cannot choose how it is checked
+	if h.Algorithm != algorithm {
+		return nil, ErrMalformed
+	}
+	key, ok := s.keys[h.KeyId]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return nil, ErrSignature
+	}
+	claimsData, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(claimsData, claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if s.now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+func sign(key []byte, value string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
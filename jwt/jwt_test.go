@@ -0,0 +1,59 @@
+package jwt
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignVerify(t *testing.T) {
+	signer, err := NewSigner(map[string]string{"2020-06": "first secret"}, "2020-06")
+	assert.Nil(t, err)
+	token, err := signer.Sign("user", "session", time.Minute)
+	assert.Nil(t, err)
+	claims, err := signer.Verify(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "user", claims.Subject)
+	assert.Equal(t, "session", claims.Session)
+
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + encoding.EncodeToString([]byte(`{"sub":"admin","sid":"session","exp":9999999999}`)) + "." + parts[2]
+	_, err = signer.Verify(forged)
+	assert.Equal(t, ErrSignature, err)
+	_, err = signer.Verify("not a token")
+	assert.Equal(t, ErrMalformed, err)
+
+	unsigned := encoding.EncodeToString([]byte(`{"alg":"none","kid":"2020-06"}`)) + "." + parts[1] + "."
+	_, err = signer.Verify(unsigned)
+	assert.Equal(t, ErrMalformed, err)
+}
+
+func TestExpiry(t *testing.T) {
+	signer, _ := NewSigner(map[string]string{"k": "secret"}, "k")
+	token, _ := signer.Sign("user", "session", time.Minute)
+	signer.now = func() time.Time { return time.Now().Add(time.Minute) }
+	_, err := signer.Verify(token)
+	assert.Equal(t, ErrExpired, err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, _ := NewSigner(map[string]string{"old": "old secret"}, "old")
+	token, _ := old.Sign("user", "session", time.Minute)
+
+	// the new key signs, the old one is still accepted
+	rotated, _ := NewSigner(map[string]string{"old": "old secret", "new": "new secret"}, "new")
+	_, err := rotated.Verify(token)
+	assert.Nil(t, err)
+	newToken, _ := rotated.Sign("user", "session", time.Minute)
+	_, err = old.Verify(newToken)
+	assert.Equal(t, ErrUnknownKey, err)
+
+	// once the old key is retired its tokens are rejected
+	retired, _ := NewSigner(map[string]string{"new": "new secret"}, "new")
+	_, err = retired.Verify(token)
+	assert.Equal(t, ErrUnknownKey, err)
+
+	_, err = NewSigner(map[string]string{"old": "old secret"}, "new")
+	assert.Equal(t, ErrNoKey, err)
+}
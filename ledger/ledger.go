@@ -0,0 +1,264 @@
+// Package ledger records every movement of money as a balanced, immutable
+// double-entry journal. Amounts are signed, in the asset's smallest unit:
+// debits are positive and credits are negative, so the entries of a journal
+// sum to zero for every asset it touches.
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// Accounts shared by every user. Coin is held in DepositClearing until it is
+// converted in Fx into what is owed to beneficiaries in PayoutClearing.
+// NetworkFees is the coin paid to miners for transactions we send.
+const (
+	DepositClearing = "deposit_clearing"
+	Fx              = "fx"
+	PayoutClearing  = "payout_clearing"
+	FeeRevenue      = "fee_revenue"
+	NetworkFees     = "network_fees"
+)
+
+// Journal kinds, one for each step money moves in.
+const (
+	KindCoinReceived     = "coin_received"
+	KindBalancePayment   = "balance_payment"
+	KindPayoutInitiated  = "payout_initiated"
+	KindPayoutFailed     = "payout_failed"
+	KindRefund           = "refund"
+	KindReturnToBalance  = "return_to_balance"
+	KindDeposit          = "deposit"
+	KindWithdrawal       = "withdrawal"
+	KindWithdrawalFailed = "withdrawal_failed"
+)
+
+var (
+	ErrUnbalanced = errors.New("journal does not balance")
+	ErrEmpty      = errors.New("journal has no entries")
+)
+
+// UserWallet is the account holding a user's custodial balance.
+func UserWallet(userId string) string {
+	return "wallet:" + userId
+}
+
+// ProviderFloat is the account for the balance held with a payout provider.
+func ProviderFloat(provider string) string {
+	return "float:" + provider
+}
+
+// Journal groups the entries of one money movement. Kind and Reference
+// identify it, so the same movement is never posted twice.
+type Journal struct {
+	ID        uuid.UUID `json:"id" gorm:"primary_key"`
+	Kind      string    `json:"kind" gorm:"unique_index:idx_ledger_journals_kind_reference"`
+	Reference string    `json:"reference" gorm:"unique_index:idx_ledger_journals_kind_reference"`
+	Memo      string    `json:"memo"`
+	Ts        time.Time `json:"ts"`
+}
+
+func (j *Journal) TableName() string {
+	return "ledger_journals"
+}
+
+func (j *Journal) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
+type Entry struct {
+	ID        uuid.UUID `json:"id" gorm:"primary_key"`
+	JournalId string    `json:"journal_id" gorm:"index"`
+	Account   string    `json:"account" gorm:"index"`
+	Asset     string    `json:"asset"`
+	Amount    int64     `json:"amount"`
+	Ts        time.Time `json:"ts"`
+}
+
+func (e *Entry) TableName() string {
+	return "ledger_entries"
+}
+
+func (e *Entry) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
+// Line is an entry waiting to be posted.
+type Line struct {
+	Account string
+	Asset   string
+	Amount  int64
+}
+
+func Debit(account, asset string, amount int64) Line {
+	return Line{Account: account, Asset: asset, Amount: amount}
+}
+
+func Credit(account, asset string, amount int64) Line {
+	return Line{Account: account, Asset: asset, Amount: -amount}
+}
+
+type AccountBalance struct {
+	Account string `json:"account"`
+	Asset   string `json:"asset"`
+	Balance int64  `json:"balance"`
+}
+
+// Imbalance is a journal whose entries do not sum to zero for an asset.
+type Imbalance struct {
+	JournalId string `json:"journal_id"`
+	Asset     string `json:"asset"`
+	Sum       int64  `json:"sum"`
+}
+
+type Ledger struct {
+	db *gorm.DB
+}
+
+func New(db *gorm.DB) *Ledger {
+	return &Ledger{db: db}
+}
+
+// Post records lines as a journal in its own transaction. Posting a kind and
+// reference that has already been posted does nothing.
+func (l *Ledger) Post(kind, reference, memo string, lines ...Line) error {
+	tx := l.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if err := l.PostTx(tx, kind, reference, memo, lines...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// PostTx is Post within tx, so the journal is only recorded if the rest of
+// tx is.
+func (l *Ledger) PostTx(tx *gorm.DB, kind, reference, memo string, lines ...Line) error {
+	if err := validate(lines); err != nil {
+		return fmt.Errorf("%s %s: %v", kind, reference, err)
+	}
+	var count int
+	if err := tx.Table("ledger_journals").Where("kind = ? AND reference = ?", kind, reference).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	now := time.Now()
+	journal := &Journal{Kind: kind, Reference: reference, Memo: memo, Ts: now}
+	if err := tx.Table("ledger_journals").Create(journal).Error; err != nil {
+		return err
+	}
+	for _, next := range lines {
+		if next.Amount == 0 {
+			continue
+		}
+		entry := &Entry{
+			JournalId: journal.ID.String(),
+			Account:   next.Account,
+			Asset:     next.Asset,
+			Amount:    next.Amount,
+			Ts:        now,
+		}
+		if err := tx.Table("ledger_entries").Create(entry).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reverse posts the mirror image of the journal with kind and reference as
+// a journal of reversalKind. It does nothing when there is no such journal.
+func (l *Ledger) Reverse(kind, reference, reversalKind, memo string) error {
+	tx := l.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if err := l.ReverseTx(tx, kind, reference, reversalKind, memo); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func (l *Ledger) ReverseTx(tx *gorm.DB, kind, reference, reversalKind, memo string) error {
+	lines, err := l.MirrorTx(tx, kind, reference)
+	if err != nil || len(lines) == 0 {
+		return err
+	}
+	return l.PostTx(tx, reversalKind, reference, memo, lines...)
+}
+
+// MirrorTx returns the lines that would reverse the journal with kind and
+// reference, or none when there is no such journal.
+func (l *Ledger) MirrorTx(tx *gorm.DB, kind, reference string) ([]Line, error) {
+	journal := &Journal{}
+	err := tx.Table("ledger_journals").Where("kind = ? AND reference = ?", kind, reference).First(journal).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*Entry, 0)
+	if err := tx.Table("ledger_entries").Where("journal_id = ?", journal.ID.String()).
+		Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	lines := make([]Line, 0, len(entries))
+	for _, next := range entries {
+		lines = append(lines, Line{Account: next.Account, Asset: next.Asset, Amount: -next.Amount})
+	}
+	return lines, nil
+}
+
+// Balance returns the balance of account in asset. Positive balances are
+// debit balances.
+func (l *Ledger) Balance(account, asset string) (int64, error) {
+	var result struct {
+		Balance int64
+	}
+	err := l.db.Table("ledger_entries").Select("COALESCE(SUM(amount), 0) AS balance").
+		Where("account = ? AND asset = ?", account, asset).Scan(&result).Error
+	return result.Balance, err
+}
+
+// Balances returns the balance of every account and asset.
+func (l *Ledger) Balances() ([]*AccountBalance, error) {
+	values := make([]*AccountBalance, 0)
+	err := l.db.Table("ledger_entries").Select("account, asset, SUM(amount) AS balance").
+		Group("account, asset").Order("account, asset").Scan(&values).Error
+	return values, err
+}
+
+// Check returns every journal that does not balance. A healthy ledger has
+// none.
+func (l *Ledger) Check() ([]*Imbalance, error) {
+	values := make([]*Imbalance, 0)
+	err := l.db.Table("ledger_entries").Select("journal_id, asset, SUM(amount) AS sum").
+		Group("journal_id, asset").Having("SUM(amount) <> 0").Scan(&values).Error
+	return values, err
+}
+
+// validate checks that lines sum to zero for every asset.
+func validate(lines []Line) error {
+	if len(lines) == 0 {
+		return ErrEmpty
+	}
+	sums := make(map[string]int64)
+	for _, next := range lines {
+		sums[next.Asset] += next.Amount
+	}
+	for _, sum := range sums {
+		if sum != 0 {
+			return ErrUnbalanced
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package ledger
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	assert.Equal(t, ErrEmpty, validate(nil))
+	assert.Nil(t, validate([]Line{
+		Debit(DepositClearing, "BTC", 1000),
+		Credit(Fx, "BTC", 1000),
+		Debit(Fx, "NGN", 5100),
+		Credit(PayoutClearing, "NGN", 5000),
+		Credit(FeeRevenue, "NGN", 100),
+	}))
+	// balanced overall but not per asset
+	assert.Equal(t, ErrUnbalanced, validate([]Line{
+		Debit(DepositClearing, "BTC", 1000),
+		Credit(PayoutClearing, "NGN", 1000),
+	}))
+	assert.Equal(t, ErrUnbalanced, validate([]Line{
+		Debit(UserWallet("1"), "BTC", 1000),
+		Credit(DepositClearing, "BTC", 999),
+	}))
+}
@@ -1,16 +1,60 @@
 package bc
 
 import (
+	"errors"
 	"fmt"
 	"github.com/adigunhammedolalekan/cashtroops/libs"
+	"github.com/blockcypher/gobcy"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/btcsuite/btcutil/bech32"
 	"github.com/sirupsen/logrus"
+	"math/big"
+	"strings"
+	"time"
 )
 
 const (
 	bcAddress               = "https://api.blockcypher.com/v1/%s/%s"
 	EventTypeTxConfirmation = "confirmed-tx"
+
+	// estimated size in bytes of a one input, one output P2PKH transaction
+	singleOutputTxSize = 226
 )
 
+var ErrInvalidAddress = errors.New("invalid address for coin")
+
+// NotSentError is returned by Send when it failed before the transaction
+// was broadcast, so no coin has left the address.
+type NotSentError struct {
+	Err error
+}
+
+func (e *NotSentError) Error() string {
+	return "transaction was not sent: " + e.Err.Error()
+}
+
+// IsNotSent reports whether err is known to have stopped Send before the
+// transaction was broadcast. Any other error from Send may have come after
+// it was.
+func IsNotSent(err error) bool {
+	_, ok := err.(*NotSentError)
+	return ok
+}
+
+// addressVersions holds the accepted base58 version bytes and bech32
+// prefix for each coin/network pair supported by BlockCypher.
+var addressVersions = map[string]struct {
+	versions []byte
+	hrp      string
+}{
+	"btc/main":  {versions: []byte{0x00, 0x05}, hrp: "bc"},
+	"btc/test3": {versions: []byte{0x6f, 0xc4}, hrp: "tb"},
+	"ltc/main":  {versions: []byte{0x30, 0x32, 0x05}, hrp: "ltc"},
+	"doge/main": {versions: []byte{0x1e, 0x16}},
+	"dash/main": {versions: []byte{0x4c, 0x10}},
+	"bcy/test":  {versions: []byte{0x1b, 0x1f}},
+}
+
 type Address struct {
 	Private string `json:"private"`
 	Public  string `json:"public"`
@@ -26,11 +70,26 @@ type Event struct {
 	Address string `json:"address"`
 }
 
+// TxRef is a transaction input or output involving an address. Received
+// coin has a TxOutputN of 0 or more.
+type TxRef struct {
+	TxHash        string    `json:"tx_hash"`
+	TxInputN      int       `json:"tx_input_n"`
+	TxOutputN     int       `json:"tx_output_n"`
+	Value         int64     `json:"value"`
+	Confirmations int       `json:"confirmations"`
+	Confirmed     time.Time `json:"confirmed"`
+}
+
 type Client interface {
 	GenerateAddress() (*Address, error)
 	SetupWebHooks(hooks []Event) error
 	ListHooks() ([]Event, error)
 	AddHook(event Event) (*Event, error)
+	ValidateAddress(address string) error
+	EstimateFee() (int64, error)
+	Send(from *Address, to string, amount, fee int64) (string, error)
+	AddressTransactions(address string) ([]TxRef, error)
 }
 
 type client struct {
@@ -108,3 +167,84 @@ func (o *client) AddHook(event Event) (*Event, error) {
 	}
 	return e, nil
 }
+
+// ValidateAddress checks that address is well formed and belongs to the
+// coin and network this client was created for.
+func (o *client) ValidateAddress(address string) error {
+	address = strings.TrimSpace(address)
+	params, ok := addressVersions[o.coin+"/"+o.network]
+	if !ok {
+		return fmt.Errorf("address validation is not supported for %s/%s", o.coin, o.network)
+	}
+	if params.hrp != "" && strings.HasPrefix(strings.ToLower(address), params.hrp+"1") {
+		hrp, _, err := bech32.Decode(address)
+		if err != nil || hrp != params.hrp {
+			return ErrInvalidAddress
+		}
+		return nil
+	}
+	_, version, err := base58.CheckDecode(address)
+	if err != nil {
+		return ErrInvalidAddress
+	}
+	for _, next := range params.versions {
+		if next == version {
+			return nil
+		}
+	}
+	return ErrInvalidAddress
+}
+
+// EstimateFee returns the network fee, in the coin's smallest unit, for a
+// single input and single output transaction at medium priority.
+func (o *client) EstimateFee() (int64, error) {
+	chainUrl := fmt.Sprintf(bcAddress+"?token=%s", o.coin, o.network, o.token)
+	chain := &gobcy.Blockchain{}
+	if err := o.httpClient.Do(chainUrl, "GET", nil, chain); err != nil {
+		return 0, err
+	}
+	return int64(chain.MediumFee) * singleOutputTxSize / 1000, nil
+}
+
+// Send moves amount from the from address to the to address, paying fee to
+// the network. It returns the hash of the broadcast transaction, or a
+// NotSentError when it failed before broadcasting it.
+func (o *client) Send(from *Address, to string, amount, fee int64) (string, error) {
+	trans := gobcy.TempNewTX(from.Address, to, *big.NewInt(amount))
+	trans.Fees = *big.NewInt(fee)
+	newTxUrl := fmt.Sprintf(bcAddress+"/txs/new?token=%s", o.coin, o.network, o.token)
+	skel := &gobcy.TXSkel{}
+	if err := o.httpClient.Do(newTxUrl, "POST", &trans, skel); err != nil {
+		return "", &NotSentError{Err: err}
+	}
+	keys := make([]string, len(skel.ToSign))
+	for i := range keys {
+		keys[i] = from.Private
+	}
+	if err := skel.Sign(keys); err != nil {
+		return "", &NotSentError{Err: err}
+	}
+	sendTxUrl := fmt.Sprintf(bcAddress+"/txs/send?token=%s", o.coin, o.network, o.token)
+	sent := &gobcy.TXSkel{}
+	if err := o.httpClient.Do(sendTxUrl, "POST", skel, sent); err != nil {
+		// a rejected transaction was not relayed, anything else may have been
+		if apiErr, ok := err.(*libs.APIError); ok && apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 {
+			return "", &NotSentError{Err: err}
+		}
+		return "", err
+	}
+	return sent.Trans.Hash, nil
+}
+
+// AddressTransactions returns the confirmed transaction inputs and outputs
+// involving address, newest first.
+func (o *client) AddressTransactions(address string) ([]TxRef, error) {
+	var data struct {
+		TxRefs []TxRef `json:"txrefs"`
+	}
+	addrUrl := fmt.Sprintf(bcAddress+"/addrs/%s?limit=2000&token=%s", o.coin, o.network, address, o.token)
+	if err := o.httpClient.Do(addrUrl, "GET", nil, &data); err != nil {
+		return nil, err
+	}
+	return data.TxRefs, nil
+}
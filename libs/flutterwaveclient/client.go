@@ -0,0 +1,116 @@
+package flutterwaveclient
+
+import (
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/libs"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+const (
+	baseUrl = "https://api.flutterwave.com/v3"
+)
+
+type BeneficiaryBody struct {
+	AccountBank     string `json:"account_bank"`
+	AccountNumber   string `json:"account_number"`
+	BeneficiaryName string `json:"beneficiary_name"`
+	Currency        string `json:"currency"`
+}
+
+type Beneficiary struct {
+	ID            int    `json:"id"`
+	AccountNumber string `json:"account_number"`
+	BankCode      string `json:"bank_code"`
+	FullName      string `json:"full_name"`
+}
+
+type ResolvedAccount struct {
+	AccountNumber string `json:"account_number"`
+	AccountName   string `json:"account_name"`
+}
+
+// TransferRequest amounts are in the currency's major unit e.g NAIRA
+type TransferRequest struct {
+	AccountBank   string  `json:"account_bank"`
+	AccountNumber string  `json:"account_number"`
+	Amount        float64 `json:"amount"`
+	Narration     string  `json:"narration"`
+	Currency      string  `json:"currency"`
+	Reference     string  `json:"reference"`
+}
+
+type Transfer struct {
+	ID            int       `json:"id"`
+	AccountNumber string    `json:"account_number"`
+	BankCode      string    `json:"bank_code"`
+	FullName      string    `json:"full_name"`
+	CreatedAt     time.Time `json:"created_at"`
+	Currency      string    `json:"currency"`
+	Amount        float64   `json:"amount"`
+	Fee           float64   `json:"fee"`
+	Status        string    `json:"status"`
+	Reference     string    `json:"reference"`
+	Narration     string    `json:"narration"`
+	CompleteMsg   string    `json:"complete_message"`
+}
+
+type Client interface {
+	CreateBeneficiary(body *BeneficiaryBody) (*Beneficiary, error)
+	ResolveAccount(accountNumber, bankCode string) (*ResolvedAccount, error)
+	InitiateTransfer(req *TransferRequest) (*Transfer, error)
+	GetTransfer(id int) (*Transfer, error)
+}
+
+type flutterwaveClient struct {
+	httpClient *libs.HttpClient
+}
+
+func New(secretKey string, logger *logrus.Logger) Client {
+	return &flutterwaveClient{httpClient: libs.NewHttpClient(logger, secretKey)}
+}
+
+func (fw *flutterwaveClient) CreateBeneficiary(body *BeneficiaryBody) (*Beneficiary, error) {
+	var data struct {
+		Data *Beneficiary `json:"data"`
+	}
+	u := fmt.Sprintf("%s/beneficiaries", baseUrl)
+	if err := fw.httpClient.Do(u, "POST", body, &data); err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (fw *flutterwaveClient) ResolveAccount(accountNumber, bankCode string) (*ResolvedAccount, error) {
+	var data struct {
+		Data *ResolvedAccount `json:"data"`
+	}
+	body := map[string]string{"account_number": accountNumber, "account_bank": bankCode}
+	u := fmt.Sprintf("%s/accounts/resolve", baseUrl)
+	if err := fw.httpClient.Do(u, "POST", body, &data); err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (fw *flutterwaveClient) InitiateTransfer(req *TransferRequest) (*Transfer, error) {
+	var data struct {
+		Data *Transfer `json:"data"`
+	}
+	u := fmt.Sprintf("%s/transfers", baseUrl)
+	if err := fw.httpClient.Do(u, "POST", req, &data); err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (fw *flutterwaveClient) GetTransfer(id int) (*Transfer, error) {
+	var data struct {
+		Data *Transfer `json:"data"`
+	}
+	u := fmt.Sprintf("%s/transfers/%d", baseUrl, id)
+	if err := fw.httpClient.Do(u, "GET", nil, &data); err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
@@ -10,6 +10,17 @@ import (
 	"time"
 )
 
+// APIError is returned by Do when the remote API responds with a non 2xx
+// status code.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return "failed to complete api call"
+}
+
 type HttpClient struct {
 	inner       *http.Client
 	bearerToken string
@@ -58,7 +69,7 @@ func (o *HttpClient) Do(url, method string, reqBody, resp interface{}) error {
 	}
 	if res.StatusCode < 101 || res.StatusCode > 299 {
 		o.logger.WithError(errors.New(string(body))).Error("API call error")
-		return errors.New("failed to complete api call")
+		return &APIError{StatusCode: res.StatusCode, Body: string(body)}
 	}
 	if resp != nil {
 		if err := json.Unmarshal(body, resp); err != nil {
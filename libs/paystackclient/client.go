@@ -5,6 +5,7 @@ import (
 	"github.com/adigunhammedolalekan/cashtroops/libs"
 	"github.com/adigunhammedolalekan/cashtroops/types"
 	"github.com/sirupsen/logrus"
+	"net/url"
 	"time"
 )
 
@@ -46,12 +47,63 @@ type InitiateTransferRequest struct {
 	Amount    int64  `json:"amount"`
 	Recipient string `json:"recipient"`
 	Reason    string `json:"reason"`
+	Reference string `json:"reference,omitempty"`
+}
+
+type BulkTransferItem struct {
+	Amount    int64  `json:"amount"`
+	Recipient string `json:"recipient"`
+	Reference string `json:"reference"`
+	Reason    string `json:"reason"`
+}
+
+type BulkTransferRequest struct {
+	Currency  string              `json:"currency"`
+	Source    string              `json:"source"`
+	Transfers []*BulkTransferItem `json:"transfers"`
+}
+
+type BulkTransferResult struct {
+	Reference    string `json:"reference"`
+	Recipient    string `json:"recipient"`
+	Amount       int64  `json:"amount"`
+	TransferCode string `json:"transfer_code"`
+	Currency     string `json:"currency"`
+	Status       string `json:"status"`
+}
+
+type FinalizeTransferRequest struct {
+	TransferCode string `json:"transfer_code"`
+	Otp          string `json:"otp"`
+}
+
+type Balance struct {
+	Currency string `json:"currency"`
+	Balance  int64  `json:"balance"`
+}
+
+// ListedTransfer is a transfer as returned when listing transfers
+type ListedTransfer struct {
+	ID           int       `json:"id"`
+	Reference    string    `json:"reference"`
+	Amount       int64     `json:"amount"`
+	Currency     string    `json:"currency"`
+	Status       string    `json:"status"`
+	TransferCode string    `json:"transfer_code"`
+	CreatedAt    time.Time `json:"createdAt"`
 }
 
 type Client interface {
 	CreateTransferRecipient(recipient *TransferRecipientBody) (*TransferRecipient, error)
 	InitiateTransfer(req *InitiateTransferRequest) (*types.Transfer, error)
 	ResolveAccountNumber(accountNumber, bankCode string) (*types.BankAccount, error)
+	FinalizeTransfer(req *FinalizeTransferRequest) (*types.Transfer, error)
+	ResendTransferOtp(transferCode string) error
+	InitiateBulkTransfer(req *BulkTransferRequest) ([]*BulkTransferResult, error)
+	Balance() ([]*Balance, error)
+	VerifyTransfer(reference string) (*types.Transfer, error)
+	ListBanks(currency, bankType string) ([]types.Bank, error)
+	ListTransfers(from, to time.Time) ([]*ListedTransfer, error)
 }
 
 type paystackClient struct {
@@ -88,8 +140,113 @@ func (ps *paystackClient) InitiateTransfer(req *InitiateTransferRequest) (*types
 }
 
 func (ps *paystackClient) ResolveAccountNumber(accountNumber, bankCode string) (*types.BankAccount, error) {
-	account := &types.BankAccount{}
-	u := fmt.Sprintf("%s/bank/resolve?account_number=%s&bank_code=%s", baseUrl, accountNumber, bankCode)
-	err := ps.httpClient.Do(u, "GET", nil, account)
-	return account, err
+	var data struct {
+		Data *types.BankAccount `json:"data"`
+	}
+	u := fmt.Sprintf("%s/bank/resolve?account_number=%s&bank_code=%s", baseUrl,
+		url.QueryEscape(accountNumber), url.QueryEscape(bankCode))
+	err := ps.httpClient.Do(u, "GET", nil, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (ps *paystackClient) FinalizeTransfer(req *FinalizeTransferRequest) (*types.Transfer, error) {
+	var data struct {
+		Data *types.Transfer `json:"data"`
+	}
+	u := fmt.Sprintf("%s/transfer/finalize_transfer", baseUrl)
+	err := ps.httpClient.Do(u, "POST", req, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (ps *paystackClient) ResendTransferOtp(transferCode string) error {
+	body := map[string]string{"transfer_code": transferCode, "reason": "transfer"}
+	u := fmt.Sprintf("%s/transfer/resend_otp", baseUrl)
+	return ps.httpClient.Do(u, "POST", body, nil)
+}
+
+func (ps *paystackClient) InitiateBulkTransfer(req *BulkTransferRequest) ([]*BulkTransferResult, error) {
+	var data struct {
+		Data []*BulkTransferResult `json:"data"`
+	}
+	u := fmt.Sprintf("%s/transfer/bulk", baseUrl)
+	err := ps.httpClient.Do(u, "POST", req, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (ps *paystackClient) Balance() ([]*Balance, error) {
+	var data struct {
+		Data []*Balance `json:"data"`
+	}
+	u := fmt.Sprintf("%s/balance", baseUrl)
+	err := ps.httpClient.Do(u, "GET", nil, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (ps *paystackClient) VerifyTransfer(reference string) (*types.Transfer, error) {
+	var data struct {
+		Data *types.Transfer `json:"data"`
+	}
+	u := fmt.Sprintf("%s/transfer/verify/%s", baseUrl, reference)
+	err := ps.httpClient.Do(u, "GET", nil, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Data, nil
+}
+
+func (ps *paystackClient) ListBanks(currency, bankType string) ([]types.Bank, error) {
+	values := make([]types.Bank, 0)
+	next := ""
+	for {
+		var data struct {
+			Data []types.Bank `json:"data"`
+			Meta struct {
+				Next string `json:"next"`
+			} `json:"meta"`
+		}
+		u := fmt.Sprintf("%s/bank?currency=%s&type=%s&use_cursor=true&perPage=100&next=%s", baseUrl,
+			url.QueryEscape(currency), url.QueryEscape(bankType), url.QueryEscape(next))
+		if err := ps.httpClient.Do(u, "GET", nil, &data); err != nil {
+			return nil, err
+		}
+		values = append(values, data.Data...)
+		if data.Meta.Next == "" || len(data.Data) == 0 {
+			return values, nil
+		}
+		next = data.Meta.Next
+	}
+}
+
+// ListTransfers returns every transfer created between from and to.
+func (ps *paystackClient) ListTransfers(from, to time.Time) ([]*ListedTransfer, error) {
+	values := make([]*ListedTransfer, 0)
+	for page := 1; ; page++ {
+		var data struct {
+			Data []*ListedTransfer `json:"data"`
+			Meta struct {
+				PageCount int `json:"pageCount"`
+			} `json:"meta"`
+		}
+		u := fmt.Sprintf("%s/transfer?perPage=100&page=%d&from=%s&to=%s", baseUrl, page,
+			url.QueryEscape(from.UTC().Format(time.RFC3339)), url.QueryEscape(to.UTC().Format(time.RFC3339)))
+		if err := ps.httpClient.Do(u, "GET", nil, &data); err != nil {
+			return nil, err
+		}
+		values = append(values, data.Data...)
+		if page >= data.Meta.PageCount || len(data.Data) == 0 {
+			return values, nil
+		}
+	}
 }
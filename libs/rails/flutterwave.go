@@ -0,0 +1,128 @@
+package rails
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/adigunhammedolalekan/cashtroops/libs/flutterwaveclient"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const Flutterwave = "flutterwave"
+
+type flutterwaveRail struct {
+	fw          flutterwaveclient.Client
+	webhookHash string
+}
+
+// NewFlutterwave returns a PayoutProvider backed by fw. webhookHash is the
+// secret hash configured on the Flutterwave dashboard.
+func NewFlutterwave(fw flutterwaveclient.Client, webhookHash string) PayoutProvider {
+	return &flutterwaveRail{fw: fw, webhookHash: webhookHash}
+}
+
+func (f *flutterwaveRail) Name() string {
+	return Flutterwave
+}
+
+func (f *flutterwaveRail) CreateRecipient(req *RecipientRequest) (string, error) {
+	beneficiary, err := f.fw.CreateBeneficiary(&flutterwaveclient.BeneficiaryBody{
+		AccountBank:     req.BankCode,
+		AccountNumber:   req.AccountNumber,
+		BeneficiaryName: req.Name,
+		Currency:        req.Currency,
+	})
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(beneficiary.ID), nil
+}
+
+func (f *flutterwaveRail) ResolveAccount(accountNumber, bankCode string) (*types.BankAccount, error) {
+	account, err := f.fw.ResolveAccount(accountNumber, bankCode)
+	if err != nil {
+		return nil, err
+	}
+	return &types.BankAccount{AccountName: account.AccountName, AccountNumber: account.AccountNumber}, nil
+}
+
+func (f *flutterwaveRail) InitiateTransfer(req *TransferRequest) (*types.Transfer, error) {
+	transfer, err := f.fw.InitiateTransfer(&flutterwaveclient.TransferRequest{
+		AccountBank:   req.BankCode,
+		AccountNumber: req.AccountNumber,
+		Amount:        float64(req.Amount) / 100,
+		Narration:     req.Reason,
+		Currency:      req.Currency,
+		Reference:     req.Reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return toTransfer(transfer), nil
+}
+
+func (f *flutterwaveRail) VerifyTransfer(transfer *types.Transfer) (*types.Transfer, error) {
+	value, err := f.fw.GetTransfer(transfer.ID)
+	if err != nil {
+		return nil, err
+	}
+	return toTransfer(value), nil
+}
+
+func (f *flutterwaveRail) ParseWebhook(header http.Header, body []byte) (*types.PayoutEvent, error) {
+	hash := header.Get("Verif-Hash")
+	if f.webhookHash == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(f.webhookHash)) != 1 {
+		return nil, ErrInvalidSignature
+	}
+	var event struct {
+		Event string                      `json:"event"`
+		Data  *flutterwaveclient.Transfer `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.Data == nil {
+		return nil, errors.New("webhook has no transfer data")
+	}
+	status := ""
+	if event.Event == "transfer.completed" {
+		switch strings.ToUpper(event.Data.Status) {
+		case "SUCCESSFUL":
+			status = types.PayoutEventSuccess
+		case "FAILED":
+			status = types.PayoutEventFailed
+		}
+	}
+	return &types.PayoutEvent{
+		Provider:     Flutterwave,
+		Reference:    event.Data.Reference,
+		TransferCode: strconv.Itoa(event.Data.ID),
+		Status:       status,
+	}, nil
+}
+
+func toTransfer(t *flutterwaveclient.Transfer) *types.Transfer {
+	status := strings.ToLower(t.Status)
+	switch status {
+	case "new", "pending":
+		status = "pending"
+	case "successful":
+		status = "success"
+	}
+	return &types.Transfer{
+		Reference:    t.Reference,
+		Amount:       int(t.Amount * 100),
+		Currency:     t.Currency,
+		Reason:       t.Narration,
+		Status:       status,
+		TransferCode: strconv.Itoa(t.ID),
+		Provider:     Flutterwave,
+		ID:           t.ID,
+		CreatedAt:    t.CreatedAt,
+		UpdatedAt:    time.Now(),
+	}
+}
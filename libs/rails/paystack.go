@@ -0,0 +1,105 @@
+package rails
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"net/http"
+)
+
+const Paystack = "paystack"
+
+type paystackRail struct {
+	ps        paystackclient.Client
+	secretKey string
+}
+
+// NewPaystack returns a PayoutProvider backed by ps. secretKey is used to
+// verify webhook signatures.
+func NewPaystack(ps paystackclient.Client, secretKey string) PayoutProvider {
+	return &paystackRail{ps: ps, secretKey: secretKey}
+}
+
+func (p *paystackRail) Name() string {
+	return Paystack
+}
+
+func (p *paystackRail) CreateRecipient(req *RecipientRequest) (string, error) {
+	recipient, err := p.ps.CreateTransferRecipient(&paystackclient.TransferRecipientBody{
+		Type:          req.Type,
+		Name:          req.Name,
+		AccountNumber: req.AccountNumber,
+		BankCode:      req.BankCode,
+		Currency:      req.Currency,
+	})
+	if err != nil {
+		return "", err
+	}
+	return recipient.RecipientCode, nil
+}
+
+func (p *paystackRail) ResolveAccount(accountNumber, bankCode string) (*types.BankAccount, error) {
+	return p.ps.ResolveAccountNumber(accountNumber, bankCode)
+}
+
+func (p *paystackRail) InitiateTransfer(req *TransferRequest) (*types.Transfer, error) {
+	transfer, err := p.ps.InitiateTransfer(&paystackclient.InitiateTransferRequest{
+		Source:    "balance",
+		Amount:    req.Amount,
+		Recipient: req.Recipient,
+		Reason:    req.Reason,
+		Reference: req.Reference,
+	})
+	if err != nil {
+		return nil, err
+	}
+	transfer.Provider = Paystack
+	return transfer, nil
+}
+
+func (p *paystackRail) VerifyTransfer(transfer *types.Transfer) (*types.Transfer, error) {
+	verified, err := p.ps.VerifyTransfer(transfer.Reference)
+	if err != nil {
+		return nil, err
+	}
+	verified.Provider = Paystack
+	return verified, nil
+}
+
+func (p *paystackRail) ParseWebhook(header http.Header, body []byte) (*types.PayoutEvent, error) {
+	mac := hmac.New(sha512.New, []byte(p.secretKey))
+	mac.Write(body)
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Paystack-Signature"))) {
+		return nil, ErrInvalidSignature
+	}
+	var event struct {
+		Event string               `json:"event"`
+		Data  *types.TransferEvent `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	if event.Data == nil {
+		return nil, errors.New("webhook has no transfer data")
+	}
+	status := ""
+	switch event.Event {
+	case "transfer.success":
+		status = types.PayoutEventSuccess
+	case "transfer.failed":
+		status = types.PayoutEventFailed
+	case "transfer.reversed":
+		status = types.PayoutEventReversed
+	}
+	return &types.PayoutEvent{
+		Provider:     Paystack,
+		Reference:    event.Data.Reference,
+		TransferCode: event.Data.TransferCode,
+		Status:       status,
+	}, nil
+}
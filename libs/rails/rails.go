@@ -0,0 +1,68 @@
+package rails
+
+import (
+	"errors"
+	"github.com/adigunhammedolalekan/cashtroops/libs"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"net"
+	"net/http"
+)
+
+var ErrInvalidSignature = errors.New("webhook signature does not match")
+
+type RecipientRequest struct {
+	Type          string
+	Name          string
+	AccountNumber string
+	BankCode      string
+	Currency      string
+}
+
+// TransferRequest amounts are in the currency's minor unit e.g KOBO
+type TransferRequest struct {
+	Amount        int64
+	Currency      string
+	Recipient     string
+	AccountNumber string
+	BankCode      string
+	Reference     string
+	Reason        string
+}
+
+// PayoutProvider is a payment rail that can pay money out to a bank account.
+type PayoutProvider interface {
+	Name() string
+	// CreateRecipient registers a bank account with the provider and returns
+	// the code to pass as TransferRequest.Recipient.
+	CreateRecipient(req *RecipientRequest) (string, error)
+	ResolveAccount(accountNumber, bankCode string) (*types.BankAccount, error)
+	InitiateTransfer(req *TransferRequest) (*types.Transfer, error)
+	VerifyTransfer(transfer *types.Transfer) (*types.Transfer, error)
+	// ParseWebhook authenticates a transfer webhook and normalises it.
+	ParseWebhook(header http.Header, body []byte) (*types.PayoutEvent, error)
+}
+
+// IsUnavailable reports whether err means the provider could not be reached
+// or is refusing requests, so the same call is safe to try elsewhere.
+func IsUnavailable(err error) bool {
+	var apiErr *libs.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode == http.StatusServiceUnavailable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+	return false
+}
+
+// IsRejected reports whether err means the provider did not accept the
+// request, so nothing it asked for can have happened.
+func IsRejected(err error) bool {
+	var apiErr *libs.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode >= 400 && apiErr.StatusCode < 500 ||
+			apiErr.StatusCode == http.StatusServiceUnavailable
+	}
+	return IsUnavailable(err)
+}
@@ -0,0 +1,93 @@
+package rails
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrNoProvider = errors.New("no payout provider is available")
+
+// Router picks the payout provider to use for a bank. Providers are tried in
+// the order they were registered unless a bank is pinned to one, and a
+// provider that reports itself unavailable is skipped for a cooldown period.
+type Router struct {
+	providers []PayoutProvider
+	byBank    map[string]string
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	downUntil map[string]time.Time
+}
+
+func NewRouter(cooldown time.Duration, providers ...PayoutProvider) *Router {
+	return &Router{
+		providers: providers,
+		byBank:    make(map[string]string),
+		cooldown:  cooldown,
+		downUntil: make(map[string]time.Time),
+	}
+}
+
+// PinBank makes provider the first choice for payouts to bankCode.
+func (r *Router) PinBank(bankCode, provider string) {
+	r.byBank[bankCode] = provider
+}
+
+func (r *Router) Provider(name string) (PayoutProvider, bool) {
+	for _, next := range r.providers {
+		if next.Name() == name {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// Candidates returns the available providers for bankCode in the order they
+// should be tried. When every provider is marked down they are all returned
+// so payouts are still attempted.
+func (r *Router) Candidates(bankCode string) []PayoutProvider {
+	ordered := make([]PayoutProvider, 0, len(r.providers))
+	if pinned, ok := r.Provider(r.byBank[bankCode]); ok {
+		ordered = append(ordered, pinned)
+	}
+	for _, next := range r.providers {
+		if next.Name() != r.byBank[bankCode] {
+			ordered = append(ordered, next)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	available := make([]PayoutProvider, 0, len(ordered))
+	for _, next := range ordered {
+		if time.Now().After(r.downUntil[next.Name()]) {
+			available = append(available, next)
+		}
+	}
+	if len(available) == 0 {
+		return ordered
+	}
+	return available
+}
+
+// MarkDown skips provider for the router's cooldown period.
+func (r *Router) MarkDown(provider string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.downUntil[provider] = time.Now().Add(r.cooldown)
+}
+
+// Do calls fn with each candidate provider for bankCode until one succeeds
+// or fails for a reason other than being unavailable.
+func (r *Router) Do(bankCode string, fn func(provider PayoutProvider) error) error {
+	err := ErrNoProvider
+	for _, next := range r.Candidates(bankCode) {
+		err = fn(next)
+		if err == nil || !IsUnavailable(err) {
+			return err
+		}
+		r.MarkDown(next.Name())
+	}
+	return err
+}
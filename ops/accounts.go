@@ -1,51 +1,163 @@
 package ops
 
 import (
+	"fmt"
 	"github.com/adigunhammedolalekan/cashtroops/errors"
-	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/libs/rails"
 	"github.com/adigunhammedolalekan/cashtroops/types"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type AccountOps interface {
 	AddBeneficiary(userId string, beneficiary *types.CreateBeneficiaryOpts) (*types.Beneficiary, error)
 	RemoveBeneficiary(owner, beneficiaryId string) error
-	ListBeneficiariesFor(userId string) ([]*types.Beneficiary, error)
+	ListBeneficiariesFor(userId string, query *types.BeneficiaryQuery) ([]*types.Beneficiary, int, error)
+	UpdateBeneficiary(owner, beneficiaryId string, opts *types.UpdateBeneficiaryOpts) (*types.Beneficiary, error)
 	GetBeneficiaryByAttr(attr string, value interface{}) (*types.Beneficiary, error)
-	SetBanks(banks []types.Bank)
-	GetBanks() []types.Bank
+	SetBankDirectory(directory *BankDirectory)
+	IsSupportedBank(corridor, bankCode string) bool
+	GetBanks(corridor string) ([]types.Bank, error)
+	ValidateBeneficiary(opts *types.CreateBeneficiaryOpts) (*types.Corridor, error)
+	PrepareBeneficiary(userId string, opts *types.CreateBeneficiaryOpts) (*types.Beneficiary, error)
+	FindBeneficiary(owner, bankCode, accountNumber string) (*types.Beneficiary, error)
+	BeneficiaryForPayment(userId string, opts *types.CreateBeneficiaryOpts) (*types.Beneficiary, error)
 	ResolveAccount(accountNumber, bankCode string) (*types.BankAccount, error)
+	ConfirmBeneficiaryName(owner, beneficiaryId string) (*types.Beneficiary, error)
 }
 
+const (
+	defaultBeneficiaryPageSize = 20
+	maxBeneficiaryPageSize     = 100
+)
+
+const (
+	// names scoring at or above nameMatchThreshold are accepted as is, those
+	// below nameRejectThreshold are rejected and anything in between is
+	// saved but flagged for review
+	nameMatchThreshold  = 0.8
+	nameRejectThreshold = 0.5
+)
+
+var ErrBeneficiaryNameUnconfirmed = errors.New(http.StatusConflict,
+	"the account name on record does not match the name you entered. please confirm the beneficiary before paying them")
+
+// likeEscaper escapes the characters LIKE treats as wildcards, with the
+// backslash Postgres escapes them with by default.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
 type accountOps struct {
-	db     *gorm.DB
-	logger *logrus.Logger
-	ps     paystackclient.Client
-	banks  []types.Bank
+	db      *gorm.DB
+	logger  *logrus.Logger
+	payouts *rails.Router
+	banks   *BankDirectory
 }
 
-func NewAccountOps(db *gorm.DB, ps paystackclient.Client, logger *logrus.Logger) AccountOps {
+func NewAccountOps(db *gorm.DB, payouts *rails.Router, logger *logrus.Logger) AccountOps {
 	return &accountOps{
-		db:     db,
-		ps:     ps,
-		logger: logger,
+		db:      db,
+		payouts: payouts,
+		logger:  logger,
 	}
 }
 
-func (a *accountOps) SetBanks(banks []types.Bank) {
-	a.banks = banks
+func (a *accountOps) SetBankDirectory(directory *BankDirectory) {
+	a.banks = directory
 }
 
+// AddBeneficiary saves a beneficiary for userId. A user has at most one
+// beneficiary per bank and account number, so adding one that was removed
+// or only used for a one-off payment makes the existing record visible
+// again instead of creating a new one.
 func (a *accountOps) AddBeneficiary(userId string, beneficiary *types.CreateBeneficiaryOpts) (*types.Beneficiary, error) {
-	existing, err := a.GetBeneficiaryByAttr("account_number", beneficiary.AccountNumber)
-	if err == nil && existing.AccountNumber != "" && existing.Owner == userId {
+	if _, err := a.ValidateBeneficiary(beneficiary); err != nil {
+		return nil, err
+	}
+	existing, err := a.FindBeneficiary(userId, beneficiary.BankCode, beneficiary.AccountNumber)
+	if err == nil && !existing.Hidden && !existing.Removed {
 		return nil, errors.New(http.StatusConflict, "beneficiary with this account number has already been added")
 	}
-	bf := types.NewBeneficiary(beneficiary, userId)
+	if existing != nil {
+		return a.restoreBeneficiary(userId, existing, beneficiary, false)
+	}
+	bf, err := a.PrepareBeneficiary(userId, beneficiary)
+	if err != nil {
+		return nil, err
+	}
 	if err := a.db.Table("beneficiaries").Create(bf).Error; err != nil {
 		a.logger.WithError(err).Error("failed to create beneficiary")
+		if _, findErr := a.FindBeneficiary(userId, bf.BankCode, bf.AccountNumber); findErr == nil {
+			return nil, errors.New(http.StatusConflict, "beneficiary with this account number has already been added")
+		}
+		return nil, err
+	}
+	return bf, nil
+}
+
+// BeneficiaryForPayment returns the beneficiary userId already has for the
+// bank account in opts, or saves a hidden one for a one-off payment.
+func (a *accountOps) BeneficiaryForPayment(userId string, opts *types.CreateBeneficiaryOpts) (*types.Beneficiary, error) {
+	if _, err := a.ValidateBeneficiary(opts); err != nil {
+		return nil, err
+	}
+	if existing, err := a.FindBeneficiary(userId, opts.BankCode, opts.AccountNumber); err == nil {
+		if existing.Removed {
+			return a.restoreBeneficiary(userId, existing, opts, true)
+		}
+		if opts.ConfirmName && !existing.Payable() {
+			return a.ConfirmBeneficiaryName(userId, existing.ID.String())
+		}
+		return existing, nil
+	}
+	opts.Hidden = true
+	bf, err := a.PrepareBeneficiary(userId, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.db.Table("beneficiaries").Create(bf).Error; err != nil {
+		// lost a race with a concurrent payment to the same account
+		if existing, findErr := a.FindBeneficiary(userId, opts.BankCode, opts.AccountNumber); findErr == nil {
+			return existing, nil
+		}
+		a.logger.WithError(err).Error("failed to create hidden beneficiary")
+		return nil, err
+	}
+	return bf, nil
+}
+
+// restoreBeneficiary verifies the account of a removed or hidden
+// beneficiary again and makes it usable, visible unless hidden is set.
+func (a *accountOps) restoreBeneficiary(userId string, existing *types.Beneficiary, opts *types.CreateBeneficiaryOpts, hidden bool) (*types.Beneficiary, error) {
+	bf, err := a.PrepareBeneficiary(userId, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.db.Table("beneficiaries").Where("id = ?", existing.ID.String()).Updates(map[string]interface{}{
+		"account_name":   bf.AccountName,
+		"bank_name":      bf.BankName,
+		"supplied_name":  bf.SuppliedName,
+		"name_verified":  bf.NameVerified,
+		"name_mismatch":  bf.NameMismatch,
+		"name_confirmed": bf.NameConfirmed,
+		"hidden":         hidden,
+		"removed":        false,
+		"removed_at":     nil,
+	}).Error; err != nil {
+		a.logger.WithError(err).Error("failed to restore beneficiary")
+		return nil, err
+	}
+	return a.GetBeneficiaryByAttr("id", existing.ID.String())
+}
+
+func (a *accountOps) FindBeneficiary(owner, bankCode, accountNumber string) (*types.Beneficiary, error) {
+	bf := &types.Beneficiary{}
+	err := a.db.Table("beneficiaries").Where("owner = ? AND bank_code = ? AND account_number = ?",
+		owner, bankCode, strings.TrimSpace(accountNumber)).First(bf).Error
+	if err != nil {
 		return nil, err
 	}
 	return bf, nil
@@ -59,13 +171,125 @@ func (a *accountOps) RemoveBeneficiary(owner, id string) error {
 	if bf.Owner != owner {
 		return errors.New(http.StatusForbidden, "You cannot remove beneficiary that does not belong to you")
 	}
-	return a.db.Table("beneficiaries").Where("id = ?", id).Delete(&types.Beneficiary{}).Error
+	if bf.Removed {
+		return errors.New(http.StatusNotFound, "beneficiary not found")
+	}
+	// keep the row so payments made to this beneficiary still resolve
+	return a.db.Table("beneficiaries").Where("id = ?", id).Updates(map[string]interface{}{
+		"removed":    true,
+		"removed_at": time.Now(),
+		"is_default": false,
+	}).Error
+}
+
+// ConfirmBeneficiaryName accepts the name the bank has on record for a
+// beneficiary whose supplied name did not match it, so they can be paid.
+func (a *accountOps) ConfirmBeneficiaryName(owner, id string) (*types.Beneficiary, error) {
+	bf, err := a.GetBeneficiaryByAttr("id", id)
+	if err != nil || bf.Removed || bf.Owner != owner {
+		return nil, errors.New(http.StatusNotFound, "beneficiary not found")
+	}
+	if bf.Payable() {
+		return bf, nil
+	}
+	if err := a.db.Table("beneficiaries").Where("id = ?", id).UpdateColumn("name_confirmed", true).Error; err != nil {
+		a.logger.WithError(err).Error("failed to confirm beneficiary name")
+		return nil, err
+	}
+	bf.NameConfirmed = true
+	return bf, nil
 }
 
-func (a *accountOps) ListBeneficiariesFor(userId string) ([]*types.Beneficiary, error) {
+func (a *accountOps) UpdateBeneficiary(owner, id string, opts *types.UpdateBeneficiaryOpts) (*types.Beneficiary, error) {
+	bf, err := a.GetBeneficiaryByAttr("id", id)
+	if err != nil || bf.Removed || bf.Hidden {
+		return nil, errors.New(http.StatusNotFound, "beneficiary not found")
+	}
+	if bf.Owner != owner {
+		return nil, errors.New(http.StatusForbidden, "You cannot update beneficiary that does not belong to you")
+	}
+	updates := make(map[string]interface{})
+	if opts.Nickname != nil {
+		nickname := strings.TrimSpace(*opts.Nickname)
+		if len(nickname) > 50 {
+			return nil, errors.New(http.StatusBadRequest, "nickname must be 50 characters or less")
+		}
+		updates["nickname"] = nickname
+	}
+	if opts.Favourite != nil {
+		updates["favourite"] = *opts.Favourite
+	}
+	if opts.IsDefault != nil {
+		updates["is_default"] = *opts.IsDefault
+	}
+	if len(updates) == 0 {
+		return bf, nil
+	}
+
+	tx := a.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+	if opts.IsDefault != nil && *opts.IsDefault {
+		// a user has at most one default beneficiary
+		if err := tx.Table("beneficiaries").Where("owner = ? AND id <> ?", owner, id).
+			UpdateColumn("is_default", false).Error; err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Table("beneficiaries").Where("id = ?", id).Updates(updates).Error; err != nil {
+		tx.Rollback()
+		a.logger.WithError(err).Error("failed to update beneficiary")
+		return nil, err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return a.GetBeneficiaryByAttr("id", id)
+}
+
+// ListBeneficiariesFor returns a page of the visible beneficiaries of
+// userId along with the total number that match query. Default and
+// favourite beneficiaries come first unless query asks for the most
+// recently paid or alphabetical order.
+func (a *accountOps) ListBeneficiariesFor(userId string, query *types.BeneficiaryQuery) ([]*types.Beneficiary, int, error) {
+	if query == nil {
+		query = &types.BeneficiaryQuery{}
+	}
+	perPage := query.PerPage
+	if perPage <= 0 {
+		perPage = defaultBeneficiaryPageSize
+	}
+	if perPage > maxBeneficiaryPageSize {
+		perPage = maxBeneficiaryPageSize
+	}
+	page := query.Page
+	if page <= 0 {
+		page = 1
+	}
+
+	scope := a.db.Table("beneficiaries").Where("owner = ? AND hidden = ? AND removed = ?", userId, false, false)
+	if search := strings.TrimSpace(query.Search); search != "" {
+		like := "%" + likeEscaper.Replace(strings.ToLower(search)) + "%"
+		scope = scope.Where("LOWER(account_name) LIKE ? OR LOWER(nickname) LIKE ? OR LOWER(bank_name) LIKE ? OR account_number LIKE ?",
+			like, like, like, like)
+	}
+	total := 0
+	if err := scope.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	switch query.Sort {
+	case "recent":
+		scope = scope.Order("last_paid_at DESC NULLS LAST")
+	case "name":
+		scope = scope.Order("LOWER(COALESCE(NULLIF(nickname, ''), account_name)) ASC")
+	default:
+		scope = scope.Order("is_default DESC").Order("favourite DESC").Order("last_paid_at DESC NULLS LAST")
+	}
 	values := make([]*types.Beneficiary, 0)
-	err := a.db.Table("beneficiaries").Where("owner = ? AND hidden = ?", userId, false).Find(&values).Error
-	return values, err
+	err := scope.Offset((page - 1) * perPage).Limit(perPage).Find(&values).Error
+	return values, total, err
 }
 
 func (a *accountOps) GetBeneficiaryByAttr(attr string, value interface{}) (*types.Beneficiary, error) {
@@ -74,10 +298,127 @@ func (a *accountOps) GetBeneficiaryByAttr(attr string, value interface{}) (*type
 	return bf, err
 }
 
-func (a *accountOps) GetBanks() []types.Bank {
-	return a.banks
+// GetBanks returns the banks or mobile money operators payouts in corridor
+// can be made to.
+func (a *accountOps) GetBanks(corridor string) ([]types.Bank, error) {
+	c, ok := types.CorridorFor(corridor)
+	if !ok {
+		return nil, errors.New(http.StatusBadRequest, "unsupported payout corridor")
+	}
+	values := make([]types.Bank, 0)
+	for _, next := range a.banks.Banks() {
+		if next.Currency == c.Currency && bankType(next) == c.RecipientType {
+			values = append(values, next)
+		}
+	}
+	return values, nil
+}
+
+// ValidateBeneficiary checks that the account number and bank code of opts
+// are valid for its corridor.
+func (a *accountOps) ValidateBeneficiary(opts *types.CreateBeneficiaryOpts) (*types.Corridor, error) {
+	corridor, ok := types.CorridorFor(opts.Corridor)
+	if !ok {
+		return nil, errors.New(http.StatusBadRequest, "unsupported payout corridor")
+	}
+	opts.AccountNumber = strings.TrimSpace(opts.AccountNumber)
+	if !corridor.ValidAccountNumber(opts.AccountNumber) {
+		return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("invalid account number. expected %s", corridor.AccountHint))
+	}
+	bank, ok := a.bankFor(corridor.Code, opts.BankCode)
+	if !ok {
+		return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("bank code is not valid for %s", corridor.Description))
+	}
+	if opts.BankName == "" {
+		opts.BankName = bank.Name
+	}
+	return corridor, nil
+}
+
+// IsSupportedBank reports whether payouts can currently be made to bankCode
+// in corridor.
+func (a *accountOps) IsSupportedBank(corridor, bankCode string) bool {
+	_, ok := a.bankFor(corridor, bankCode)
+	return ok
 }
 
+func (a *accountOps) bankFor(corridor, bankCode string) (*types.Bank, bool) {
+	banks, err := a.GetBanks(corridor)
+	if err != nil {
+		return nil, false
+	}
+	for _, next := range banks {
+		if next.Code == bankCode {
+			return &next, true
+		}
+	}
+	return nil, false
+}
+
+// ResolveAccount looks up the name on an account. Provider outages are
+// told apart from accounts that do not exist.
 func (a *accountOps) ResolveAccount(accountNumber, bankCode string) (*types.BankAccount, error) {
-	return a.ps.ResolveAccountNumber(accountNumber, bankCode)
+	account, err := a.resolve(accountNumber, bankCode)
+	if err != nil {
+		a.logger.WithError(err).WithField("bank_code", bankCode).Error("failed to resolve account")
+		if rails.IsUnavailable(err) {
+			return nil, errors.New(http.StatusServiceUnavailable, "unable to resolve account at this time. please retry later")
+		}
+		return nil, errors.New(http.StatusNotFound, "could not resolve account. please check the account number and bank")
+	}
+	return account, nil
+}
+
+func (a *accountOps) resolve(accountNumber, bankCode string) (*types.BankAccount, error) {
+	var account *types.BankAccount
+	err := a.payouts.Do(bankCode, func(provider rails.PayoutProvider) error {
+		value, err := provider.ResolveAccount(accountNumber, bankCode)
+		account = value
+		return err
+	})
+	return account, err
+}
+
+// PrepareBeneficiary validates opts and, for corridors that support it,
+// replaces the supplied account name with the name the bank has on record.
+// The returned beneficiary has not been saved.
+func (a *accountOps) PrepareBeneficiary(userId string, opts *types.CreateBeneficiaryOpts) (*types.Beneficiary, error) {
+	corridor, err := a.ValidateBeneficiary(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !corridor.Resolvable {
+		return types.NewBeneficiary(opts, userId), nil
+	}
+	account, err := a.resolve(opts.AccountNumber, opts.BankCode)
+	if err != nil {
+		a.logger.WithError(err).WithField("bank_code", opts.BankCode).Error("failed to resolve account")
+		if rails.IsUnavailable(err) {
+			return nil, errors.New(http.StatusServiceUnavailable, "unable to verify account at this time. please retry later")
+		}
+		return nil, errors.New(http.StatusBadRequest, "could not verify account number. please check the account number and bank")
+	}
+	supplied := strings.TrimSpace(opts.AccountName)
+	score := 1.0
+	if supplied != "" {
+		score = fn.NameSimilarity(supplied, account.AccountName)
+	}
+	if score < nameRejectThreshold {
+		return nil, errors.New(http.StatusBadRequest,
+			fmt.Sprintf("the account name on record does not match %s", supplied))
+	}
+	opts.AccountName = account.AccountName
+	bf := types.NewBeneficiary(opts, userId)
+	bf.NameVerified = true
+	if score < nameMatchThreshold {
+		a.logger.WithFields(logrus.Fields{
+			"supplied_name": supplied,
+			"resolved_name": account.AccountName,
+			"score":         score,
+		}).Warn("beneficiary name mismatch")
+		bf.NameMismatch = true
+		bf.NameConfirmed = opts.ConfirmName
+		bf.SuppliedName = supplied
+	}
+	return bf, nil
 }
@@ -0,0 +1,231 @@
+package ops
+
+import (
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// attemptWindow is how long failures are remembered
+const attemptWindow = 24 * time.Hour
+
+// attemptRule limits the failures of one scope. The first free failures
+// are not delayed, after them each one doubles the wait before the next
+// guess up to maxDelay, and lockAfter failures lock for lockFor.
+type attemptRule struct {
+	free      int
+	maxDelay  time.Duration
+	lockAfter int
+	lockFor   time.Duration
+}
+
+// an IP may guess for many accounts, so it gets more room before it is
+// slowed down
+var attemptRules = map[string]attemptRule{
+	types.AttemptScopeAccount: {free: 3, maxDelay: time.Minute, lockAfter: 10, lockFor: 30 * time.Minute},
+	types.AttemptScopeIp:      {free: 10, maxDelay: time.Minute, lockAfter: 50, lockFor: 15 * time.Minute},
+}
+
+var (
+	ErrAccountLocked     = errors.New(http.StatusTooManyRequests, "too many failed attempts. the account is locked for a while, or use the unlock code sent to its email")
+	ErrInvalidUnlockCode = errors.New(http.StatusBadRequest, "invalid unlock code")
+)
+
+func (rule attemptRule) delay(failures int) time.Duration {
+	if failures <= rule.free {
+		return 0
+	}
+	delay := rule.maxDelay
+	if shift := failures - rule.free - 1; shift < 16 {
+		delay = time.Second << uint(shift)
+	}
+	if delay > rule.maxDelay {
+		return rule.maxDelay
+	}
+	return delay
+}
+
+// Attempt is a guess at a kind of secret, counted against an account,
+// identified by email, or an IP.
+type Attempt struct {
+	Kind    string
+	Scope   string
+	Subject string
+}
+
+func AccountAttempt(kind, email string) Attempt {
+	return Attempt{Kind: kind, Scope: types.AttemptScopeAccount, Subject: strings.ToLower(strings.TrimSpace(email))}
+}
+
+func IpAttempt(kind, ip string) Attempt {
+	return Attempt{Kind: kind, Scope: types.AttemptScopeIp, Subject: ip}
+}
+
+func (a Attempt) key() string {
+	return a.Kind + ":" + a.Scope + ":" + a.Subject
+}
+
+// AttemptLimiter slows down and locks out whoever keeps guessing
+// passwords and codes wrong. Counts are kept in the database so every
+// instance sees them.
+type AttemptLimiter interface {
+	// Check returns an error when any of attempts is locked or has to wait.
+	Check(attempts ...Attempt) error
+	// Fail counts a failure of each of attempts and returns the counters it
+	// locked. Locked account counters carry an UnlockCode.
+	Fail(attempts ...Attempt) ([]*types.AttemptCounter, error)
+	// Succeed forgets the failures of attempt.
+	Succeed(attempt Attempt) error
+	// Unlock clears the account counters of email if code is the unlock
+	// code sent when one of them was locked.
+	Unlock(email, code string) error
+	ListLocked() ([]*types.AttemptCounter, error)
+	Clear(key string) error
+}
+
+type attemptLimiter struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+}
+
+func NewAttemptLimiter(db *gorm.DB, logger *logrus.Logger) AttemptLimiter {
+	return &attemptLimiter{db: db, logger: logger}
+}
+
+func (l *attemptLimiter) Check(attempts ...Attempt) error {
+	keys := make([]string, 0, len(attempts))
+	for _, next := range attempts {
+		keys = append(keys, next.key())
+	}
+	counters := make([]*types.AttemptCounter, 0)
+	if err := l.db.Table("attempt_counters").Where("key IN (?)", keys).Find(&counters).Error; err != nil {
+		l.logger.WithError(err).Error("failed to get attempt counters")
+		return errors.New(http.StatusInternalServerError, "failed to process request at this time. please retry")
+	}
+	now := time.Now()
+	wait := time.Duration(0)
+	for _, next := range counters {
+		if next.Locked(now) {
+			if next.Scope == types.AttemptScopeAccount {
+				return ErrAccountLocked
+			}
+			return tooManyAttempts(next.LockedUntil.Sub(now))
+		}
+		rule := attemptRules[next.Scope]
+		if until := next.LastFailure.Add(rule.delay(next.Failures)); until.Sub(now) > wait {
+			wait = until.Sub(now)
+		}
+	}
+	if wait > 0 {
+		return tooManyAttempts(wait)
+	}
+	return nil
+}
+
+// failAttempt counts a failure, starting over once earlier failures are
+// outside attemptWindow or their lock has expired.
+const failAttempt = `INSERT INTO attempt_counters (key, kind, scope, subject, failures, last_failure, unlock_hash)
+	VALUES (?, ?, ?, ?, 1, ?, '')
+	ON CONFLICT (key) DO UPDATE SET
+		failures = CASE WHEN attempt_counters.last_failure < ? OR attempt_counters.locked_until <= ?
+			THEN 1 ELSE attempt_counters.failures + 1 END,
+		locked_until = CASE WHEN attempt_counters.locked_until <= ? THEN NULL ELSE attempt_counters.locked_until END,
+		unlock_hash = CASE WHEN attempt_counters.locked_until <= ? THEN '' ELSE attempt_counters.unlock_hash END,
+		last_failure = EXCLUDED.last_failure
+	RETURNING failures`
+
+func (l *attemptLimiter) Fail(attempts ...Attempt) ([]*types.AttemptCounter, error) {
+	now := time.Now()
+	locked := make([]*types.AttemptCounter, 0)
+	for _, next := range attempts {
+		failures := 0
+		err := l.db.Raw(failAttempt, next.key(), next.Kind, next.Scope, next.Subject, now,
+			now.Add(-attemptWindow), now, now, now).Row().Scan(&failures)
+		if err != nil {
+			return locked, err
+		}
+		rule := attemptRules[next.Scope]
+		if failures < rule.lockAfter {
+			continue
+		}
+		until := now.Add(rule.lockFor)
+		counter := &types.AttemptCounter{
+			Key:         next.key(),
+			Kind:        next.Kind,
+			Scope:       next.Scope,
+			Subject:     next.Subject,
+			Failures:    failures,
+			LastFailure: now,
+			LockedUntil: &until,
+		}
+		updates := map[string]interface{}{"locked_until": until}
+		if next.Scope == types.AttemptScopeAccount {
+			counter.UnlockCode = secure.Token()
+			updates["unlock_hash"] = secure.Hash(counter.UnlockCode)
+		}
+		// only the failure that locks the counter reports it
+		result := l.db.Table("attempt_counters").Where("key = ? AND (locked_until IS NULL OR locked_until <= ?)", next.key(), now).
+			UpdateColumns(updates)
+		if result.Error != nil {
+			return locked, result.Error
+		}
+		if result.RowsAffected == 1 {
+			locked = append(locked, counter)
+		}
+	}
+	return locked, nil
+}
+
+func (l *attemptLimiter) Succeed(attempt Attempt) error {
+	return l.Clear(attempt.key())
+}
+
+func (l *attemptLimiter) Unlock(email, code string) error {
+	subject := AccountAttempt("", email).Subject
+	if code == "" {
+		return ErrInvalidUnlockCode
+	}
+	counter := &types.AttemptCounter{}
+	err := l.db.Table("attempt_counters").Where("scope = ? AND subject = ? AND unlock_hash = ?",
+		types.AttemptScopeAccount, subject, secure.Hash(code)).First(counter).Error
+	if err == gorm.ErrRecordNotFound {
+		return ErrInvalidUnlockCode
+	}
+	if err != nil {
+		l.logger.WithError(err).Error("failed to get attempt counter")
+		return errors.New(http.StatusInternalServerError, "failed to unlock account at this time. please retry")
+	}
+	err = l.db.Table("attempt_counters").Where("scope = ? AND subject = ?", types.AttemptScopeAccount, subject).
+		Delete(&types.AttemptCounter{}).Error
+	if err != nil {
+		l.logger.WithError(err).Error("failed to delete attempt counters")
+		return errors.New(http.StatusInternalServerError, "failed to unlock account at this time. please retry")
+	}
+	return nil
+}
+
+// ListLocked returns the counters locked now, the soonest to unlock first.
+func (l *attemptLimiter) ListLocked() ([]*types.AttemptCounter, error) {
+	counters := make([]*types.AttemptCounter, 0)
+	err := l.db.Table("attempt_counters").Where("locked_until > ?", time.Now()).Order("locked_until").Find(&counters).Error
+	return counters, err
+}
+
+func (l *attemptLimiter) Clear(key string) error {
+	return l.db.Table("attempt_counters").Where("key = ?", key).Delete(&types.AttemptCounter{}).Error
+}
+
+func tooManyAttempts(wait time.Duration) error {
+	if wait < time.Minute {
+		seconds := int((wait + time.Second - 1) / time.Second)
+		return errors.New(http.StatusTooManyRequests, fmt.Sprintf("too many failed attempts. please try again in %d seconds", seconds))
+	}
+	minutes := int((wait + time.Minute - 1) / time.Minute)
+	return errors.New(http.StatusTooManyRequests, fmt.Sprintf("too many failed attempts. please try again in %d minutes", minutes))
+}
@@ -0,0 +1,174 @@
+package ops
+
+import (
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrPayoutsPaused = errors.New(http.StatusServiceUnavailable, "payouts are paused until our balance is topped up")
+
+// BalanceMonitor keeps a cached copy of the Paystack NGN balance and trips
+// a circuit breaker when paying out would take it below floor. While the
+// breaker is open payouts are queued instead of initiated.
+type BalanceMonitor struct {
+	ps         paystackclient.Client
+	floor      int64
+	ttl        time.Duration
+	alertEmail string
+	logger     *logrus.Logger
+
+	// onRecover is called whenever the breaker closes again
+	onRecover func()
+
+	mu        sync.Mutex
+	balance   int64
+	checkedAt time.Time
+	tripped   bool
+	done      chan struct{}
+}
+
+func NewBalanceMonitor(ps paystackclient.Client, floor int64, ttl time.Duration, alertEmail string, logger *logrus.Logger) *BalanceMonitor {
+	return &BalanceMonitor{
+		ps:         ps,
+		floor:      floor,
+		ttl:        ttl,
+		alertEmail: alertEmail,
+		logger:     logger,
+		done:       make(chan struct{}),
+	}
+}
+
+// SetRecoveryHandler makes the monitor call onRecover whenever the breaker
+// closes again, whichever refresh closed it.
+func (m *BalanceMonitor) SetRecoveryHandler(onRecover func()) {
+	m.onRecover = onRecover
+}
+
+// Refresh fetches the current balance from Paystack, closing the breaker if
+// the balance has recovered above floor.
+func (m *BalanceMonitor) Refresh() (int64, error) {
+	balances, err := m.ps.Balance()
+	if err != nil {
+		return 0, err
+	}
+	var balance int64
+	for _, next := range balances {
+		if next.Currency == "NGN" {
+			balance = next.Balance
+		}
+	}
+	m.mu.Lock()
+	m.balance = balance
+	m.checkedAt = time.Now()
+	recovered := m.tripped && balance > m.floor
+	if recovered {
+		m.tripped = false
+	}
+	m.mu.Unlock()
+	if recovered {
+		m.logger.WithField("balance", balance).Info("payout balance recovered. resuming payouts")
+		if m.onRecover != nil {
+			go m.onRecover()
+		}
+	}
+	return balance, nil
+}
+
+// Check reserves amount against the cached balance. It returns
+// ErrPayoutsPaused when the breaker is open or would be tripped by amount.
+// A balance that cannot be read does not trip the breaker, Paystack
+// rejects payouts it cannot cover anyway.
+func (m *BalanceMonitor) Check(amount int64) error {
+	m.mu.Lock()
+	stale := time.Since(m.checkedAt) > m.ttl
+	m.mu.Unlock()
+	if stale {
+		if _, err := m.Refresh(); err != nil {
+			m.logger.WithError(err).Error("failed to refresh payout balance")
+			if m.Tripped() {
+				return ErrPayoutsPaused
+			}
+			return nil
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tripped {
+		return ErrPayoutsPaused
+	}
+	if m.balance-amount < m.floor {
+		m.tripped = true
+		go m.alert(m.balance, amount)
+		return ErrPayoutsPaused
+	}
+	m.balance -= amount
+	return nil
+}
+
+func (m *BalanceMonitor) Status() *types.PayoutBalanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &types.PayoutBalanceStatus{
+		Balance:   m.balance,
+		Floor:     m.floor,
+		Tripped:   m.tripped,
+		CheckedAt: m.checkedAt,
+	}
+}
+
+func (m *BalanceMonitor) Tripped() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.tripped
+}
+
+// Start refreshes the balance every interval so a tripped breaker closes
+// once the balance is topped up.
+func (m *BalanceMonitor) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := m.Refresh(); err != nil {
+					m.logger.WithError(err).Error("failed to refresh payout balance")
+				}
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+func (m *BalanceMonitor) Stop() {
+	close(m.done)
+}
+
+func (m *BalanceMonitor) alert(balance, amount int64) {
+	m.logger.WithFields(logrus.Fields{
+		"balance": balance,
+		"amount":  amount,
+		"floor":   m.floor,
+	}).Error("payout balance is below floor. payouts paused")
+	if m.alertEmail == "" {
+		return
+	}
+	if err := fn.SendEmail(&types.MailRequest{
+		User:  "CashTroops Operator",
+		Email: m.alertEmail,
+		Title: "Payouts paused: Paystack balance is low - CashTroops",
+		Body: fmt.Sprintf("Paystack balance is N%d, below the floor of N%d. A payout of N%d has been queued. "+
+			"Payouts resume automatically once the balance is topped up.", balance/100, m.floor/100, amount/100),
+	}); err != nil {
+		m.logger.WithError(err).Error("failed to send low balance alert")
+	}
+}
@@ -0,0 +1,183 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// BankDirectory keeps the list of banks payouts can be made to. The list is
+// synced from Paystack into the database on a schedule and served from
+// memory. Corridors that have never been synced use the bundled list.
+type BankDirectory struct {
+	store    bankStore
+	ps       paystackclient.Client
+	fallback []types.Bank
+	logger   *logrus.Logger
+
+	mu    sync.RWMutex
+	banks []types.Bank
+	done  chan struct{}
+}
+
+func NewBankDirectory(db *gorm.DB, ps paystackclient.Client, fallback []types.Bank, logger *logrus.Logger) *BankDirectory {
+	return &BankDirectory{
+		store:    &dbBankStore{db: db},
+		ps:       ps,
+		fallback: fallback,
+		banks:    fallback,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+}
+
+// Banks returns every active bank.
+func (d *BankDirectory) Banks() []types.Bank {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	values := make([]types.Bank, 0, len(d.banks))
+	for _, next := range d.banks {
+		if next.Active && !next.IsDeleted {
+			values = append(values, next)
+		}
+	}
+	return values
+}
+
+// Load reads the saved bank list from the database. The bundled banks of
+// corridors the database has nothing for are kept.
+func (d *BankDirectory) Load() error {
+	values, err := d.store.List()
+	if err != nil {
+		return err
+	}
+	synced := make(map[string]bool)
+	for _, next := range values {
+		synced[next.Currency+"/"+bankType(next)] = true
+	}
+	for _, next := range d.fallback {
+		if !synced[next.Currency+"/"+bankType(next)] {
+			values = append(values, next)
+		}
+	}
+	d.mu.Lock()
+	d.banks = values
+	d.mu.Unlock()
+	return nil
+}
+
+// Refresh fetches the bank list for every corridor from Paystack and saves
+// it. Banks Paystack no longer returns are marked as deleted. A corridor
+// that fails to sync keeps its previous banks.
+func (d *BankDirectory) Refresh() error {
+	var lastErr error
+	for _, corridor := range types.Corridors {
+		banks, err := d.ps.ListBanks(corridor.Currency, corridor.RecipientType)
+		if err != nil {
+			d.logger.WithError(err).WithField("corridor", corridor.Code).Error("failed to fetch banks")
+			lastErr = err
+			continue
+		}
+		if len(banks) == 0 {
+			continue
+		}
+		for i := range banks {
+			banks[i].Currency = corridor.Currency
+			banks[i].Type = corridor.RecipientType
+			banks[i].Key = types.BankKey(corridor.Currency, corridor.RecipientType, banks[i].Code)
+			banks[i].UpdatedAt = time.Now()
+		}
+		if err := d.store.Sync(corridor.Currency, corridor.RecipientType, banks); err != nil {
+			d.logger.WithError(err).WithField("corridor", corridor.Code).Error("failed to save banks")
+			lastErr = err
+		}
+	}
+	if err := d.Load(); err != nil {
+		return err
+	}
+	return lastErr
+}
+
+// Start refreshes the bank list every interval until Stop is called.
+func (d *BankDirectory) Start(interval time.Duration) {
+	go func() {
+		if err := d.Refresh(); err != nil {
+			d.logger.WithError(err).Error("failed to sync banks")
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := d.Refresh(); err != nil {
+					d.logger.WithError(err).Error("failed to sync banks")
+				}
+			case <-d.done:
+				return
+			}
+		}
+	}()
+}
+
+func (d *BankDirectory) Stop() {
+	close(d.done)
+}
+
+// bankType is the recipient type of bank. Banks saved before corridors
+// existed have none and are NUBAN.
+func bankType(bank types.Bank) string {
+	if bank.Type == "" {
+		return "nuban"
+	}
+	return bank.Type
+}
+
+// bankStore keeps the synced bank list.
+type bankStore interface {
+	List() ([]types.Bank, error)
+	// Sync saves banks, keyed by types.BankKey, as the current list for
+	// currency and bankType and marks every other bank of theirs deleted.
+	Sync(currency, bankType string, banks []types.Bank) error
+}
+
+type dbBankStore struct {
+	db *gorm.DB
+}
+
+func (s *dbBankStore) List() ([]types.Bank, error) {
+	values := make([]types.Bank, 0)
+	err := s.db.Table("banks").Order("name asc").Find(&values).Error
+	return values, err
+}
+
+// upsertBank saves a bank, updating the one already saved under its key.
+const upsertBank = `INSERT INTO banks (key, name, slug, code, currency, country, type, id, longcode, active, is_deleted, updated_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT (key) DO UPDATE SET name = EXCLUDED.name, slug = EXCLUDED.slug, country = EXCLUDED.country,
+		id = EXCLUDED.id, longcode = EXCLUDED.longcode, active = EXCLUDED.active,
+		is_deleted = EXCLUDED.is_deleted, updated_at = EXCLUDED.updated_at`
+
+func (s *dbBankStore) Sync(currency, bankType string, banks []types.Bank) error {
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(banks))
+	for _, next := range banks {
+		if err := tx.Exec(upsertBank, next.Key, next.Name, next.Slug, next.Code, next.Currency, next.Country,
+			next.Type, next.ID, next.Longcode, next.Active, next.IsDeleted, next.UpdatedAt).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		keys = append(keys, next.Key)
+	}
+	if err := tx.Table("banks").Where("currency = ? AND type = ? AND key NOT IN (?)", currency, bankType, keys).
+		Updates(map[string]interface{}{"is_deleted": true, "active": false, "updated_at": time.Now()}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
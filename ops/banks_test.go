@@ -0,0 +1,84 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"sort"
+	"testing"
+)
+
+// memoryBankStore keeps banks the way dbBankStore does, without a database.
+type memoryBankStore struct {
+	banks map[string]types.Bank
+}
+
+func (s *memoryBankStore) List() ([]types.Bank, error) {
+	values := make([]types.Bank, 0, len(s.banks))
+	for _, next := range s.banks {
+		values = append(values, next)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Name < values[j].Name })
+	return values, nil
+}
+
+func (s *memoryBankStore) Sync(currency, bankType string, banks []types.Bank) error {
+	keys := make(map[string]bool)
+	for _, next := range banks {
+		s.banks[next.Key] = next
+		keys[next.Key] = true
+	}
+	for key, next := range s.banks {
+		if next.Currency == currency && next.Type == bankType && !keys[key] {
+			next.IsDeleted, next.Active = true, false
+			s.banks[key] = next
+		}
+	}
+	return nil
+}
+
+// bankLister serves ListBanks from banks, keyed by currency.
+type bankLister struct {
+	paystackclient.Client
+	banks map[string][]types.Bank
+}
+
+func (l *bankLister) ListBanks(currency, bankType string) ([]types.Bank, error) {
+	values := make([]types.Bank, len(l.banks[currency]))
+	copy(values, l.banks[currency])
+	return values, nil
+}
+
+func TestBankDirectoryRefresh(t *testing.T) {
+	fallback := []types.Bank{
+		{Name: "Access Bank", Code: "044", Currency: "NGN", Type: "nuban", Active: true},
+		{Name: "MTN Mobile Money", Code: "MTN", Currency: "GHS", Type: "mobile_money", Active: true},
+	}
+	lister := &bankLister{banks: map[string][]types.Bank{
+		"NGN": {
+			{Name: "Access Bank", Code: "044", Active: true},
+			{Name: "Zenith Bank", Code: "057", Active: true},
+		},
+	}}
+	store := &memoryBankStore{banks: make(map[string]types.Bank)}
+	directory := &BankDirectory{store: store, ps: lister, fallback: fallback, banks: fallback, logger: logrus.New()}
+
+	assert.Nil(t, directory.Refresh())
+	assert.Equal(t, []string{"Access Bank", "MTN Mobile Money", "Zenith Bank"}, bankNames(directory.Banks()))
+
+	// a second sync updates banks already saved and drops delisted ones
+	lister.banks["NGN"] = []types.Bank{{Name: "Access Bank Plc", Code: "044", Active: true}}
+	assert.Nil(t, directory.Refresh())
+	assert.Equal(t, []string{"Access Bank Plc", "MTN Mobile Money"}, bankNames(directory.Banks()))
+	assert.True(t, store.banks[types.BankKey("NGN", "nuban", "057")].IsDeleted)
+}
+
+func bankNames(banks []types.Bank) []string {
+	values := make([]string, 0, len(banks))
+	for _, next := range banks {
+		values = append(values, next.Name)
+	}
+	sort.Strings(values)
+	return values
+}
@@ -0,0 +1,328 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/ledger"
+	"github.com/adigunhammedolalekan/cashtroops/libs"
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/libs/rails"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Paystack accepts at most 100 transfers in one bulk request
+	maxBulkTransferSize    = 100
+	maxBulkTransferRetries = 3
+)
+
+type queuedPayout struct {
+	payment   *types.Payment
+	recipient string
+	attempts  int
+}
+
+// PayoutBatcher collects payments that are ready to be paid out and submits
+// them to Paystack as a single bulk transfer once every window, or sooner
+// when a full batch is queued. Queued payments are marked BATCHED so they
+// are picked up again after a restart.
+type PayoutBatcher struct {
+	db     *gorm.DB
+	ps     paystackclient.Client
+	ledger *ledger.Ledger
+	window time.Duration
+	logger *logrus.Logger
+	// onFailure is called with payments the batcher gives up on
+	onFailure func(payment *types.Payment)
+
+	mu    sync.Mutex
+	queue []*queuedPayout
+	flush chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func NewPayoutBatcher(db *gorm.DB, ps paystackclient.Client, ledger *ledger.Ledger, window time.Duration, logger *logrus.Logger) *PayoutBatcher {
+	return &PayoutBatcher{
+		db:     db,
+		ps:     ps,
+		ledger: ledger,
+		window: window,
+		logger: logger,
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// SetFailureHandler makes the batcher call onFailure with payments it gives
+// up on.
+func (b *PayoutBatcher) SetFailureHandler(onFailure func(payment *types.Payment)) {
+	b.onFailure = onFailure
+}
+
+// Add queues payment for payout to the Paystack recipient code.
+func (b *PayoutBatcher) Add(payment *types.Payment, recipient string) error {
+	tx := b.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	result := tx.Table("payments").Where("id = ? AND status IN (?)", payment.ID.String(),
+		[]types.PaymentStatus{"", types.INITIALIZED}).UpdateColumn("status", types.BATCHED)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		b.logger.WithField("payment_id", payment.ID.String()).Warn("payment is no longer waiting for a payout. not queueing it")
+		return nil
+	}
+	if err := b.ledger.PostTx(tx, ledger.KindPayoutInitiated, payment.ID.String(), "payout batched with "+rails.Paystack,
+		payoutInitiated(payment, rails.Paystack)...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	payment.Status = types.BATCHED
+	b.enqueue(&queuedPayout{payment: payment, recipient: recipient})
+	return nil
+}
+
+// load queues the payments that were still BATCHED when the batcher last
+// stopped.
+func (b *PayoutBatcher) load() error {
+	values := make([]*types.Payment, 0)
+	if err := b.db.Table("payments").Where("status = ?", types.BATCHED).Order("ts asc").Find(&values).Error; err != nil {
+		return err
+	}
+	items := make([]*queuedPayout, 0, len(values))
+	for _, payment := range values {
+		beneficiary := &types.Beneficiary{}
+		err := b.db.Table("beneficiaries").Where("id = ?", payment.BeneficiaryId).First(beneficiary).Error
+		if err != nil || beneficiary.TransferRecipientId == "" {
+			b.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("failed to find recipient of batched payment")
+			continue
+		}
+		items = append(items, &queuedPayout{payment: payment, recipient: beneficiary.TransferRecipientId})
+	}
+	if len(items) > 0 {
+		b.logger.WithField("count", len(items)).Info("queueing batched payments")
+		b.enqueue(items...)
+	}
+	return nil
+}
+
+func (b *PayoutBatcher) enqueue(items ...*queuedPayout) {
+	b.mu.Lock()
+	b.queue = append(b.queue, items...)
+	full := len(b.queue) >= maxBulkTransferSize
+	b.mu.Unlock()
+	if full {
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Start queues the payments left BATCHED by an earlier run and runs the
+// batching loop in the background until Stop is called.
+func (b *PayoutBatcher) Start() {
+	if err := b.load(); err != nil {
+		b.logger.WithError(err).Error("failed to load batched payments")
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		ticker := time.NewTicker(b.window)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.Flush()
+			case <-b.flush:
+				b.Flush()
+			case <-b.done:
+				b.Flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop submits whatever is still queued and stops the batching loop.
+func (b *PayoutBatcher) Stop() {
+	close(b.done)
+	b.wg.Wait()
+}
+
+// Flush submits every payout queued so far, in batches of at most
+// maxBulkTransferSize. Payouts re-queued by a failed batch wait for the
+// next flush.
+func (b *PayoutBatcher) Flush() {
+	b.mu.Lock()
+	pending := b.queue
+	b.queue = nil
+	b.mu.Unlock()
+	for len(pending) > 0 {
+		n := len(pending)
+		if n > maxBulkTransferSize {
+			n = maxBulkTransferSize
+		}
+		b.submit(pending[:n])
+		pending = pending[n:]
+	}
+}
+
+func (b *PayoutBatcher) submit(batch []*queuedPayout) {
+	req := &paystackclient.BulkTransferRequest{
+		Currency:  "NGN",
+		Source:    "balance",
+		Transfers: make([]*paystackclient.BulkTransferItem, 0, len(batch)),
+	}
+	byReference := make(map[string]*queuedPayout, len(batch))
+	for _, next := range batch {
+		reference := next.payment.ID.String()
+		byReference[reference] = next
+		req.Transfers = append(req.Transfers, &paystackclient.BulkTransferItem{
+			Amount:    next.payment.KoboAmount,
+			Recipient: next.recipient,
+			Reference: reference,
+		})
+	}
+	results, err := b.ps.InitiateBulkTransfer(req)
+	if err != nil {
+		b.logger.WithError(err).WithField("size", len(batch)).Error("failed to initiate bulk transfer")
+		b.retry(batch)
+		return
+	}
+	for i, result := range results {
+		// Paystack returns results in request order; older API versions
+		// omit the reference so fall back to the position in the batch.
+		item, ok := byReference[result.Reference]
+		if !ok && i < len(batch) {
+			item = batch[i]
+		}
+		if item == nil {
+			b.logger.WithField("transfer_code", result.TransferCode).Error("bulk transfer result does not match any payment")
+			continue
+		}
+		delete(byReference, item.payment.ID.String())
+		transfer := &types.Transfer{
+			PaymentId:    item.payment.ID.String(),
+			Reference:    item.payment.ID.String(),
+			Amount:       int(result.Amount),
+			Currency:     result.Currency,
+			Source:       req.Source,
+			Status:       result.Status,
+			TransferCode: result.TransferCode,
+			CreatedAt:    time.Now(),
+			UpdatedAt:    time.Now(),
+		}
+		b.accepted(transfer)
+	}
+	for reference := range byReference {
+		b.logger.WithField("payment_id", reference).Error("payment missing from bulk transfer response")
+		b.settle(byReference[reference])
+	}
+}
+
+// accepted logs a transfer Paystack accepted and leaves its payment waiting
+// for the transfer's webhook.
+func (b *PayoutBatcher) accepted(transfer *types.Transfer) {
+	if err := b.db.Table("transfers").Create(transfer).Error; err != nil {
+		b.logger.WithError(err).WithField("payment_id", transfer.PaymentId).Error("failed to log transfer")
+	}
+	if err := b.db.Table("payments").Where("id = ? AND status = ?", transfer.PaymentId, types.BATCHED).
+		UpdateColumn("status", types.INITIALIZED).Error; err != nil {
+		b.logger.WithError(err).WithField("payment_id", transfer.PaymentId).Error("failed to update batched payment")
+	}
+}
+
+// retry re-queues a failed batch. Payment IDs are used as transfer
+// references so Paystack rejects any transfer that was already accepted.
+func (b *PayoutBatcher) retry(batch []*queuedPayout) {
+	requeue := make([]*queuedPayout, 0, len(batch))
+	for _, next := range batch {
+		next.attempts++
+		if next.attempts < maxBulkTransferRetries {
+			requeue = append(requeue, next)
+			continue
+		}
+		b.logger.WithField("payment_id", next.payment.ID.String()).Error("giving up on payout after repeated bulk transfer failures")
+		b.settle(next)
+	}
+	if len(requeue) > 0 {
+		b.enqueue(requeue...)
+	}
+}
+
+// settle decides what became of a payout the batcher gave up on. A failed
+// or timed out request may still have been accepted, so the payout only
+// fails when Paystack has no transfer for its reference. When that cannot
+// be told the payment is left for review.
+func (b *PayoutBatcher) settle(item *queuedPayout) {
+	reference := item.payment.ID.String()
+	transfer, err := b.ps.VerifyTransfer(reference)
+	if err == nil && transfer != nil {
+		b.logger.WithFields(logrus.Fields{
+			"payment_id": reference,
+			"status":     transfer.Status,
+		}).Info("payout was accepted despite the failed bulk transfer")
+		transfer.PaymentId, transfer.Reference = reference, reference
+		b.accepted(transfer)
+		return
+	}
+	status := givenUpStatus(err)
+	tx := b.db.Begin()
+	if tx.Error != nil {
+		b.logger.WithError(tx.Error).WithField("payment_id", reference).Error("failed to update batched payment")
+		return
+	}
+	result := tx.Table("payments").Where("id = ? AND status = ?", reference, types.BATCHED).
+		UpdateColumn("status", status)
+	if result.Error != nil {
+		tx.Rollback()
+		b.logger.WithError(result.Error).WithField("payment_id", reference).Error("failed to update batched payment")
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return
+	}
+	if status == types.FAILED {
+		if err := b.ledger.ReverseTx(tx, ledger.KindPayoutInitiated, reference, ledger.KindPayoutFailed,
+			"bulk transfer failed"); err != nil {
+			tx.Rollback()
+			b.logger.WithError(err).WithField("payment_id", reference).Error("failed to post failed payout to ledger")
+			return
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		b.logger.WithError(err).WithField("payment_id", reference).Error("failed to update batched payment")
+		return
+	}
+	item.payment.Status = status
+	if status == types.REVIEW {
+		b.logger.WithError(err).WithField("payment_id", reference).Error("could not tell whether the payout was made. left for review")
+		return
+	}
+	if b.onFailure != nil {
+		b.onFailure(item.payment)
+	}
+}
+
+// givenUpStatus is what a payment the batcher gave up on becomes when
+// looking up its transfer on Paystack failed with err. Only a transfer
+// Paystack has never seen has failed.
+func givenUpStatus(err error) types.PaymentStatus {
+	if apiErr, ok := err.(*libs.APIError); ok && apiErr.StatusCode == http.StatusNotFound {
+		return types.FAILED
+	}
+	return types.REVIEW
+}
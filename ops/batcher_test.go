@@ -0,0 +1,20 @@
+package ops
+
+import (
+	"errors"
+	"github.com/adigunhammedolalekan/cashtroops/libs"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestGivenUpStatus(t *testing.T) {
+	// paystack has no transfer for the reference, so nothing was paid out
+	assert.Equal(t, types.FAILED, givenUpStatus(&libs.APIError{StatusCode: 404}))
+
+	// anything else may hide an accepted transfer
+	assert.Equal(t, types.REVIEW, givenUpStatus(&libs.APIError{StatusCode: 500}))
+	assert.Equal(t, types.REVIEW, givenUpStatus(&libs.APIError{StatusCode: 429}))
+	assert.Equal(t, types.REVIEW, givenUpStatus(errors.New("i/o timeout")))
+	assert.Equal(t, types.REVIEW, givenUpStatus(nil))
+}
@@ -0,0 +1,80 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/session"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// denySyncInterval bounds how long a session revoked by another instance
+// keeps being accepted by this one.
+const denySyncInterval = 10 * time.Second
+
+// denyList keeps the revoked sessions whose access tokens may not have
+// expired yet in memory, so verifying an access token never reads the
+// session store. Sessions revoked by other instances are picked up by
+// reloading the list from the store in the background.
+type denyList struct {
+	store  session.Store
+	logger *logrus.Logger
+
+	mu     sync.RWMutex
+	denied map[string]time.Time
+}
+
+func newDenyList(store session.Store, logger *logrus.Logger) *denyList {
+	return &denyList{store: store, logger: logger, denied: make(map[string]time.Time)}
+}
+
+// start loads the list and keeps reloading it every interval.
+func (d *denyList) start(interval time.Duration) {
+	if err := d.sync(); err != nil {
+		d.logger.WithError(err).Error("failed to load revoked sessions")
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := d.sync(); err != nil {
+				d.logger.WithError(err).Error("failed to load revoked sessions")
+			}
+		}
+	}()
+}
+
+// sync adds the sessions revoked in the store and forgets those whose mark
+// has expired.
+func (d *denyList) sync() error {
+	denied, err := d.store.ListDenied()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for sessionId, until := range d.denied {
+		if now.After(until) {
+			delete(d.denied, sessionId)
+		}
+	}
+	for sessionId, until := range denied {
+		if now.Before(until) {
+			d.denied[sessionId] = until
+		}
+	}
+	return nil
+}
+
+func (d *denyList) add(sessionId string, until time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.denied[sessionId] = until
+}
+
+func (d *denyList) contains(sessionId string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	until, ok := d.denied[sessionId]
+	return ok && time.Now().Before(until)
+}
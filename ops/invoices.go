@@ -0,0 +1,331 @@
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultInvoiceExpiry = 7 * 24 * time.Hour
+	maxInvoiceExpiry     = 90 * 24 * time.Hour
+	maxInvoiceMemo       = 140
+	invoiceCodeLength    = 12
+)
+
+type InvoiceOps interface {
+	CreateInvoice(userId string, opts *types.CreateInvoiceOpts) (*types.Invoice, error)
+	ListInvoices(userId string) ([]*types.Invoice, error)
+	CancelInvoice(userId, id string) (*types.Invoice, error)
+	GetInvoice(code string) (*types.InvoiceView, error)
+	PayInvoice(code string, req *types.PayInvoiceRequest) (*types.PayInvoiceResponse, error)
+	CompleteInvoice(payment *types.Payment) error
+}
+
+type invoiceOps struct {
+	db         *gorm.DB
+	userOps    UserOps
+	accountOps AccountOps
+	paymentOps PaymentOps
+	logger     *logrus.Logger
+}
+
+func NewInvoiceOps(db *gorm.DB, userOps UserOps, accountOps AccountOps, paymentOps PaymentOps, logger *logrus.Logger) InvoiceOps {
+	return &invoiceOps{
+		db:         db,
+		userOps:    userOps,
+		accountOps: accountOps,
+		paymentOps: paymentOps,
+		logger:     logger,
+	}
+}
+
+func (i *invoiceOps) CreateInvoice(userId string, opts *types.CreateInvoiceOpts) (*types.Invoice, error) {
+	beneficiary, err := i.accountOps.GetBeneficiaryByAttr("id", opts.BeneficiaryId)
+	if err != nil || beneficiary.Owner != userId || beneficiary.Removed {
+		return nil, errors.New(http.StatusNotFound, "beneficiary not found")
+	}
+	corridor := beneficiary.PayoutCorridor()
+	currency := strings.ToUpper(strings.TrimSpace(opts.Currency))
+	if currency == "" {
+		currency = corridor.Currency
+	}
+	if currency != "USD" && currency != corridor.Currency {
+		return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("invoice currency must be USD or %s", corridor.Currency))
+	}
+	amount := opts.AmountMinor()
+	if amount <= 0 {
+		return nil, errors.New(http.StatusBadRequest, "The amount seems to be invalid")
+	}
+	memo := strings.TrimSpace(opts.Memo)
+	if len(memo) > maxInvoiceMemo {
+		return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("memo cannot be longer than %d characters", maxInvoiceMemo))
+	}
+	now := time.Now()
+	expiresAt := now.Add(defaultInvoiceExpiry)
+	if opts.ExpiresAt != nil {
+		expiresAt = *opts.ExpiresAt
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > maxInvoiceExpiry {
+		return nil, errors.New(http.StatusBadRequest, "invoice expiry must be within the next 90 days")
+	}
+	invoice := &types.Invoice{
+		Code:          fn.GenerateRandomString(invoiceCodeLength),
+		UserId:        userId,
+		BeneficiaryId: beneficiary.ID.String(),
+		Amount:        amount,
+		Currency:      currency,
+		Memo:          memo,
+		Status:        types.InvoiceOpen,
+		ExpiresAt:     expiresAt,
+		Ts:            now,
+	}
+	if err := i.db.Table("invoices").Create(invoice).Error; err != nil {
+		i.logger.WithError(err).Error("failed to create invoice")
+		return nil, errors.New(http.StatusInternalServerError, "failed to create invoice at this time. please retry later.")
+	}
+	return invoice, nil
+}
+
+func (i *invoiceOps) ListInvoices(userId string) ([]*types.Invoice, error) {
+	data := make([]*types.Invoice, 0)
+	err := i.db.Table("invoices").Where("user_id = ?", userId).Order("ts desc").Find(&data).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, next := range data {
+		i.expire(next)
+	}
+	return data, nil
+}
+
+func (i *invoiceOps) CancelInvoice(userId, id string) (*types.Invoice, error) {
+	invoice, err := i.getInvoiceByAttr("id", id)
+	if err != nil || invoice.UserId != userId {
+		return nil, errors.New(http.StatusNotFound, "invoice not found")
+	}
+	if invoice.Status != types.InvoiceOpen {
+		return nil, errors.New(http.StatusConflict, fmt.Sprintf("invoice is already %s", strings.ToLower(string(invoice.Status))))
+	}
+	if err := i.db.Table("invoices").Where("id = ?", id).
+		UpdateColumn("status", types.InvoiceCancelled).Error; err != nil {
+		return nil, err
+	}
+	invoice.Status = types.InvoiceCancelled
+	return invoice, nil
+}
+
+// GetInvoice returns what a payer needs to see about the invoice with code.
+// It does not require a session.
+func (i *invoiceOps) GetInvoice(code string) (*types.InvoiceView, error) {
+	invoice, err := i.getInvoiceByAttr("code", code)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "invoice not found")
+	}
+	i.expire(invoice)
+	requester, err := i.userOps.GetUserByAttr("id", invoice.UserId)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "invoice not found")
+	}
+	beneficiary, err := i.accountOps.GetBeneficiaryByAttr("id", invoice.BeneficiaryId)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "invoice not found")
+	}
+	return &types.InvoiceView{
+		Code:          invoice.Code,
+		RequestedBy:   requester.Name(),
+		Amount:        invoice.Amount,
+		Currency:      invoice.Currency,
+		Memo:          invoice.Memo,
+		Status:        invoice.Status,
+		ExpiresAt:     invoice.ExpiresAt,
+		AccountName:   beneficiary.AccountName,
+		BankName:      beneficiary.BankName,
+		PayoutCountry: beneficiary.PayoutCorridor().Country,
+	}, nil
+}
+
+// PayInvoice quotes the invoice amount in req.Coin and starts a payment into
+// the requester's beneficiary. A payer asking again for the same coin and
+// refund address gets the deposit address of the payment already waiting
+// for their coin rather than a new one.
+func (i *invoiceOps) PayInvoice(code string, req *types.PayInvoiceRequest) (*types.PayInvoiceResponse, error) {
+	invoice, err := i.getInvoiceByAttr("code", code)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "invoice not found")
+	}
+	i.expire(invoice)
+	if !invoice.Payable(time.Now()) {
+		return nil, errors.New(http.StatusConflict, fmt.Sprintf("invoice is %s and can no longer be paid", strings.ToLower(string(invoice.Status))))
+	}
+	if req.Coin == "" {
+		return nil, errors.New(http.StatusBadRequest, "coin is required")
+	}
+	// the payer is not a user, so a failed payout can only be refunded to
+	// the address they leave here
+	refundAddress := strings.TrimSpace(req.RefundAddress)
+	if refundAddress == "" {
+		return nil, errors.New(http.StatusBadRequest, "refund address is required")
+	}
+	email := strings.TrimSpace(req.Email)
+	if email != "" {
+		if err := fn.ValidateEmail(email); err != nil {
+			return nil, errors.New(http.StatusBadRequest, err.Error())
+		}
+	}
+	quote, err := i.paymentOps.Quote(req.Coin, invoice.Currency, invoice.Amount)
+	if err != nil {
+		return nil, err
+	}
+	// payouts are made in whole dollars, so the payer is quoted enough
+	// coin to cover the amount rounded up
+	usdAmount := int64(math.Ceil(quote.UsdAmount))
+	if quote.UsdAmount > 0 {
+		quote.CoinAmount = int64(math.Ceil(float64(quote.CoinAmount) * float64(usdAmount) / quote.UsdAmount))
+	}
+	if pending, err := i.pendingPayment(invoice, req.Coin, refundAddress); err == nil {
+		return &types.PayInvoiceResponse{InitPaymentResponse: &types.InitPaymentResponse{
+			AddressUsed: pending.AddressUsed,
+			Coin:        pending.Coin,
+			PaymentId:   pending.ID.String(),
+		}, Quote: quote}, nil
+	}
+	resp, err := i.paymentOps.InitializePayment(invoice.UserId, &types.InitPaymentRequest{
+		BeneficiaryId: invoice.BeneficiaryId,
+		Amount:        json.Number(strconv.FormatInt(usdAmount, 10)),
+		Coin:          req.Coin,
+		RefundAddress: refundAddress,
+		InvoiceId:     invoice.ID.String(),
+		PayerEmail:    email,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &types.PayInvoiceResponse{InitPaymentResponse: resp, Quote: quote}, nil
+}
+
+// pendingPayment returns the payment for invoice still waiting for coin to
+// arrive at its deposit address.
+func (i *invoiceOps) pendingPayment(invoice *types.Invoice, coin, refundAddress string) (*types.Payment, error) {
+	payment := &types.Payment{}
+	err := i.db.Table("payments").
+		Where("invoice_id = ? AND coin = ? AND refund_address = ? AND address_used <> ''",
+			invoice.ID.String(), coin, refundAddress).
+		Where("status = '' OR status IS NULL").
+		Order("ts desc").First(payment).Error
+	return payment, err
+}
+
+// amountPaid is what payment paid out towards invoice, in the invoice
+// currency's minor unit. Payouts are made in whole dollars.
+func amountPaid(invoice *types.Invoice, payment *types.Payment) int64 {
+	if invoice.Currency == "USD" {
+		return int64(payment.UsdAmount) * 100
+	}
+	return payment.KoboAmount
+}
+
+// CompleteInvoice marks the invoice payment was made for as paid and lets
+// the requester and payer know. A payment started before the invoice
+// expired or was cancelled still completes it, since the money has been
+// paid out. One that fell short of the invoice amount leaves it unpaid.
+func (i *invoiceOps) CompleteInvoice(payment *types.Payment) error {
+	invoice, err := i.getInvoiceByAttr("id", payment.InvoiceId)
+	if err != nil {
+		return err
+	}
+	if paid := amountPaid(invoice, payment); paid < invoice.Amount {
+		i.logger.WithFields(logrus.Fields{
+			"invoice_id": invoice.ID.String(),
+			"payment_id": payment.ID.String(),
+			"amount":     invoice.Amount,
+			"paid":       paid,
+		}).Warn("payment did not cover the invoice")
+		return errors.New(http.StatusConflict, "payment did not cover the invoice amount")
+	}
+	now := time.Now()
+	result := i.db.Table("invoices").
+		Where("id = ? AND status <> ?", invoice.ID.String(), types.InvoicePaid).
+		Updates(map[string]interface{}{
+			"status":      types.InvoicePaid,
+			"payment_id":  payment.ID.String(),
+			"amount_paid": payment.KoboAmount,
+			"paid_at":     now,
+		})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		i.logger.WithFields(logrus.Fields{
+			"invoice_id": invoice.ID.String(),
+			"payment_id": payment.ID.String(),
+		}).Warn("invoice was paid more than once")
+	}
+	requester, err := i.userOps.GetUserByAttr("id", invoice.UserId)
+	if err != nil {
+		return err
+	}
+	beneficiary, err := i.accountOps.GetBeneficiaryByAttr("id", invoice.BeneficiaryId)
+	if err != nil {
+		return err
+	}
+
+	go func(requester *types.User, invoice *types.Invoice, payment *types.Payment) {
+		value, err := fn.GenerateInvoicePaidEmail(requester.Name(), beneficiary, invoice, payment)
+		if err != nil {
+			return
+		}
+		if err := fn.SendEmail(&types.MailRequest{
+			User:  requester.Name(),
+			Email: requester.Email,
+			Title: "Your payment request has been paid - CashTroops",
+			Body:  value,
+		}); err != nil {
+			i.logger.WithError(err).Error("failed to send email")
+		}
+	}(requester, invoice, payment)
+	if payment.PayerEmail != "" {
+		go func(requester *types.User, invoice *types.Invoice, payment *types.Payment) {
+			value, err := fn.GenerateInvoiceReceiptEmail(requester.Name(), invoice, payment)
+			if err != nil {
+				return
+			}
+			if err := fn.SendEmail(&types.MailRequest{
+				User:  payment.PayerEmail,
+				Email: payment.PayerEmail,
+				Title: fmt.Sprintf("You paid %s - CashTroops", requester.Name()),
+				Body:  value,
+			}); err != nil {
+				i.logger.WithError(err).Error("failed to send email")
+			}
+		}(requester, invoice, payment)
+	}
+	return nil
+}
+
+// expire marks an open invoice past its expiry as expired.
+func (i *invoiceOps) expire(invoice *types.Invoice) {
+	if invoice.Status != types.InvoiceOpen || time.Now().Before(invoice.ExpiresAt) {
+		return
+	}
+	invoice.Status = types.InvoiceExpired
+	if err := i.db.Table("invoices").Where("id = ? AND status = ?", invoice.ID.String(), types.InvoiceOpen).
+		UpdateColumn("status", types.InvoiceExpired).Error; err != nil {
+		i.logger.WithError(err).WithField("invoice_id", invoice.ID.String()).Error("failed to expire invoice")
+	}
+}
+
+func (i *invoiceOps) getInvoiceByAttr(attr string, value interface{}) (*types.Invoice, error) {
+	invoice := &types.Invoice{}
+	err := i.db.Table("invoices").Where(attr+" = ?", value).First(invoice).Error
+	return invoice, err
+}
@@ -4,17 +4,29 @@ import (
 	"fmt"
 	"github.com/adigunhammedolalekan/cashtroops/errors"
 	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/ledger"
 	"github.com/adigunhammedolalekan/cashtroops/libs/bc"
 	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
 	"github.com/adigunhammedolalekan/cashtroops/libs/priceclient"
+	"github.com/adigunhammedolalekan/cashtroops/libs/rails"
 	"github.com/adigunhammedolalekan/cashtroops/types"
 	"github.com/btcsuite/btcutil"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
+	"math"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// txnWebhookUrl receives confirmations for coin sent to generated addresses
+const txnWebhookUrl = "https://webhook.site/59ae6da0-029a-4368-9696-5f533b3c36a7"
+
+// ErrPayoutNotStarted is returned by ProcessPayment when it failed before
+// any provider could have accepted the payout.
+var ErrPayoutNotStarted = errors.New(http.StatusInternalServerError,
+	"failed to complete payment due to an error on our end. please retry later")
+
 type PaymentOps interface {
 	InitializePayment(userId string, req *types.InitPaymentRequest) (*types.InitPaymentResponse, error)
 	VerifyWebHookId(webHookId string) error
@@ -25,8 +37,25 @@ type PaymentOps interface {
 	ListPayments(userId string) ([]*types.Payment, error)
 	InitRate(pair string, value int64) error
 	GetPaymentByAttr(attr string, value interface{}) (*types.Payment, error)
-	CompletePayment(transferStatus string, trf *types.TransferEvent) error
+	ParsePayoutEvent(provider string, header http.Header, body []byte) (*types.PayoutEvent, error)
+	CompletePayment(event *types.PayoutEvent) error
 	GetTransferByAttr(attr string, value interface{}) (*types.Transfer, error)
+	RefundPayment(userId, paymentId, address string) (*types.Payment, error)
+	ListPendingOtpTransfers() ([]*types.Transfer, error)
+	FinalizeTransfer(transferCode, otp string) (*types.Transfer, error)
+	FinalizeTransfers(reqs []*paystackclient.FinalizeTransferRequest) []*types.FinalizeTransferResult
+	ResendTransferOtp(transferCode string) error
+	SetPayoutBatcher(batcher *PayoutBatcher)
+	SetBalanceMonitor(monitor *BalanceMonitor)
+	ProcessQueuedPayments()
+	PayoutBalanceStatus() (*types.PayoutBalanceStatus, error)
+	Quote(coin, currency string, amount int64) (*types.Quote, error)
+	SetInvoiceOps(invoices InvoiceOps)
+	SetWalletOps(wallet WalletOps)
+	SetStepUpThreshold(usd int64)
+	// StepUp checks the second factor of userId when a payment of
+	// usdAmount needs one.
+	StepUp(userId, code string, usdAmount float64) error
 }
 
 type paymentOps struct {
@@ -36,14 +65,26 @@ type paymentOps struct {
 	bcClient    bc.Client
 	priceClient priceclient.Client
 	ps          paystackclient.Client
+	payouts     *rails.Router
+	batcher     *PayoutBatcher
+	monitor     *BalanceMonitor
+	invoices    InvoiceOps
+	wallet      WalletOps
+	ledger      *ledger.Ledger
 	logger      *logrus.Logger
+
+	// payments of at least stepUpThreshold dollars need a second factor
+	stepUpThreshold int64
 }
 
 func NewPaymentOps(
 	db *gorm.DB,
 	bcClient bc.Client,
 	ops UserOps,
-	accountOps AccountOps, ps paystackclient.Client, logger *logrus.Logger) PaymentOps {
+	accountOps AccountOps,
+	ps paystackclient.Client,
+	payouts *rails.Router,
+	ledger *ledger.Ledger, logger *logrus.Logger) PaymentOps {
 	return &paymentOps{
 		db:          db,
 		bcClient:    bcClient,
@@ -51,31 +92,115 @@ func NewPaymentOps(
 		userOps:     ops,
 		accountOps:  accountOps,
 		ps:          ps,
+		payouts:     payouts,
+		ledger:      ledger,
 		logger:      logger,
 	}
 }
 
+// SetPayoutBatcher makes ProcessPayment queue transfers on batcher instead
+// of initiating them one at a time.
+func (p *paymentOps) SetPayoutBatcher(batcher *PayoutBatcher) {
+	p.batcher = batcher
+	batcher.SetFailureHandler(p.payoutReversed)
+}
+
+// SetBalanceMonitor makes ProcessPayment queue payouts the Paystack balance
+// cannot cover instead of initiating them.
+func (p *paymentOps) SetBalanceMonitor(monitor *BalanceMonitor) {
+	p.monitor = monitor
+}
+
+// SetInvoiceOps makes CompletePayment mark invoices paid by completed
+// payments.
+func (p *paymentOps) SetInvoiceOps(invoices InvoiceOps) {
+	p.invoices = invoices
+}
+
+// SetWalletOps makes failed and reversed balance payments return to the
+// user's balance.
+func (p *paymentOps) SetWalletOps(wallet WalletOps) {
+	p.wallet = wallet
+}
+
+// SetStepUpThreshold makes payments of at least usd dollars need a second
+// factor from users with two factor authentication. Zero disables it.
+func (p *paymentOps) SetStepUpThreshold(usd int64) {
+	p.stepUpThreshold = usd
+}
+
+func (p *paymentOps) StepUp(userId, code string, usdAmount float64) error {
+	if p.stepUpThreshold <= 0 || usdAmount < float64(p.stepUpThreshold) {
+		return nil
+	}
+	return p.userOps.VerifyStepUp(userId, code)
+}
+
 func (p *paymentOps) InitializePayment(userId string, req *types.InitPaymentRequest) (*types.InitPaymentResponse, error) {
+	if req.RefundAddress != "" {
+		if err := p.bcClient.ValidateAddress(req.RefundAddress); err != nil {
+			return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("refund address is not a valid %s address", req.Coin))
+		}
+	}
 	beneficiaryId := req.BeneficiaryId
-	if beneficiaryId == "" && req.Beneficiary != nil {
-		newBeneficiary := types.NewBeneficiary(&types.CreateBeneficiaryOpts{
+	newBeneficiary := beneficiaryId == "" && req.Beneficiary != nil
+	// schedules and invoice payers start payments without the user present
+	if req.InvoiceId == "" && req.ScheduleId == "" {
+		var err error
+		if newBeneficiary {
+			// paying a new beneficiary adds one, which always needs a second factor
+			err = p.userOps.VerifyStepUp(userId, req.TwoFactorCode)
+		} else {
+			err = p.StepUp(userId, req.TwoFactorCode, float64(req.AmountInt()))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var corridor *types.Corridor
+	if newBeneficiary {
+		newBeneficiary, err := p.accountOps.BeneficiaryForPayment(userId, &types.CreateBeneficiaryOpts{
 			AccountName:   req.Beneficiary.AccountName,
 			AccountNumber: req.Beneficiary.AccountNumber,
 			BankName:      req.Beneficiary.BankName,
 			BankCode:      req.Beneficiary.BankCode,
-			Hidden:        true,
-		}, userId)
-		if err := p.db.Table("beneficiaries").Create(newBeneficiary).Error; err != nil {
-			p.logger.WithError(err).Error("failed to create hidden beneficiary")
+			Corridor:      req.Beneficiary.Corridor,
+			ConfirmName:   req.Beneficiary.ConfirmName,
+		})
+		if err != nil {
+			if _, ok := err.(*errors.Error); ok {
+				return nil, err
+			}
 			return nil, errors.New(http.StatusInternalServerError, "failed to process transaction at this time. please retry later.")
 		}
+		if !newBeneficiary.Payable() {
+			return nil, ErrBeneficiaryNameUnconfirmed
+		}
 		beneficiaryId = newBeneficiary.ID.String()
+		corridor = newBeneficiary.PayoutCorridor()
+	} else {
+		beneficiary, err := p.accountOps.GetBeneficiaryByAttr("id", beneficiaryId)
+		if err != nil || beneficiary.Owner != userId || beneficiary.Removed {
+			return nil, errors.New(http.StatusNotFound, "beneficiary not found")
+		}
+		if !beneficiary.Payable() {
+			return nil, ErrBeneficiaryNameUnconfirmed
+		}
+		corridor = beneficiary.PayoutCorridor()
+		if !p.accountOps.IsSupportedBank(corridor.Code, beneficiary.BankCode) {
+			return nil, errors.New(http.StatusBadRequest, "the beneficiary's bank is no longer supported. please add a new beneficiary")
+		}
 	}
 	payment := &types.Payment{
 		UserId:        userId,
 		Amount:        req.AmountInt(),
 		Coin:          req.Coin,
+		Currency:      corridor.Currency,
 		BeneficiaryId: beneficiaryId,
+		RefundAddress: req.RefundAddress,
+		InvoiceId:     req.InvoiceId,
+		PayerEmail:    req.PayerEmail,
+		ScheduleId:    req.ScheduleId,
 		Ts:            time.Now(),
 	}
 	tx := p.db.Begin()
@@ -93,6 +218,7 @@ func (p *paymentOps) InitializePayment(userId string, req *types.InitPaymentRequ
 		return nil, errors.New(http.StatusInternalServerError, "failed to process transaction at this time. please retry later.")
 	}
 	newAddress := &types.Address{
+		Address:  addr.Address,
 		Public:   addr.Public,
 		Private:  addr.Private,
 		Provider: "BLOCKCYPHER",
@@ -113,7 +239,7 @@ func (p *paymentOps) InitializePayment(userId string, req *types.InitPaymentRequ
 	}
 	event := bc.Event{
 		Event:   bc.EventTypeTxConfirmation,
-		URL:     "https://webhook.site/59ae6da0-029a-4368-9696-5f533b3c36a7",
+		URL:     txnWebhookUrl,
 		Address: addr.Address,
 	}
 	newEvent, err := p.bcClient.AddHook(event)
@@ -162,7 +288,7 @@ func (p *paymentOps) FinalizePayment(address string, amount int64) error {
 		p.logger.WithError(err).Error("payment not found")
 		return err
 	}
-	if payment.Status == types.DONE {
+	if payment.Status != "" && payment.Status != types.INITIALIZED {
 		p.logger.WithFields(logrus.Fields{
 			"status": payment.Status,
 			"id":     payment.ID.String(),
@@ -174,25 +300,110 @@ func (p *paymentOps) FinalizePayment(address string, amount int64) error {
 		p.logger.WithError(err).Error("failed to get current BTC price")
 		return errors.New(http.StatusInternalServerError, "failed to finalize transaction")
 	}
-	rate, err := p.GetCurrentRate("USD-NGN")
+	if payment.Currency == "" {
+		payment.Currency = "NGN"
+	}
+	corridor, ok := types.CorridorForCurrency(payment.Currency)
+	if !ok {
+		p.logger.WithField("currency", payment.Currency).Error("no corridor pays out in payment currency")
+		return errors.New(http.StatusInternalServerError, "failed to finalize transaction")
+	}
+	pair := corridor.RatePair()
+	rate, err := p.GetCurrentRate(pair)
 	if err != nil {
-		p.logger.WithError(err).Error("failed to get current rate")
-		return errors.New(http.StatusInternalServerError, "failed to get USD-NGN rate")
+		p.logger.WithError(err).WithField("pair", pair).Error("failed to get current rate")
+		return errors.New(http.StatusInternalServerError, fmt.Sprintf("failed to get %s rate", pair))
 	}
-	// convert amount from SHATOSHI to BTC, then to USD, then to NGN-KOBO
+	// convert amount from SHATOSHI to BTC, then to USD, then to the payout
+	// currency's minor unit e.g NGN-KOBO
 	btcAmount := btcutil.Amount(amount).ToUnit(btcutil.AmountBTC)
 	amountInUsd := btcAmount * currentBtcPrice.FloatAmount()
 	amountInKobo := (int64(amountInUsd) * rate.Value) * 100
 	payment.KoboAmount = amountInKobo
 	payment.UsdAmount = amountInUsd
 	payment.BtcAmount = btcAmount
-	err = p.db.Table("payments").Where("id = ?", payment.ID.String()).Update(payment).Error
-	if err != nil {
+	payment.CoinAmount = amount
+	// whole dollars are paid out, what is left over is kept as a fee
+	exactKobo := int64(amountInUsd * float64(rate.Value) * 100)
+	if exactKobo < amountInKobo {
+		exactKobo = amountInKobo
+	}
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	// coin is only recorded once, so a repeated or concurrent notification
+	// for the address cannot finalize the payment again
+	result := tx.Table("payments").Where("id = ? AND coin_amount = 0", payment.ID.String()).
+		Where("status = '' OR status IS NULL OR status = ?", types.INITIALIZED).
+		UpdateColumns(map[string]interface{}{
+			"kobo_amount": payment.KoboAmount,
+			"usd_amount":  payment.UsdAmount,
+			"btc_amount":  payment.BtcAmount,
+			"coin_amount": payment.CoinAmount,
+			"currency":    payment.Currency,
+		})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		p.logger.WithField("id", payment.ID.String()).Info("payment has already been processed")
+		return errors.New(http.StatusConflict, "payment has already been processed")
+	}
+	if err := p.ledger.PostTx(tx, ledger.KindCoinReceived, payment.ID.String(), "coin received for payment",
+		ledger.Debit(ledger.DepositClearing, strings.ToUpper(payment.Coin), amount),
+		ledger.Credit(ledger.Fx, strings.ToUpper(payment.Coin), amount),
+		ledger.Debit(ledger.Fx, payment.Currency, exactKobo),
+		ledger.Credit(ledger.PayoutClearing, payment.Currency, amountInKobo),
+		ledger.Credit(ledger.FeeRevenue, payment.Currency, exactKobo-amountInKobo),
+	); err != nil {
+		tx.Rollback()
+		p.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("failed to post to ledger")
+		return errors.New(http.StatusInternalServerError, "failed to finalize transaction")
+	}
+	if err := tx.Commit().Error; err != nil {
 		return err
 	}
 	return p.ProcessPayment(payment)
 }
 
+// Quote converts amount, in currency's minor unit, into coin at the current
+// price and rate.
+func (p *paymentOps) Quote(coin, currency string, amount int64) (*types.Quote, error) {
+	price, err := p.priceClient.CurrentPrice()
+	if err != nil || price.FloatAmount() <= 0 {
+		p.logger.WithError(err).Error("failed to get current BTC price")
+		return nil, errors.New(http.StatusInternalServerError, "failed to get a quote at this time. please retry later.")
+	}
+	var rate int64 = 1
+	if currency != "USD" {
+		corridor, ok := types.CorridorForCurrency(currency)
+		if !ok {
+			return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("%s is not a supported currency", currency))
+		}
+		pair := corridor.RatePair()
+		value, err := p.GetCurrentRate(pair)
+		if err != nil || value.Value <= 0 {
+			p.logger.WithError(err).WithField("pair", pair).Error("failed to get current rate")
+			return nil, errors.New(http.StatusInternalServerError, fmt.Sprintf("failed to get %s rate", pair))
+		}
+		rate = value.Value
+	}
+	usdAmount := float64(amount) / 100 / float64(rate)
+	return &types.Quote{
+		Currency:   currency,
+		Amount:     amount,
+		UsdAmount:  usdAmount,
+		Coin:       coin,
+		CoinPrice:  price.FloatAmount(),
+		CoinAmount: int64(math.Ceil(usdAmount / price.FloatAmount() * btcutil.SatoshiPerBitcoin)),
+		Rate:       rate,
+		Ts:         time.Now(),
+	}, nil
+}
+
 func (p *paymentOps) GetPaymentByAddress(address string) (*types.Payment, error) {
 	return p.GetPaymentByAttr("address_used", address)
 }
@@ -209,49 +420,146 @@ func (p *paymentOps) ProcessPayment(payment *types.Payment) error {
 		p.logger.WithError(err).Error("failed to find beneficiary")
 		return errors.New(http.StatusInternalServerError, "failed to complete payment at this time. please retry")
 	}
-	trfRecipientId := beneficiary.TransferRecipientId
-	if trfRecipientId == "" {
-		p.logger.WithFields(logrus.Fields{
-			"account_number": beneficiary.AccountNumber,
-		}).Info("creating TRF recv for account")
-		transferRecipient, err := p.ps.CreateTransferRecipient(&paystackclient.TransferRecipientBody{
-			Type:          "nuban",
-			Name:          beneficiary.AccountName,
+	corridor := beneficiary.PayoutCorridor()
+	var newTransfer *types.Transfer
+	var providerName string
+	// started is set once a provider may have accepted the transfer
+	started := false
+	err = p.payouts.Do(beneficiary.BankCode, func(provider rails.PayoutProvider) error {
+		providerName = provider.Name()
+		trfRecipientId, err := p.transferRecipientFor(beneficiary, provider)
+		if err != nil {
+			return err
+		}
+		// the balance monitor and bulk transfers only cover the NGN balance
+		if provider.Name() == rails.Paystack && corridor.Currency == "NGN" {
+			if p.monitor != nil {
+				if err := p.monitor.Check(payment.KoboAmount); err != nil {
+					return err
+				}
+			}
+			if p.batcher != nil {
+				return p.batcher.Add(payment, trfRecipientId)
+			}
+		}
+		newTransfer, err = provider.InitiateTransfer(&rails.TransferRequest{
+			Amount:        payment.KoboAmount,
+			Currency:      corridor.Currency,
+			Recipient:     trfRecipientId,
 			AccountNumber: beneficiary.AccountNumber,
 			BankCode:      beneficiary.BankCode,
-			Currency:      "NGN",
+			Reference:     payment.ID.String(),
 		})
 		if err != nil {
-			p.logger.WithError(err).Error("failed to create TRF recipient")
-			return errors.New(http.StatusInternalServerError, "failed to complete payment due to an error on our end. please retry later")
-		}
-		p.logger.WithField("recipient", transferRecipient).Info("Recipient Created!")
-		trfRecipientId = transferRecipient.RecipientCode
-		if err := p.db.Table("beneficiaries").Where("id = ?", beneficiary.ID.String()).
-			UpdateColumn("transfer_recipient_id", trfRecipientId).Error; err != nil {
-			p.logger.WithError(err).Error("failed to update TRF recipient_id")
-			return errors.New(http.StatusInternalServerError, "failed to complete payment due to an error on our end. please retry later")
+			p.logger.WithError(err).WithField("provider", provider.Name()).Error("failed to initiate transfer")
+			started = started || !rails.IsRejected(err)
 		}
-	}
-	newTransfer, err := p.ps.InitiateTransfer(&paystackclient.InitiateTransferRequest{
-		Source:    "balance",
-		Amount:    payment.KoboAmount,
-		Reason:    "",
-		Recipient: trfRecipientId,
+		return err
 	})
+	if err == ErrPayoutsPaused {
+		p.logger.WithField("payment_id", payment.ID.String()).Warn("payouts paused. queueing payment")
+		return p.db.Table("payments").Where("id = ?", payment.ID.String()).
+			UpdateColumn("status", types.QUEUED).Error
+	}
+	if err != nil && !started {
+		return ErrPayoutNotStarted
+	}
 	if err != nil {
-		p.logger.WithError(err).Error("failed to initiate transfer")
 		return errors.New(http.StatusInternalServerError, "failed to complete payment due to an error on our end. please retry later")
 	}
+	if newTransfer == nil {
+		// queued on the bulk transfer batcher, which books the payout
+		return nil
+	}
 
 	newTransfer.PaymentId = payment.ID.String()
-	if err := p.db.Table("transfers").Create(newTransfer).Error; err != nil {
-		p.logger.WithError(err).Error("failed to log transfer")
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if err := tx.Table("transfers").Create(newTransfer).Error; err != nil {
+		tx.Rollback()
+		p.logger.WithError(err).WithField("transfer_code", newTransfer.TransferCode).Error("failed to log transfer")
 		return errors.New(http.StatusInternalServerError, "failed to complete payment due to an error on our end. please retry later")
 	}
+	if err := p.ledger.PostTx(tx, ledger.KindPayoutInitiated, payment.ID.String(), "payout initiated with "+providerName,
+		payoutInitiated(payment, providerName)...); err != nil {
+		tx.Rollback()
+		p.logger.WithError(err).WithField("transfer_code", newTransfer.TransferCode).Error("failed to post to ledger")
+		return errors.New(http.StatusInternalServerError, "failed to complete payment due to an error on our end. please retry later")
+	}
+	if err := tx.Commit().Error; err != nil {
+		p.logger.WithError(err).WithField("transfer_code", newTransfer.TransferCode).Error("failed to log transfer")
+		return errors.New(http.StatusInternalServerError, "failed to complete payment due to an error on our end. please retry later")
+	}
+	if newTransfer.Status == types.TransferStatusOtp {
+		p.logger.WithFields(logrus.Fields{
+			"payment_id":    payment.ID.String(),
+			"transfer_code": newTransfer.TransferCode,
+		}).Warn("transfer is waiting for OTP finalization")
+	}
 	return nil
 }
 
+// payoutInitiated is the journal for a payout provider has started. Providers
+// take the payout from their float when it is initiated and give it back if
+// it fails.
+func payoutInitiated(payment *types.Payment, provider string) []ledger.Line {
+	return []ledger.Line{
+		ledger.Debit(ledger.PayoutClearing, payment.Currency, payment.KoboAmount),
+		ledger.Credit(ledger.ProviderFloat(provider), payment.Currency, payment.KoboAmount),
+	}
+}
+
+// transferRecipientFor returns the recipient code provider issued for
+// beneficiary, creating and saving one the first time the beneficiary is
+// paid through that provider.
+func (p *paymentOps) transferRecipientFor(beneficiary *types.Beneficiary, provider rails.PayoutProvider) (string, error) {
+	if provider.Name() == rails.Paystack && beneficiary.TransferRecipientId != "" {
+		return beneficiary.TransferRecipientId, nil
+	}
+	existing := &types.PayoutRecipient{}
+	err := p.db.Table("payout_recipients").Where("beneficiary_id = ? AND provider = ?",
+		beneficiary.ID.String(), provider.Name()).First(existing).Error
+	if err == nil {
+		return existing.Code, nil
+	}
+	p.logger.WithFields(logrus.Fields{
+		"account_number": beneficiary.AccountNumber,
+		"provider":       provider.Name(),
+	}).Info("creating TRF recv for account")
+	corridor := beneficiary.PayoutCorridor()
+	code, err := provider.CreateRecipient(&rails.RecipientRequest{
+		Type:          corridor.RecipientType,
+		Name:          beneficiary.AccountName,
+		AccountNumber: beneficiary.AccountNumber,
+		BankCode:      beneficiary.BankCode,
+		Currency:      corridor.Currency,
+	})
+	if err != nil {
+		p.logger.WithError(err).Error("failed to create TRF recipient")
+		return "", err
+	}
+	recipient := &types.PayoutRecipient{
+		BeneficiaryId: beneficiary.ID.String(),
+		Provider:      provider.Name(),
+		Code:          code,
+		Ts:            time.Now(),
+	}
+	if err := p.db.Table("payout_recipients").Create(recipient).Error; err != nil {
+		p.logger.WithError(err).Error("failed to save TRF recipient")
+		return "", err
+	}
+	if provider.Name() == rails.Paystack {
+		if err := p.db.Table("beneficiaries").Where("id = ?", beneficiary.ID.String()).
+			UpdateColumn("transfer_recipient_id", code).Error; err != nil {
+			p.logger.WithError(err).Error("failed to update TRF recipient_id")
+			return "", err
+		}
+	}
+	return code, nil
+}
+
 func (p *paymentOps) ListPayments(userId string) ([]*types.Payment, error) {
 	values := make([]*types.Payment, 0)
 	err := p.db.Table("payments").Where("user_id = ?", userId).Find(&values).Error
@@ -270,8 +578,30 @@ func (p *paymentOps) InitRate(pair string, value int64) error {
 	return p.db.Table("rates").Create(rate).Error
 }
 
-func (p *paymentOps) CompletePayment(transferStatus string, trf *types.TransferEvent) error {
-	transfer, err := p.GetTransferByAttr("reference", trf.Reference)
+func (p *paymentOps) ParsePayoutEvent(provider string, header http.Header, body []byte) (*types.PayoutEvent, error) {
+	rail, ok := p.payouts.Provider(provider)
+	if !ok {
+		return nil, errors.New(http.StatusNotFound, "unknown payout provider")
+	}
+	event, err := rail.ParseWebhook(header, body)
+	if err == rails.ErrInvalidSignature {
+		return nil, errors.New(http.StatusUnauthorized, err.Error())
+	}
+	if err != nil {
+		return nil, errors.New(http.StatusBadRequest, "malformed webhook body")
+	}
+	return event, nil
+}
+
+// payoutPredecessors are the statuses a payout event can move a payment
+// from, by the status it moves it to.
+var payoutPredecessors = map[types.PaymentStatus][]types.PaymentStatus{
+	types.DONE:     {"", types.INITIALIZED, types.BATCHED, types.REVIEW},
+	types.REVERSED: {"", types.INITIALIZED, types.BATCHED, types.REVIEW, types.DONE},
+}
+
+func (p *paymentOps) CompletePayment(event *types.PayoutEvent) error {
+	transfer, err := p.GetTransferByAttr("reference", event.Reference)
 	if err != nil {
 		return err
 	}
@@ -279,19 +609,57 @@ func (p *paymentOps) CompletePayment(transferStatus string, trf *types.TransferE
 	if err != nil {
 		return err
 	}
-	paymentStatus := types.DONE
-	switch transferStatus {
-	case "transfer.failed":
-		paymentStatus = types.REVERSED
-	case "transfer.reversed":
+	var paymentStatus types.PaymentStatus
+	switch event.Status {
+	case types.PayoutEventSuccess:
+		paymentStatus = types.DONE
+	case types.PayoutEventFailed, types.PayoutEventReversed:
 		paymentStatus = types.REVERSED
 	default:
-		break
+		p.logger.WithField("reference", event.Reference).Info("ignoring transfer event")
+		return nil
+	}
+	if err := p.db.Table("transfers").Where("reference = ?", event.Reference).
+		UpdateColumn("status", event.Status).Error; err != nil {
+		return err
+	}
+	// webhooks are redelivered, so only a payment still waiting on its
+	// payout, or a paid one being reversed, moves on
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	result := tx.Table("payments").Where("id = ? AND status IN (?)", payment.ID.String(), payoutPredecessors[paymentStatus]).
+		UpdateColumn("status", paymentStatus)
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		p.logger.WithFields(logrus.Fields{
+			"reference": event.Reference,
+			"status":    payment.Status,
+		}).Info("ignoring transfer event for a payment that has moved on")
+		return nil
+	}
+	if paymentStatus == types.REVERSED {
+		if err := p.ledger.ReverseTx(tx, ledger.KindPayoutInitiated, payment.ID.String(), ledger.KindPayoutFailed,
+			"payout "+event.Status); err != nil {
+			tx.Rollback()
+			p.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("failed to post to ledger")
+			return err
+		}
 	}
-	if err := p.db.Table("payments").Where("id = ?", payment.ID.String()).
-		UpdateColumn("status", paymentStatus).Error; err != nil {
+	if err := tx.Commit().Error; err != nil {
 		return err
 	}
+	if paymentStatus == types.DONE {
+		if err := p.db.Table("beneficiaries").Where("id = ?", payment.BeneficiaryId).
+			UpdateColumn("last_paid_at", time.Now()).Error; err != nil {
+			p.logger.WithError(err).Error("failed to update beneficiary last paid time")
+		}
+	}
 	beneficiary, err := p.accountOps.GetBeneficiaryByAttr("id", payment.BeneficiaryId)
 	if err != nil {
 		return err
@@ -301,6 +669,12 @@ func (p *paymentOps) CompletePayment(transferStatus string, trf *types.TransferE
 		return err
 	}
 
+	if paymentStatus == types.DONE && payment.InvoiceId != "" && p.invoices != nil {
+		if err := p.invoices.CompleteInvoice(payment); err != nil {
+			p.logger.WithError(err).WithField("invoice_id", payment.InvoiceId).Error("failed to complete invoice")
+		}
+		return nil
+	}
 	if paymentStatus == types.DONE {
 		go func(account *types.User, payment *types.Payment, beneficiary *types.Beneficiary) {
 			value, err := fn.GeneratePaymentCompletedEmail(account.Name(), beneficiary, payment)
@@ -319,10 +693,203 @@ func (p *paymentOps) CompletePayment(transferStatus string, trf *types.TransferE
 		return nil
 	}
 
-	// Handle other cases.
+	payment.Status = paymentStatus
+	p.payoutReversed(payment)
 	return nil
 }
 
+// payoutReversed tells the payer a payout failed or was reversed after its
+// journal was reversed. Balance payments go back to the balance and others
+// are refunded to their refund address, or left for RefundPayment when
+// they have none.
+func (p *paymentOps) payoutReversed(payment *types.Payment) {
+	name, email := p.payer(payment)
+	go func(name, email string, payment *types.Payment) {
+		if email == "" {
+			return
+		}
+		value, err := fn.GeneratePaymentReversedEmail(name, payment)
+		if err != nil {
+			return
+		}
+		if err := fn.SendEmail(&types.MailRequest{
+			User:  name,
+			Email: email,
+			Title: "Your payment could not be completed - CashTroops",
+			Body:  value,
+		}); err != nil {
+			p.logger.WithError(err).Error("failed to send email")
+		}
+	}(name, email, payment)
+	if payment.FromBalance {
+		p.returnToBalance(payment)
+		return
+	}
+	if payment.RefundAddress != "" {
+		go func(payment *types.Payment) {
+			if _, err := p.refund(payment, payment.RefundAddress); err != nil {
+				p.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("automatic refund failed")
+			}
+		}(payment)
+	}
+}
+
+func (p *paymentOps) RefundPayment(userId, paymentId, address string) (*types.Payment, error) {
+	payment, err := p.GetPaymentByAttr("id", paymentId)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "payment not found")
+	}
+	if payment.UserId != userId {
+		return nil, errors.New(http.StatusForbidden, "you cannot refund a payment that does not belong to you")
+	}
+	// the coin for an invoice came from its payer, so it only ever goes back
+	// to the refund address they left
+	if payment.InvoiceId != "" {
+		if payment.RefundAddress == "" {
+			return nil, errors.New(http.StatusConflict, "the payer did not leave a refund address for this payment")
+		}
+		address = payment.RefundAddress
+	}
+	if err := p.bcClient.ValidateAddress(address); err != nil {
+		return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("refund address is not a valid %s address", payment.Coin))
+	}
+	return p.refund(payment, address)
+}
+
+// refund sends the coin received for a reversed payment back to address,
+// less the network fee, and marks the payment as REFUNDED.
+func (p *paymentOps) refund(payment *types.Payment, address string) (*types.Payment, error) {
+	if payment.FromBalance {
+		return nil, errors.New(http.StatusConflict, "payments from your balance are returned to it automatically")
+	}
+	if payment.Status != types.REVERSED && payment.Status != types.FAILED {
+		return nil, errors.New(http.StatusConflict, "only failed or reversed payments can be refunded")
+	}
+	depositAddress := &types.Address{}
+	if err := p.db.Table("addresses").Where("address = ?", payment.AddressUsed).First(depositAddress).Error; err != nil {
+		p.logger.WithError(err).Error("failed to find deposit address")
+		return nil, errors.New(http.StatusInternalServerError, "failed to refund payment at this time. please retry later")
+	}
+	fee, err := p.bcClient.EstimateFee()
+	if err != nil {
+		p.logger.WithError(err).Error("failed to estimate network fee")
+		return nil, errors.New(http.StatusInternalServerError, "failed to refund payment at this time. please retry later")
+	}
+	refundAmount := payment.CoinAmount - fee
+	if refundAmount <= 0 {
+		return nil, errors.New(http.StatusBadRequest, "amount received is too small to cover the network fee")
+	}
+
+	// claim the payment so concurrent requests cannot refund it twice
+	result := p.db.Table("payments").Where("id = ? AND status = ?", payment.ID.String(), payment.Status).
+		Updates(map[string]interface{}{"status": types.REFUNDING, "refund_address": address})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, errors.New(http.StatusConflict, "payment is already being refunded")
+	}
+	txHash, err := p.bcClient.Send(&bc.Address{
+		Address: depositAddress.Address,
+		Public:  depositAddress.Public,
+		Private: depositAddress.Private,
+	}, address, refundAmount, fee)
+	if err != nil {
+		p.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("failed to broadcast refund")
+		// a refund that may have been broadcast stays REFUNDING so it is
+		// not sent again
+		if bc.IsNotSent(err) {
+			p.db.Table("payments").Where("id = ?", payment.ID.String()).UpdateColumn("status", payment.Status)
+		}
+		return nil, errors.New(http.StatusInternalServerError, "failed to refund payment at this time. please retry later")
+	}
+	payment.Status = types.REFUNDED
+	payment.RefundAddress = address
+	payment.RefundAmount = refundAmount
+	payment.RefundTxHash = txHash
+	payment.TimeUpdated = time.Now()
+	if err := p.refunded(payment, fee); err != nil {
+		p.logger.WithError(err).WithField("tx_hash", txHash).Error("refund was sent but payment could not be updated")
+		return nil, err
+	}
+
+	name, email := p.payer(payment)
+	if email == "" {
+		return payment, nil
+	}
+	go func(name, email string, payment *types.Payment) {
+		value, err := fn.GenerateRefundEmail(name, payment)
+		if err != nil {
+			return
+		}
+		if err := fn.SendEmail(&types.MailRequest{
+			User:  name,
+			Email: email,
+			Title: fmt.Sprintf("Your %s has been refunded - CashTroops", payment.Coin),
+			Body:  value,
+		}); err != nil {
+			p.logger.WithError(err).Error("failed to send email")
+		}
+	}(name, email, payment)
+	return payment, nil
+}
+
+// refunded records a refund that was sent, booking the coin returned to
+// the payer and the network fee paid out of it separately.
+func (p *paymentOps) refunded(payment *types.Payment, fee int64) error {
+	coin := strings.ToUpper(payment.Coin)
+	lines := []ledger.Line{
+		ledger.Credit(ledger.DepositClearing, coin, payment.CoinAmount),
+		ledger.Debit(ledger.Fx, coin, payment.RefundAmount),
+		ledger.Debit(ledger.NetworkFees, coin, fee),
+	}
+	tx := p.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if err := tx.Table("payments").Where("id = ?", payment.ID.String()).Updates(map[string]interface{}{
+		"status":         payment.Status,
+		"refund_amount":  payment.RefundAmount,
+		"refund_tx_hash": payment.RefundTxHash,
+		"time_updated":   payment.TimeUpdated,
+	}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	// the payout side of the conversion is unwound, the coin side is what
+	// was actually sent
+	mirror, err := p.ledger.MirrorTx(tx, ledger.KindCoinReceived, payment.ID.String())
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, next := range mirror {
+		if next.Asset != coin {
+			lines = append(lines, next)
+		}
+	}
+	if err := p.ledger.PostTx(tx, ledger.KindRefund, payment.ID.String(), "refunded to "+payment.RefundAddress,
+		lines...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+// payer returns who sent the coins for payment. For an invoice that is
+// whoever paid it rather than the user who raised it, and email is empty
+// when they did not leave one.
+func (p *paymentOps) payer(payment *types.Payment) (name, email string) {
+	if payment.InvoiceId != "" {
+		return payment.PayerEmail, payment.PayerEmail
+	}
+	account, err := p.userOps.GetUserByAttr("id", payment.UserId)
+	if err != nil {
+		return "", ""
+	}
+	return account.Name(), account.Email
+}
+
 func (p *paymentOps) GetPaymentByAttr(attr string, value interface{}) (*types.Payment, error) {
 	payment := &types.Payment{}
 	err := p.db.Table("payments").Where(attr+" = ?", value).First(payment).Error
@@ -334,3 +901,142 @@ func (p *paymentOps) GetTransferByAttr(attr string, value interface{}) (*types.T
 	err := p.db.Table("transfers").Where(attr+" = ?", value).First(trf).Error
 	return trf, err
 }
+
+func (p *paymentOps) ListPendingOtpTransfers() ([]*types.Transfer, error) {
+	values := make([]*types.Transfer, 0)
+	err := p.db.Table("transfers").Where("status = ?", types.TransferStatusOtp).
+		Order("created_at asc").Find(&values).Error
+	return values, err
+}
+
+func (p *paymentOps) FinalizeTransfer(transferCode, otp string) (*types.Transfer, error) {
+	transfer, err := p.GetTransferByAttr("transfer_code", transferCode)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "transfer not found")
+	}
+	if transfer.Status != types.TransferStatusOtp {
+		return nil, errors.New(http.StatusConflict, "transfer is not awaiting OTP")
+	}
+	if otp == "" {
+		return nil, errors.New(http.StatusBadRequest, "otp is required")
+	}
+	finalized, err := p.ps.FinalizeTransfer(&paystackclient.FinalizeTransferRequest{
+		TransferCode: transferCode,
+		Otp:          otp,
+	})
+	if err != nil {
+		p.logger.WithError(err).WithField("transfer_code", transferCode).Error("failed to finalize transfer")
+		return nil, errors.New(http.StatusBadGateway, "failed to finalize transfer. please check the OTP and retry")
+	}
+	transfer.Status = finalized.Status
+	if err := p.db.Table("transfers").Where("transfer_code = ?", transferCode).
+		Updates(map[string]interface{}{"status": finalized.Status, "updated_at": time.Now()}).Error; err != nil {
+		p.logger.WithError(err).Error("failed to update finalized transfer")
+		return nil, err
+	}
+	return transfer, nil
+}
+
+func (p *paymentOps) FinalizeTransfers(reqs []*paystackclient.FinalizeTransferRequest) []*types.FinalizeTransferResult {
+	results := make([]*types.FinalizeTransferResult, 0, len(reqs))
+	for _, next := range reqs {
+		result := &types.FinalizeTransferResult{TransferCode: next.TransferCode}
+		transfer, err := p.FinalizeTransfer(next.TransferCode, next.Otp)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Status = transfer.Status
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (p *paymentOps) ResendTransferOtp(transferCode string) error {
+	transfer, err := p.GetTransferByAttr("transfer_code", transferCode)
+	if err != nil {
+		return errors.New(http.StatusNotFound, "transfer not found")
+	}
+	if transfer.Status != types.TransferStatusOtp {
+		return errors.New(http.StatusConflict, "transfer is not awaiting OTP")
+	}
+	if err := p.ps.ResendTransferOtp(transferCode); err != nil {
+		p.logger.WithError(err).WithField("transfer_code", transferCode).Error("failed to resend transfer OTP")
+		return errors.New(http.StatusBadGateway, "failed to resend OTP at this time. please retry")
+	}
+	return nil
+}
+
+// ProcessQueuedPayments retries payouts that were queued while the balance
+// circuit breaker was open, oldest first.
+func (p *paymentOps) ProcessQueuedPayments() {
+	values := make([]*types.Payment, 0)
+	if err := p.db.Table("payments").Where("status = ?", types.QUEUED).Order("ts asc").Find(&values).Error; err != nil {
+		p.logger.WithError(err).Error("failed to load queued payments")
+		return
+	}
+	p.logger.WithField("count", len(values)).Info("processing queued payments")
+	for _, payment := range values {
+		if p.monitor != nil && p.monitor.Tripped() {
+			return
+		}
+		// claim the payment so another instance draining the queue skips it
+		result := p.db.Table("payments").Where("id = ? AND status = ?", payment.ID.String(), types.QUEUED).
+			UpdateColumn("status", types.INITIALIZED)
+		if result.Error != nil {
+			p.logger.WithError(result.Error).Error("failed to release queued payment")
+			continue
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		payment.Status = types.INITIALIZED
+		if err := p.ProcessPayment(payment); err != nil {
+			p.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("failed to process queued payment")
+			p.processFailed(payment, err)
+		}
+	}
+}
+
+// processFailed settles a queued payment ProcessPayment failed on. Only a
+// balance payment whose payout is known not to have started goes back to
+// the balance. Any other payment may have been paid out, or has nobody
+// waiting on it to retry, so it is left for an operator.
+func (p *paymentOps) processFailed(payment *types.Payment, err error) {
+	status := types.REVIEW
+	if err == ErrPayoutNotStarted && payment.FromBalance {
+		status = types.FAILED
+	}
+	result := p.db.Table("payments").Where("id = ? AND status = ?", payment.ID.String(), types.INITIALIZED).
+		UpdateColumn("status", status)
+	if result.Error != nil {
+		p.logger.WithError(result.Error).WithField("payment_id", payment.ID.String()).Error("failed to update failed queued payment")
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+	payment.Status = status
+	if status == types.FAILED {
+		// returning the payment reverses its journal
+		p.returnToBalance(payment)
+	}
+}
+
+// returnToBalance puts a failed or reversed balance payment back into the
+// user's balance. Other payments are left for RefundPayment.
+func (p *paymentOps) returnToBalance(payment *types.Payment) {
+	if !payment.FromBalance || p.wallet == nil {
+		return
+	}
+	if err := p.wallet.ReturnPayment(payment); err != nil {
+		p.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("failed to return payment to balance")
+	}
+}
+
+func (p *paymentOps) PayoutBalanceStatus() (*types.PayoutBalanceStatus, error) {
+	if p.monitor == nil {
+		return nil, errors.New(http.StatusNotFound, "payout balance monitoring is disabled")
+	}
+	return p.monitor.Status(), nil
+}
@@ -0,0 +1,49 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"net/http"
+)
+
+// Action is something a user does that a Policy may forbid.
+type Action string
+
+const (
+	ActionPay                 Action = "pay"
+	ActionManageBeneficiaries Action = "manage_beneficiaries"
+	ActionWithdraw            Action = "withdraw"
+	ActionSchedulePayments    Action = "schedule_payments"
+)
+
+var ErrAccountNotActivated = errors.New(http.StatusForbidden, "please activate your account with the code sent to your email first")
+
+// Policy decides whether a user may perform an action.
+type Policy interface {
+	Authorize(user *types.User, action Action) error
+}
+
+type policy struct {
+	// requireActivation lists the actions unactivated users cannot take
+	requireActivation map[Action]bool
+}
+
+// NewPolicy returns the Policy under which only activated users can move
+// money or manage who it goes to.
+func NewPolicy() Policy {
+	return &policy{
+		requireActivation: map[Action]bool{
+			ActionPay:                 true,
+			ActionManageBeneficiaries: true,
+			ActionWithdraw:            true,
+			ActionSchedulePayments:    true,
+		},
+	}
+}
+
+func (p *policy) Authorize(user *types.User, action Action) error {
+	if p.requireActivation[action] && !user.Activated {
+		return ErrAccountNotActivated
+	}
+	return nil
+}
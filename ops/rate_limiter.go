@@ -0,0 +1,51 @@
+package ops
+
+import (
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"time"
+)
+
+// RateLimiter caps how often an endpoint is called by a user or an IP.
+// Counts are kept in the database so every instance sees them.
+type RateLimiter interface {
+	// Allow counts a request under key and returns an error once more than
+	// limit were made in the current window.
+	Allow(key string, limit int, window time.Duration) error
+}
+
+type rateLimiter struct {
+	db     *gorm.DB
+	logger *logrus.Logger
+}
+
+func NewRateLimiter(db *gorm.DB, logger *logrus.Logger) RateLimiter {
+	return &rateLimiter{db: db, logger: logger}
+}
+
+// countRequest counts a request, starting a new window once the current
+// one is over.
+const countRequest = `INSERT INTO rate_counters (key, window_start, count) VALUES (?, ?, 1)
+	ON CONFLICT (key) DO UPDATE SET
+		count = CASE WHEN rate_counters.window_start <= ? THEN 1 ELSE rate_counters.count + 1 END,
+		window_start = CASE WHEN rate_counters.window_start <= ? THEN EXCLUDED.window_start ELSE rate_counters.window_start END
+	RETURNING count, window_start`
+
+func (l *rateLimiter) Allow(key string, limit int, window time.Duration) error {
+	now := time.Now()
+	count, start := 0, time.Time{}
+	err := l.db.Raw(countRequest, key, now, now.Add(-window), now.Add(-window)).Row().Scan(&count, &start)
+	if err != nil {
+		// a broken counter should not take the endpoint down with it
+		l.logger.WithError(err).WithField("key", key).Error("failed to count request")
+		return nil
+	}
+	if count <= limit {
+		return nil
+	}
+	seconds := int((start.Add(window).Sub(now) + time.Second - 1) / time.Second)
+	return errors.New(http.StatusTooManyRequests, fmt.Sprintf("too many requests. please try again in %d seconds", seconds))
+}
@@ -0,0 +1,468 @@
+package ops
+
+import (
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/libs/bc"
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/libs/rails"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// payoutLag is how long after a payment its payout may still be created.
+// Paystack transfers are listed this far past the end of a period so late
+// payouts are not reported missing.
+const payoutLag = 24 * time.Hour
+
+// Reconciler compares Paystack transfers and on-chain transactions with
+// what we recorded for a period and reports every difference.
+type Reconciler struct {
+	db         *gorm.DB
+	bcClient   bc.Client
+	ps         paystackclient.Client
+	alertEmail string
+	logger     *logrus.Logger
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewReconciler(db *gorm.DB, bcClient bc.Client, ps paystackclient.Client, alertEmail string, logger *logrus.Logger) *Reconciler {
+	return &Reconciler{
+		db:         db,
+		bcClient:   bcClient,
+		ps:         ps,
+		alertEmail: alertEmail,
+		logger:     logger,
+		done:       make(chan struct{}),
+	}
+}
+
+// Run reconciles payments made and deposits received between from and to.
+// Only addresses that saw activity are checked on chain, and a failed check
+// is reported as an issue rather than failing the run.
+func (r *Reconciler) Run(from, to time.Time) (*types.ReconciliationReport, error) {
+	report := &types.ReconciliationReport{
+		From:   from,
+		To:     to,
+		Issues: make([]*types.ReconciliationIssue, 0),
+		Ts:     time.Now(),
+	}
+	if err := r.reconcilePayments(report); err != nil {
+		return nil, err
+	}
+	if err := r.reconcileDeposits(report); err != nil {
+		return nil, err
+	}
+	if err := r.reconcileWithdrawals(report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func (r *Reconciler) reconcilePayments(report *types.ReconciliationReport) error {
+	payments := make([]*types.Payment, 0)
+	if err := r.db.Table("payments").Where("ts >= ? AND ts < ?", report.From, report.To).
+		Order("ts asc").Find(&payments).Error; err != nil {
+		return err
+	}
+	report.Payments = len(payments)
+	listed, err := r.ps.ListTransfers(report.From, report.To.Add(payoutLag))
+	if err != nil {
+		return err
+	}
+	byReference := make(map[string][]*paystackclient.ListedTransfer)
+	for _, next := range listed {
+		byReference[next.Reference] = append(byReference[next.Reference], next)
+	}
+	active, err := r.activeAddresses(payments)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, payment := range payments {
+		seen[payment.ID.String()] = true
+		// an address that never received coin has nothing on chain to check
+		if !payment.FromBalance && (payment.CoinAmount > 0 || active[payment.AddressUsed]) {
+			r.reconcileCoin(report, payment)
+		}
+		if err := r.reconcilePayout(report, payment, byReference[payment.ID.String()]); err != nil {
+			return err
+		}
+	}
+
+	// transfers made in the period for payments outside it are matched
+	// against the payments table before being reported as orphans
+	unmatched := make([]string, 0)
+	for _, next := range listed {
+		if next.CreatedAt.Before(report.From) || !next.CreatedAt.Before(report.To) {
+			continue
+		}
+		report.ProviderTransfers++
+		if !seen[next.Reference] {
+			unmatched = append(unmatched, next.Reference)
+		}
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+	known := make([]string, 0)
+	if err := r.db.Table("payments").Where("CAST(id AS TEXT) IN (?)", unmatched).
+		Pluck("CAST(id AS TEXT)", &known).Error; err != nil {
+		return err
+	}
+	for _, id := range known {
+		seen[id] = true
+	}
+	for _, next := range listed {
+		if next.CreatedAt.Before(report.From) || !next.CreatedAt.Before(report.To) || seen[next.Reference] {
+			continue
+		}
+		report.Add(&types.ReconciliationIssue{
+			Kind:      types.IssueOrphanTransfer,
+			Reference: next.Reference,
+			Actual:    strconv.FormatInt(next.Amount, 10),
+			Detail:    fmt.Sprintf("paystack transfer %s (%s) matches no payment", next.TransferCode, next.Status),
+		})
+	}
+	return nil
+}
+
+// activeAddresses returns which of the addresses payments used have had a
+// transaction confirmed.
+func (r *Reconciler) activeAddresses(payments []*types.Payment) (map[string]bool, error) {
+	values := make([]string, 0, len(payments))
+	for _, next := range payments {
+		if next.AddressUsed != "" {
+			values = append(values, next.AddressUsed)
+		}
+	}
+	active := make(map[string]bool)
+	if len(values) == 0 {
+		return active, nil
+	}
+	found := make([]string, 0)
+	if err := r.db.Table("addresses").Where("address IN (?) AND active_at IS NOT NULL", values).
+		Pluck("address", &found).Error; err != nil {
+		return nil, err
+	}
+	for _, next := range found {
+		active[next] = true
+	}
+	return active, nil
+}
+
+// reconcileCoin checks that the coin received at a payment's address is
+// what was recorded for it.
+func (r *Reconciler) reconcileCoin(report *types.ReconciliationReport, payment *types.Payment) {
+	refs, err := r.bcClient.AddressTransactions(payment.AddressUsed)
+	if err != nil {
+		r.logger.WithError(err).WithField("address", payment.AddressUsed).Error("failed to list address transactions")
+		report.Add(checkFailed(payment.AddressUsed, err))
+		return
+	}
+	if issue := matchCoin(payment, refs); issue != nil {
+		report.Add(issue)
+	}
+}
+
+// matchCoin compares the coin received on chain at a payment's address with
+// what was recorded for it. CoinAmount is only set once coin is received.
+func matchCoin(payment *types.Payment, refs []bc.TxRef) *types.ReconciliationIssue {
+	received := receivedRefs(refs)
+	issue := &types.ReconciliationIssue{
+		PaymentId: payment.ID.String(),
+		Address:   payment.AddressUsed,
+		Expected:  strconv.FormatInt(payment.CoinAmount, 10),
+	}
+	switch {
+	case payment.CoinAmount == 0 && len(received) > 0:
+		issue.Kind = types.IssueUnrecordedDeposit
+		issue.TxHash = received[0].TxHash
+		issue.Actual = strconv.FormatInt(received[0].Value, 10)
+		issue.Detail = "coin was received for a payment we did not finalize"
+	case payment.CoinAmount > 0 && len(received) == 0:
+		issue.Kind = types.IssueMissingDeposit
+		issue.Detail = "payment was finalized but no coin was received on chain"
+	case len(received) > 1:
+		var total int64
+		for _, next := range received {
+			total += next.Value
+		}
+		issue.Kind = types.IssueMultipleDeposits
+		issue.Actual = strconv.FormatInt(total, 10)
+		issue.Detail = fmt.Sprintf("%d transactions were received for one payment", len(received))
+	case len(received) == 1 && received[0].Value != payment.CoinAmount:
+		issue.Kind = types.IssueAmountMismatch
+		issue.TxHash = received[0].TxHash
+		issue.Actual = strconv.FormatInt(received[0].Value, 10)
+		issue.Detail = "coin received differs from the amount recorded"
+	default:
+		return nil
+	}
+	return issue
+}
+
+// reconcilePayout checks a payment against the Paystack transfers
+// referencing it.
+func (r *Reconciler) reconcilePayout(report *types.ReconciliationReport, payment *types.Payment, transfers []*paystackclient.ListedTransfer) error {
+	local := &types.Transfer{}
+	err := r.db.Table("transfers").Where("payment_id = ?", payment.ID.String()).First(local).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return err
+	}
+	if issue := matchPayout(payment, local, transfers); issue != nil {
+		report.Add(issue)
+	}
+	return nil
+}
+
+// matchPayout compares a payment and the transfer we recorded for it with
+// the Paystack transfers referencing it. Flutterwave payouts are not
+// listed by Paystack, so they are not checked.
+func matchPayout(payment *types.Payment, local *types.Transfer, transfers []*paystackclient.ListedTransfer) *types.ReconciliationIssue {
+	if local.Provider == rails.Flutterwave {
+		return nil
+	}
+	issue := &types.ReconciliationIssue{
+		PaymentId: payment.ID.String(),
+		Reference: payment.ID.String(),
+		Expected:  strconv.FormatInt(payment.KoboAmount, 10),
+	}
+	switch {
+	case len(transfers) == 0:
+		if !expectsPayout(payment) {
+			return nil
+		}
+		issue.Kind = types.IssueMissingPayout
+		issue.Detail = fmt.Sprintf("payment is %s but paystack has no transfer for it", payment.Status)
+		if local.TransferCode != "" {
+			issue.Detail += ", although transfer " + local.TransferCode + " was recorded"
+		}
+	case len(transfers) > 1:
+		var total int64
+		for _, next := range transfers {
+			total += next.Amount
+		}
+		issue.Kind = types.IssueDuplicatePayout
+		issue.Actual = strconv.FormatInt(total, 10)
+		issue.Detail = fmt.Sprintf("paystack has %d transfers for one payment", len(transfers))
+	case transfers[0].Amount != payment.KoboAmount:
+		issue.Kind = types.IssueAmountMismatch
+		issue.Actual = strconv.FormatInt(transfers[0].Amount, 10)
+		issue.Detail = "paystack transfer amount differs from the amount recorded"
+	case transfers[0].Status == types.PayoutEventSuccess && payment.Status != types.DONE,
+		transfers[0].Status != types.PayoutEventSuccess && payment.Status == types.DONE:
+		issue.Kind = types.IssueStatusMismatch
+		issue.Expected = string(payment.Status)
+		issue.Actual = transfers[0].Status
+		issue.Detail = "paystack transfer status does not match the payment"
+	default:
+		return nil
+	}
+	return issue
+}
+
+// reconcileDeposits checks the coin received at deposit addresses in the
+// period against the deposits credited to balances. Only addresses active
+// since the period began, or credited during it, are checked.
+func (r *Reconciler) reconcileDeposits(report *types.ReconciliationReport) error {
+	addresses := make([]*types.Address, 0)
+	if err := r.db.Table("addresses").Where("deposit = ?", true).
+		Where("active_at >= ? OR address IN (SELECT address FROM deposits WHERE ts >= ? AND ts < ?)",
+			report.From, report.From, report.To).
+		Find(&addresses).Error; err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		refs, err := r.bcClient.AddressTransactions(address.Address)
+		if err != nil {
+			r.logger.WithError(err).WithField("address", address.Address).Error("failed to list address transactions")
+			report.Add(checkFailed(address.Address, err))
+			continue
+		}
+		deposits := make([]*types.Deposit, 0)
+		if err := r.db.Table("deposits").Where("address = ?", address.Address).Find(&deposits).Error; err != nil {
+			return err
+		}
+		issues, received := matchDeposits(address.Address, refs, deposits, report.From, report.To)
+		report.Deposits += received
+		for _, next := range issues {
+			report.Add(next)
+		}
+	}
+	return nil
+}
+
+// matchDeposits compares the coin a deposit address received on chain
+// between from and to with the deposits credited for it. It also returns
+// how many transactions were received in the period.
+func matchDeposits(address string, refs []bc.TxRef, deposits []*types.Deposit, from, to time.Time) ([]*types.ReconciliationIssue, int) {
+	issues := make([]*types.ReconciliationIssue, 0)
+	// an address can receive several outputs of one transaction
+	onChain := make(map[string]int64)
+	everOnChain := make(map[string]bool)
+	for _, next := range receivedRefs(refs) {
+		everOnChain[next.TxHash] = true
+		if next.Confirmed.Before(from) || !next.Confirmed.Before(to) {
+			continue
+		}
+		onChain[next.TxHash] += next.Value
+	}
+	recorded := make(map[string]int64)
+	for _, next := range deposits {
+		recorded[next.TxHash] = next.Amount
+		if next.Ts.Before(from) || !next.Ts.Before(to) {
+			continue
+		}
+		// the transaction may have confirmed outside the period
+		if !everOnChain[next.TxHash] {
+			issues = append(issues, &types.ReconciliationIssue{
+				Kind:     types.IssueMissingDeposit,
+				Address:  address,
+				TxHash:   next.TxHash,
+				Expected: strconv.FormatInt(next.Amount, 10),
+				Detail:   "deposit was credited but the transaction is not on chain",
+			})
+		}
+	}
+	for txHash, value := range onChain {
+		amount, ok := recorded[txHash]
+		switch {
+		case !ok:
+			issues = append(issues, &types.ReconciliationIssue{
+				Kind:    types.IssueUnrecordedDeposit,
+				Address: address,
+				TxHash:  txHash,
+				Actual:  strconv.FormatInt(value, 10),
+				Detail:  "coin was received at a deposit address but not credited",
+			})
+		case amount != value:
+			issues = append(issues, &types.ReconciliationIssue{
+				Kind:     types.IssueAmountMismatch,
+				Address:  address,
+				TxHash:   txHash,
+				Expected: strconv.FormatInt(amount, 10),
+				Actual:   strconv.FormatInt(value, 10),
+				Detail:   "deposit credited differs from the coin received",
+			})
+		}
+	}
+	return issues, len(onChain)
+}
+
+// reconcileWithdrawals reports withdrawals made in the period that are
+// still pending. Sending them failed in a way that does not tell whether
+// they were broadcast, so an operator has to check the chain before either
+// marking them sent or returning them to the balance.
+func (r *Reconciler) reconcileWithdrawals(report *types.ReconciliationReport) error {
+	withdrawals := make([]*types.Withdrawal, 0)
+	if err := r.db.Table("withdrawals").Where("status = ? AND ts >= ? AND ts < ?",
+		types.WithdrawalPending, report.From, report.To).Find(&withdrawals).Error; err != nil {
+		return err
+	}
+	for _, next := range withdrawals {
+		report.Add(&types.ReconciliationIssue{
+			Kind:      types.IssuePendingWithdrawal,
+			Reference: next.ID.String(),
+			Address:   next.Address,
+			Expected:  strconv.FormatInt(next.Amount-next.Fee, 10),
+			Detail:    "withdrawal may have been broadcast but was never marked as sent",
+		})
+	}
+	return nil
+}
+
+// Start reconciles the previous day every interval and alerts the operator
+// when anything does not match.
+func (r *Reconciler) Start(interval time.Duration) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				to := time.Now().UTC().Truncate(24 * time.Hour)
+				report, err := r.Run(to.Add(-24*time.Hour), to)
+				if err != nil {
+					r.logger.WithError(err).Error("failed to reconcile")
+					continue
+				}
+				if len(report.Issues) > 0 {
+					r.alert(report)
+				}
+			case <-r.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the daily job, waiting for a run in progress to finish.
+func (r *Reconciler) Stop() {
+	close(r.done)
+	r.wg.Wait()
+}
+
+func (r *Reconciler) alert(report *types.ReconciliationReport) {
+	r.logger.WithFields(logrus.Fields{
+		"from":   report.From,
+		"to":     report.To,
+		"issues": len(report.Issues),
+	}).Error("reconciliation found mismatches")
+	if r.alertEmail == "" {
+		return
+	}
+	if err := fn.SendEmail(&types.MailRequest{
+		User:  "CashTroops Operator",
+		Email: r.alertEmail,
+		Title: "Reconciliation mismatches - CashTroops",
+		Body: fmt.Sprintf("Reconciling %s found %d mismatches between our records, Paystack and the blockchain. "+
+			"Download the report from /api/admin/reconciliation?format=csv.",
+			report.From.Format("2006-01-02"), len(report.Issues)),
+	}); err != nil {
+		r.logger.WithError(err).Error("failed to send reconciliation alert")
+	}
+}
+
+// expectsPayout reports whether a payout should have been made for
+// payment. Queued payments are waiting for one, refunded payments never
+// had a successful one.
+func expectsPayout(payment *types.Payment) bool {
+	switch payment.Status {
+	case types.DONE, types.REVERSED:
+		return true
+	case types.INITIALIZED:
+		return payment.CoinAmount > 0 || payment.FromBalance
+	}
+	return false
+}
+
+// checkFailed is the issue for an address that could not be checked on
+// chain.
+func checkFailed(address string, err error) *types.ReconciliationIssue {
+	return &types.ReconciliationIssue{
+		Kind:    types.IssueCheckFailed,
+		Address: address,
+		Detail:  "could not list the address's transactions: " + err.Error(),
+	}
+}
+
+// receivedRefs returns the transaction outputs paying into an address.
+func receivedRefs(refs []bc.TxRef) []bc.TxRef {
+	values := make([]bc.TxRef, 0, len(refs))
+	for _, next := range refs {
+		if next.TxOutputN >= 0 {
+			values = append(values, next)
+		}
+	}
+	return values
+}
@@ -0,0 +1,99 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/libs/bc"
+	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/libs/rails"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestMatchCoin(t *testing.T) {
+	payment := &types.Payment{ID: uuid.New(), AddressUsed: "addr", CoinAmount: 5000}
+	received := bc.TxRef{TxHash: "a", TxOutputN: 0, Value: 5000}
+	spent := bc.TxRef{TxHash: "b", TxInputN: 0, TxOutputN: -1, Value: 5000}
+
+	assert.Nil(t, matchCoin(payment, []bc.TxRef{received, spent}))
+
+	issue := matchCoin(payment, []bc.TxRef{spent})
+	assert.Equal(t, types.IssueMissingDeposit, issue.Kind)
+
+	issue = matchCoin(payment, []bc.TxRef{{TxHash: "a", Value: 4000}})
+	assert.Equal(t, types.IssueAmountMismatch, issue.Kind)
+	assert.Equal(t, "4000", issue.Actual)
+
+	issue = matchCoin(payment, []bc.TxRef{received, {TxHash: "c", Value: 100}})
+	assert.Equal(t, types.IssueMultipleDeposits, issue.Kind)
+	assert.Equal(t, "5100", issue.Actual)
+
+	unfinalized := &types.Payment{ID: uuid.New(), AddressUsed: "addr"}
+	assert.Nil(t, matchCoin(unfinalized, nil))
+	issue = matchCoin(unfinalized, []bc.TxRef{received})
+	assert.Equal(t, types.IssueUnrecordedDeposit, issue.Kind)
+	assert.Equal(t, "a", issue.TxHash)
+}
+
+func TestMatchPayout(t *testing.T) {
+	payment := &types.Payment{ID: uuid.New(), KoboAmount: 500000, Status: types.DONE}
+	paid := &paystackclient.ListedTransfer{Reference: payment.ID.String(), Amount: 500000, Status: types.PayoutEventSuccess}
+
+	assert.Nil(t, matchPayout(payment, &types.Transfer{}, []*paystackclient.ListedTransfer{paid}))
+
+	issue := matchPayout(payment, &types.Transfer{TransferCode: "TRF_1"}, nil)
+	assert.Equal(t, types.IssueMissingPayout, issue.Kind)
+	assert.Contains(t, issue.Detail, "TRF_1")
+	// flutterwave payouts are not listed by paystack
+	assert.Nil(t, matchPayout(payment, &types.Transfer{Provider: rails.Flutterwave}, nil))
+	// nothing is paid out before coin is received
+	assert.Nil(t, matchPayout(&types.Payment{ID: uuid.New(), Status: types.INITIALIZED}, &types.Transfer{}, nil))
+
+	issue = matchPayout(payment, &types.Transfer{}, []*paystackclient.ListedTransfer{paid, paid})
+	assert.Equal(t, types.IssueDuplicatePayout, issue.Kind)
+	assert.Equal(t, "1000000", issue.Actual)
+
+	short := &paystackclient.ListedTransfer{Reference: paid.Reference, Amount: 400000, Status: types.PayoutEventSuccess}
+	issue = matchPayout(payment, &types.Transfer{}, []*paystackclient.ListedTransfer{short})
+	assert.Equal(t, types.IssueAmountMismatch, issue.Kind)
+
+	failed := &paystackclient.ListedTransfer{Reference: paid.Reference, Amount: 500000, Status: "failed"}
+	issue = matchPayout(payment, &types.Transfer{}, []*paystackclient.ListedTransfer{failed})
+	assert.Equal(t, types.IssueStatusMismatch, issue.Kind)
+	assert.Equal(t, string(types.DONE), issue.Expected)
+}
+
+func TestMatchDeposits(t *testing.T) {
+	from := time.Date(2020, 6, 30, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	during, before := from.Add(time.Hour), from.Add(-time.Hour)
+	refs := []bc.TxRef{
+		// two outputs of one transaction
+		{TxHash: "a", TxOutputN: 0, Value: 300, Confirmed: during},
+		{TxHash: "a", TxOutputN: 1, Value: 200, Confirmed: during},
+		{TxHash: "b", TxOutputN: 0, Value: 700, Confirmed: during},
+		{TxHash: "c", TxOutputN: 0, Value: 900, Confirmed: during},
+		{TxHash: "d", TxOutputN: 0, Value: 100, Confirmed: before},
+		{TxHash: "e", TxOutputN: -1, TxInputN: 0, Value: 1000, Confirmed: during},
+	}
+	deposits := []*types.Deposit{
+		{TxHash: "a", Amount: 500, Ts: during},
+		{TxHash: "b", Amount: 600, Ts: during},
+		// confirmed before the period but credited in it
+		{TxHash: "d", Amount: 100, Ts: during},
+		{TxHash: "f", Amount: 800, Ts: during},
+	}
+
+	issues, received := matchDeposits("addr", refs, deposits, from, to)
+	assert.Equal(t, 3, received)
+	byHash := make(map[string]*types.ReconciliationIssue)
+	for _, next := range issues {
+		assert.Equal(t, "addr", next.Address)
+		byHash[next.TxHash] = next
+	}
+	assert.Len(t, byHash, 3)
+	assert.Equal(t, types.IssueAmountMismatch, byHash["b"].Kind)
+	assert.Equal(t, types.IssueUnrecordedDeposit, byHash["c"].Kind)
+	assert.Equal(t, types.IssueMissingDeposit, byHash["f"].Kind)
+}
@@ -0,0 +1,293 @@
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ScheduleOps interface {
+	CreateSchedule(userId string, opts *types.CreateScheduleOpts) (*types.Schedule, error)
+	ListSchedules(userId string) ([]*types.Schedule, error)
+	PauseSchedule(userId, id string) (*types.Schedule, error)
+	ResumeSchedule(userId, id string) (*types.Schedule, error)
+	CancelSchedule(userId, id string) (*types.Schedule, error)
+	RunDueSchedules()
+}
+
+type scheduleOps struct {
+	db         *gorm.DB
+	userOps    UserOps
+	accountOps AccountOps
+	paymentOps PaymentOps
+	logger     *logrus.Logger
+}
+
+func NewScheduleOps(db *gorm.DB, userOps UserOps, accountOps AccountOps, paymentOps PaymentOps, logger *logrus.Logger) ScheduleOps {
+	return &scheduleOps{
+		db:         db,
+		userOps:    userOps,
+		accountOps: accountOps,
+		paymentOps: paymentOps,
+		logger:     logger,
+	}
+}
+
+func (s *scheduleOps) CreateSchedule(userId string, opts *types.CreateScheduleOpts) (*types.Schedule, error) {
+	beneficiary, err := s.accountOps.GetBeneficiaryByAttr("id", opts.BeneficiaryId)
+	if err != nil || beneficiary.Owner != userId || beneficiary.Removed {
+		return nil, errors.New(http.StatusNotFound, "beneficiary not found")
+	}
+	amount := opts.AmountMinor()
+	if amount <= 0 {
+		return nil, errors.New(http.StatusBadRequest, "The amount seems to be invalid")
+	}
+	if opts.Coin == "" {
+		return nil, errors.New(http.StatusBadRequest, "coin is required")
+	}
+	cadence := strings.ToLower(strings.TrimSpace(opts.Cadence))
+	if !types.ValidCadence(cadence) {
+		return nil, errors.New(http.StatusBadRequest, "cadence must be one of weekly, biweekly or monthly")
+	}
+	now := time.Now()
+	startAt := now
+	if opts.StartAt != nil {
+		startAt = *opts.StartAt
+	}
+	if startAt.Before(now.Add(-time.Minute)) {
+		return nil, errors.New(http.StatusBadRequest, "start date cannot be in the past")
+	}
+	schedule := &types.Schedule{
+		UserId:        userId,
+		BeneficiaryId: beneficiary.ID.String(),
+		Amount:        amount,
+		Currency:      beneficiary.PayoutCorridor().Currency,
+		Coin:          opts.Coin,
+		Cadence:       cadence,
+		Status:        types.ScheduleActive,
+		StartAt:       startAt,
+		NextRunAt:     startAt,
+		Ts:            now,
+	}
+	if err := s.db.Table("schedules").Create(schedule).Error; err != nil {
+		s.logger.WithError(err).Error("failed to create schedule")
+		return nil, errors.New(http.StatusInternalServerError, "failed to create schedule at this time. please retry later.")
+	}
+	return schedule, nil
+}
+
+func (s *scheduleOps) ListSchedules(userId string) ([]*types.Schedule, error) {
+	data := make([]*types.Schedule, 0)
+	err := s.db.Table("schedules").Where("user_id = ? AND status <> ?", userId, types.ScheduleCancelled).
+		Order("next_run_at asc").Find(&data).Error
+	return data, err
+}
+
+func (s *scheduleOps) PauseSchedule(userId, id string) (*types.Schedule, error) {
+	schedule, err := s.ownSchedule(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	if schedule.Status != types.ScheduleActive {
+		return nil, errors.New(http.StatusConflict, "only active schedules can be paused")
+	}
+	return s.setStatus(schedule, types.SchedulePaused, schedule.NextRunAt)
+}
+
+// ResumeSchedule reactivates a paused schedule from its next due date after
+// now, so runs missed while it was paused are skipped.
+func (s *scheduleOps) ResumeSchedule(userId, id string) (*types.Schedule, error) {
+	schedule, err := s.ownSchedule(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	if schedule.Status != types.SchedulePaused {
+		return nil, errors.New(http.StatusConflict, "only paused schedules can be resumed")
+	}
+	beneficiary, err := s.accountOps.GetBeneficiaryByAttr("id", schedule.BeneficiaryId)
+	if err != nil || beneficiary.Removed {
+		return nil, errors.New(http.StatusBadRequest, "the schedule's beneficiary has been removed")
+	}
+	runs, next := nextRun(schedule, time.Now())
+	schedule.Runs = runs
+	return s.setStatus(schedule, types.ScheduleActive, next)
+}
+
+func (s *scheduleOps) CancelSchedule(userId, id string) (*types.Schedule, error) {
+	schedule, err := s.ownSchedule(userId, id)
+	if err != nil {
+		return nil, err
+	}
+	if schedule.Status == types.ScheduleCancelled {
+		return nil, errors.New(http.StatusConflict, "schedule has already been cancelled")
+	}
+	return s.setStatus(schedule, types.ScheduleCancelled, schedule.NextRunAt)
+}
+
+// RunDueSchedules starts a payment for every active schedule that is due.
+func (s *scheduleOps) RunDueSchedules() {
+	now := time.Now()
+	due := make([]*types.Schedule, 0)
+	if err := s.db.Table("schedules").Where("status = ? AND next_run_at <= ?", types.ScheduleActive, now).
+		Find(&due).Error; err != nil {
+		s.logger.WithError(err).Error("failed to load due schedules")
+		return
+	}
+	for _, next := range due {
+		s.run(next, now)
+	}
+}
+
+func (s *scheduleOps) run(schedule *types.Schedule, now time.Time) {
+	logger := s.logger.WithField("schedule_id", schedule.ID.String())
+	// claim the run by moving the schedule to its next due date. Runs missed
+	// while the scheduler was not running are skipped rather than started
+	// all at once.
+	runs, next := nextRun(schedule, now)
+	result := s.db.Table("schedules").
+		Where("id = ? AND next_run_at = ? AND status = ?", schedule.ID.String(), schedule.NextRunAt, types.ScheduleActive).
+		Updates(map[string]interface{}{"next_run_at": next, "runs": runs, "last_run_at": now})
+	if result.Error != nil {
+		logger.WithError(result.Error).Error("failed to claim schedule run")
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+	schedule.NextRunAt, schedule.Runs, schedule.LastRunAt = next, runs, &now
+
+	quote, resp, err := s.startPayment(schedule)
+	if err != nil {
+		logger.WithError(err).Error("failed to start scheduled payment")
+		updates := map[string]interface{}{"last_error": err.Error()}
+		// errors caused by the schedule itself, such as a removed
+		// beneficiary, will not go away on the next run
+		if e, ok := err.(*errors.Error); ok && e.Code < http.StatusInternalServerError {
+			updates["status"] = types.SchedulePaused
+		}
+		s.db.Table("schedules").Where("id = ?", schedule.ID.String()).Updates(updates)
+		return
+	}
+	if err := s.db.Table("schedules").Where("id = ?", schedule.ID.String()).
+		Updates(map[string]interface{}{"last_payment_id": resp.PaymentId, "last_error": ""}).Error; err != nil {
+		logger.WithError(err).Error("failed to update schedule")
+	}
+	s.notify(schedule, quote, resp)
+}
+
+func (s *scheduleOps) startPayment(schedule *types.Schedule) (*types.Quote, *types.InitPaymentResponse, error) {
+	quote, err := s.paymentOps.Quote(schedule.Coin, schedule.Currency, schedule.Amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := s.paymentOps.InitializePayment(schedule.UserId, &types.InitPaymentRequest{
+		BeneficiaryId: schedule.BeneficiaryId,
+		Amount:        json.Number(strconv.FormatInt(int64(math.Ceil(quote.UsdAmount)), 10)),
+		Coin:          schedule.Coin,
+		ScheduleId:    schedule.ID.String(),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return quote, resp, nil
+}
+
+func (s *scheduleOps) notify(schedule *types.Schedule, quote *types.Quote, resp *types.InitPaymentResponse) {
+	account, err := s.userOps.GetUserByAttr("id", schedule.UserId)
+	if err != nil {
+		return
+	}
+	beneficiary, err := s.accountOps.GetBeneficiaryByAttr("id", schedule.BeneficiaryId)
+	if err != nil {
+		return
+	}
+	go func(account *types.User, beneficiary *types.Beneficiary) {
+		value, err := fn.GenerateScheduledPaymentEmail(account.Name(), beneficiary, schedule, quote, resp.AddressUsed)
+		if err != nil {
+			return
+		}
+		if err := fn.SendEmail(&types.MailRequest{
+			User:  account.Name(),
+			Email: account.Email,
+			Title: fmt.Sprintf("Your scheduled payment to %s is due - CashTroops", beneficiary.AccountName),
+			Body:  value,
+		}); err != nil {
+			s.logger.WithError(err).Error("failed to send email")
+		}
+	}(account, beneficiary)
+}
+
+func (s *scheduleOps) ownSchedule(userId, id string) (*types.Schedule, error) {
+	schedule := &types.Schedule{}
+	err := s.db.Table("schedules").Where("id = ?", id).First(schedule).Error
+	if err != nil || schedule.UserId != userId {
+		return nil, errors.New(http.StatusNotFound, "schedule not found")
+	}
+	return schedule, nil
+}
+
+func (s *scheduleOps) setStatus(schedule *types.Schedule, status types.ScheduleStatus, nextRunAt time.Time) (*types.Schedule, error) {
+	if err := s.db.Table("schedules").Where("id = ?", schedule.ID.String()).
+		Updates(map[string]interface{}{"status": status, "next_run_at": nextRunAt, "runs": schedule.Runs}).Error; err != nil {
+		s.logger.WithError(err).Error("failed to update schedule")
+		return nil, err
+	}
+	schedule.Status, schedule.NextRunAt = status, nextRunAt
+	return schedule, nil
+}
+
+// nextRun returns the first due date after now and how many due dates come
+// before it.
+func nextRun(schedule *types.Schedule, now time.Time) (int, time.Time) {
+	runs := schedule.Runs
+	next := schedule.RunAt(runs)
+	for !next.After(now) {
+		runs++
+		next = schedule.RunAt(runs)
+	}
+	return runs, next
+}
+
+// Scheduler runs due schedules on an interval until Stop is called.
+type Scheduler struct {
+	schedules ScheduleOps
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+func NewScheduler(schedules ScheduleOps) *Scheduler {
+	return &Scheduler{schedules: schedules, done: make(chan struct{})}
+}
+
+func (s *Scheduler) Start(interval time.Duration) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.schedules.RunDueSchedules()
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the scheduler, waiting for a run in progress to finish.
+func (s *Scheduler) Stop() {
+	close(s.done)
+	s.wg.Wait()
+}
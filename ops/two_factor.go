@@ -0,0 +1,202 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
+	"github.com/adigunhammedolalekan/cashtroops/totp"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer       = "CashTroops"
+	backupCodeCount  = 10
+	backupCodeLength = 10
+	// backup codes avoid letters and digits that are easily confused
+	backupCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+var (
+	ErrTwoFactorRequired    = errors.New(http.StatusForbidden, "two factor code required")
+	ErrInvalidTwoFactorCode = errors.New(http.StatusForbidden, "invalid two factor code")
+)
+
+// SetupTwoFactor generates a new TOTP secret for userId. It is only used
+// once ConfirmTwoFactor has seen a code of it.
+func (u *userOps) SetupTwoFactor(userId string) (*types.TwoFactorSetup, error) {
+	user, err := u.GetUserByAttr("id", userId)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "user not found")
+	}
+	if user.TwoFactorEnabled {
+		return nil, errors.New(http.StatusConflict, "two factor authentication is already enabled")
+	}
+	secret := totp.GenerateSecret()
+	if err := u.db.Table("users").Where("id = ?", user.ID).UpdateColumn("totp_secret", secret).Error; err != nil {
+		u.logger.WithError(err).Error("failed to save totp secret")
+		return nil, errors.New(http.StatusInternalServerError, "failed to set up two factor authentication at this time. please retry")
+	}
+	u.users.invalidate(userId)
+	return &types.TwoFactorSetup{Secret: secret, Uri: totp.URI(totpIssuer, user.Email, secret)}, nil
+}
+
+// ConfirmTwoFactor enables two factor authentication for userId once code
+// shows their authenticator was set up, and returns their backup codes.
+// The codes cannot be shown again.
+func (u *userOps) ConfirmTwoFactor(userId, code string) ([]string, error) {
+	user, err := u.GetUserByAttr("id", userId)
+	if err != nil {
+		return nil, errors.New(http.StatusNotFound, "user not found")
+	}
+	if user.TwoFactorEnabled {
+		return nil, errors.New(http.StatusConflict, "two factor authentication is already enabled")
+	}
+	if user.TotpSecret == "" {
+		return nil, errors.New(http.StatusBadRequest, "please set up two factor authentication first")
+	}
+	step, ok := totp.Validate(user.TotpSecret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes := make([]string, 0, backupCodeCount)
+	tx := u.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table("backup_codes").Where("user_id = ?", userId).Delete(&types.BackupCode{}).Error; err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to delete backup codes")
+		return nil, errors.New(http.StatusInternalServerError, "failed to enable two factor authentication at this time. please retry")
+	}
+	for i := 0; i < backupCodeCount; i++ {
+		value := secure.String(backupCodeLength, backupCodeAlphabet)
+		backup := &types.BackupCode{UserId: userId, CodeHash: secure.Hash(value), Ts: time.Now()}
+		if err := tx.Table("backup_codes").Create(backup).Error; err != nil {
+			tx.Rollback()
+			u.logger.WithError(err).Error("failed to create backup code")
+			return nil, errors.New(http.StatusInternalServerError, "failed to enable two factor authentication at this time. please retry")
+		}
+		codes = append(codes, value)
+	}
+	err = tx.Table("users").Where("id = ?", user.ID).UpdateColumns(map[string]interface{}{
+		"two_factor_enabled": true,
+		"totp_last_step":     step,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to enable two factor authentication")
+		return nil, errors.New(http.StatusInternalServerError, "failed to enable two factor authentication at this time. please retry")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, errors.New(http.StatusInternalServerError, "failed to enable two factor authentication at this time. please retry")
+	}
+	u.users.invalidate(userId)
+	return codes, nil
+}
+
+// DisableTwoFactor turns two factor authentication off for userId, who
+// has to prove both factors.
+func (u *userOps) DisableTwoFactor(userId, password, code string) error {
+	user, err := u.GetUserByAttr("id", userId)
+	if err != nil {
+		return errors.New(http.StatusNotFound, "user not found")
+	}
+	if !user.TwoFactorEnabled {
+		return errors.New(http.StatusBadRequest, "two factor authentication is not enabled")
+	}
+	if ok := fn.VerifyHashPassword(user.Password, password); !ok {
+		return errors.New(http.StatusForbidden, "password does not match our record")
+	}
+	if err := u.verifySecondFactor(user, code); err != nil {
+		return err
+	}
+
+	tx := u.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if err := tx.Table("backup_codes").Where("user_id = ?", userId).Delete(&types.BackupCode{}).Error; err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to delete backup codes")
+		return errors.New(http.StatusInternalServerError, "failed to disable two factor authentication at this time. please retry")
+	}
+	err = tx.Table("users").Where("id = ?", user.ID).UpdateColumns(map[string]interface{}{
+		"two_factor_enabled": false,
+		"totp_secret":        "",
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to disable two factor authentication")
+		return errors.New(http.StatusInternalServerError, "failed to disable two factor authentication at this time. please retry")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.New(http.StatusInternalServerError, "failed to disable two factor authentication at this time. please retry")
+	}
+	u.users.invalidate(userId)
+	return nil
+}
+
+// VerifyStepUp checks code before a sensitive operation of userId. Users
+// without two factor authentication have nothing to step up with. Wrong
+// codes are counted against the account like wrong passwords.
+func (u *userOps) VerifyStepUp(userId, code string) error {
+	user, err := u.GetUserByAttr("id", userId)
+	if err != nil {
+		return errors.New(http.StatusNotFound, "user not found")
+	}
+	if !user.TwoFactorEnabled {
+		return nil
+	}
+	attempts := u.attempts(types.AttemptStepUp, user.Email, "")
+	if err := u.limiter.Check(attempts...); err != nil {
+		return err
+	}
+	if err := u.verifySecondFactor(user, code); err != nil {
+		if err == ErrInvalidTwoFactorCode {
+			u.failed(attempts)
+		}
+		return err
+	}
+	u.succeeded(attempts)
+	return nil
+}
+
+// verifySecondFactor accepts a TOTP code newer than the last one used, or
+// an unused backup code, which is then used up.
+func (u *userOps) verifySecondFactor(user *types.User, code string) error {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), " ", "", -1))
+	if code == "" {
+		return ErrTwoFactorRequired
+	}
+	if len(code) == totp.Digits {
+		step, ok := totp.Validate(user.TotpSecret, code, time.Now())
+		if !ok {
+			return ErrInvalidTwoFactorCode
+		}
+		// only one request can move the last step past a code's
+		result := u.db.Table("users").Where("id = ? AND totp_last_step < ?", user.ID, step).
+			UpdateColumn("totp_last_step", step)
+		if result.Error != nil {
+			u.logger.WithError(result.Error).Error("failed to record totp step")
+			return errors.New(http.StatusInternalServerError, "failed to verify code at this time. please retry")
+		}
+		if result.RowsAffected != 1 {
+			return ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+	result := u.db.Table("backup_codes").Where("user_id = ? AND code_hash = ? AND used = ?", user.ID.String(), secure.Hash(code), false).
+		UpdateColumn("used", true)
+	if result.Error != nil {
+		u.logger.WithError(result.Error).Error("failed to use backup code")
+		return errors.New(http.StatusInternalServerError, "failed to verify code at this time. please retry")
+	}
+	if result.RowsAffected != 1 {
+		return ErrInvalidTwoFactorCode
+	}
+	return nil
+}
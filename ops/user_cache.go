@@ -0,0 +1,70 @@
+package ops
+
+import (
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"sync"
+	"time"
+)
+
+// userCacheTtl bounds how long a user changed outside userOps, e.g directly
+// in the database, can be served stale.
+const userCacheTtl = 30 * time.Second
+
+type cachedUser struct {
+	user    types.User
+	expires time.Time
+}
+
+// userCache keeps recently resolved users so authenticating a request does
+// not always hit the database. userOps invalidates a user whenever it
+// changes their record.
+type userCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	users     map[string]*cachedUser
+	lastSweep time.Time
+}
+
+func newUserCache(ttl time.Duration) *userCache {
+	return &userCache{ttl: ttl, users: make(map[string]*cachedUser)}
+}
+
+// get returns a copy of the cached user, so callers cannot change the cache.
+func (c *userCache) get(id string) (*types.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.users[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(cached.expires) {
+		delete(c.users, id)
+		return nil, false
+	}
+	user := cached.user
+	return &user, true
+}
+
+func (c *userCache) set(user *types.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// expired entries are swept at most once per ttl rather than by a
+	// background loop
+	now := time.Now()
+	if now.Sub(c.lastSweep) > c.ttl {
+		for id, cached := range c.users {
+			if now.After(cached.expires) {
+				delete(c.users, id)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.users[user.ID.String()] = &cachedUser{user: *user, expires: now.Add(c.ttl)}
+}
+
+func (c *userCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.users, id)
+}
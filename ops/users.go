@@ -1,49 +1,104 @@
 package ops
 
 import (
+	"crypto/subtle"
 	"github.com/adigunhammedolalekan/cashtroops/errors"
 	"github.com/adigunhammedolalekan/cashtroops/fn"
+	"github.com/adigunhammedolalekan/cashtroops/jwt"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
 	"github.com/adigunhammedolalekan/cashtroops/session"
 	"github.com/adigunhammedolalekan/cashtroops/types"
 	"github.com/jinzhu/gorm"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"time"
 )
 
 const (
 	passwordResetTokenTable = "password_reset_tokens"
+	// activationCodeTtl is how long an activation code can be used
+	activationCodeTtl = 24 * time.Hour
+	// activation codes can be sent once every activationResendInterval and
+	// at most maxActivationCodes times a day
+	activationResendInterval = time.Minute
+	maxActivationCodes       = 5
+	// passwordResetTtl is how long a password reset code can be verified
+	// and then used to reset the password
+	passwordResetTtl = 15 * time.Minute
+	// maxPasswordResetAttempts wrong codes revoke a password reset token
+	maxPasswordResetAttempts = 5
+)
+
+// ErrAccessTokenExpired tells clients to use their refresh token.
+var ErrAccessTokenExpired = errors.New(http.StatusUnauthorized, "access token has expired. please refresh it")
+
+var (
+	ErrInvalidActivationCode = errors.New(http.StatusBadRequest, "invalid activation code")
+	ErrActivationCodeExpired = errors.New(http.StatusBadRequest, "activation code has expired. please request a new one")
+	ErrInvalidPasswordReset  = errors.New(http.StatusUnauthorized, "password reset code is invalid or has expired")
 )
 
 type UserOps interface {
-	CreateUser(user *types.CreateUserOpts) (*types.User, error)
-	AuthenticateUser(email, password string) (*types.User, error)
+	CreateUser(user *types.CreateUserOpts, device *types.Device) (*types.User, error)
+	// AuthenticateUser signs a user in. Users with two factor
+	// authentication also need code, or ErrTwoFactorRequired is returned.
+	AuthenticateUser(email, password, code string, device *types.Device) (*types.User, error)
 	GetUserByEmail(email string) (*types.User, error)
-	ActivateAccount(code, email string) error
-	GetSession(key string) (*types.User, error)
+	ActivateAccount(code, email, ip string) error
+	// ResendActivation sends a new activation code to email.
+	ResendActivation(email string) error
+	// GetSession returns the user an access token was issued to.
+	GetSession(accessToken string) (*types.User, error)
+	VerifyAccessToken(accessToken string) (*jwt.Claims, error)
+	RefreshToken(refreshToken string) (*types.AuthTokens, error)
+	Logout(userId, sessionId string) error
+	ListSessions(userId, currentSessionId string) ([]*types.Session, error)
+	RevokeSession(userId, sessionId string) error
 	RequestPasswordReset(email string) error
-	VerifyPasswordResetRequest(code, email string) (*types.PasswordResetToken, error)
+	VerifyPasswordResetRequest(code, email, ip string) (*types.PasswordResetToken, error)
 	ResetPassword(tokenId, newPassword string) error
 	GetPasswordResetToken(code, email string) (*types.PasswordResetToken, error)
 	GetPasswordResetTokenById(id string) (*types.PasswordResetToken, error)
-	ChangePassword(userId, oldPassword, newPassword string) error
+	ChangePassword(userId, oldPassword, newPassword, currentSessionId string) error
 	GetUserByAttr(attr string, value interface{}) (*types.User, error)
+	SetupTwoFactor(userId string) (*types.TwoFactorSetup, error)
+	ConfirmTwoFactor(userId, code string) ([]string, error)
+	DisableTwoFactor(userId, password, code string) error
+	VerifyStepUp(userId, code string) error
+	// UnlockAccount lifts a lockout of email with the code sent when it
+	// was locked.
+	UnlockAccount(email, code string) error
 }
 
 type userOps struct {
 	db      *gorm.DB
 	session session.Store
-	logger  *logrus.Logger
+	users   *userCache
+	// access tokens are verified with signer, and checked against the
+	// sessions revoked within the last accessTtl kept in denied
+	signer    *jwt.Signer
+	accessTtl time.Duration
+	denied    *denyList
+	limiter   AttemptLimiter
+	logger    *logrus.Logger
 }
 
-func NewUserOps(db *gorm.DB, sess session.Store, logger *logrus.Logger) UserOps {
+func NewUserOps(db *gorm.DB, sess session.Store, signer *jwt.Signer, accessTtl time.Duration, limiter AttemptLimiter, logger *logrus.Logger) UserOps {
+	denied := newDenyList(sess, logger)
+	denied.start(denySyncInterval)
 	return &userOps{
-		db:      db,
-		session: sess,
-		logger:  logger,
+		db:        db,
+		session:   sess,
+		users:     newUserCache(userCacheTtl),
+		signer:    signer,
+		accessTtl: accessTtl,
+		denied:    denied,
+		limiter:   limiter,
+		logger:    logger,
 	}
 }
 
-func (u *userOps) CreateUser(user *types.CreateUserOpts) (*types.User, error) {
+func (u *userOps) CreateUser(user *types.CreateUserOpts, device *types.Device) (*types.User, error) {
 	if err := fn.ValidateEmail(user.Email); err != nil {
 		return nil, errors.New(http.StatusBadRequest, err.Error())
 	}
@@ -60,8 +115,6 @@ func (u *userOps) CreateUser(user *types.CreateUserOpts) (*types.User, error) {
 	}
 	user.Password = fn.HashPassword(user.Password)
 	newUser := types.NewUser(user)
-	token := types.NewToken(fn.GenerateRandomString(64), newUser)
-	newUser.Token = token.Key
 
 	tx := u.db.Begin()
 	if err := tx.Error; err != nil {
@@ -72,11 +125,12 @@ func (u *userOps) CreateUser(user *types.CreateUserOpts) (*types.User, error) {
 		u.logger.WithError(err).Error("failed to create user in the database")
 		return nil, errors.New(http.StatusInternalServerError, "failed to create account at this time. please retry later")
 	}
-	if err := u.session.Create(token); err != nil {
+	if err := u.startSession(newUser, device); err != nil {
+		tx.Rollback()
 		u.logger.WithError(err).Error("failed to create auth token for new user")
 		return nil, errors.New(http.StatusInternalServerError, "failed to create account at this time. please retry later")
 	}
-	verification := types.NewVerification(user.Email, fn.GenRandomCode())
+	verification := types.NewVerification(user.Email, fn.GenRandomCode(), activationCodeTtl)
 	if err := tx.Table("verifications").Create(verification).Error; err != nil {
 		tx.Rollback()
 		u.logger.WithError(err).Error("failed to create verification")
@@ -104,7 +158,7 @@ func (u *userOps) CreateUser(user *types.CreateUserOpts) (*types.User, error) {
 	return newUser, nil
 }
 
-func (u *userOps) AuthenticateUser(email, password string) (*types.User, error) {
+func (u *userOps) AuthenticateUser(email, password, code string, device *types.Device) (*types.User, error) {
 	if err := fn.ValidateEmail(email); err != nil {
 		return nil, errors.New(http.StatusBadRequest, err.Error())
 	}
@@ -112,50 +166,361 @@ func (u *userOps) AuthenticateUser(email, password string) (*types.User, error)
 	if err := fn.ValidatePassword(password); err != nil {
 		return nil, errors.New(http.StatusBadRequest, err.Error())
 	}
+	ip := ""
+	if device != nil {
+		ip = device.IP
+	}
+	attempts := u.attempts(types.AttemptLogin, email, ip)
+	if err := u.limiter.Check(attempts...); err != nil {
+		return nil, err
+	}
 	user, err := u.GetUserByEmail(email)
 	if err != nil {
 		u.logger.WithField("email", email).WithError(err).Error("user not found")
+		u.failed(attempts)
 		return nil, errors.New(http.StatusForbidden, "email and password combination does not match")
 	}
 	if ok := fn.VerifyHashPassword(user.Password, password); !ok {
+		u.failed(attempts)
 		return nil, errors.New(http.StatusForbidden, "email and password combination does not match")
 	}
-	token := types.NewToken(fn.GenerateRandomString(64), user)
-	user.Token = token.Key
-	if err := u.session.Create(token); err != nil {
-		u.logger.WithError(err).Error("failed to create auth token for new user")
-		return nil, errors.New(http.StatusInternalServerError, "failed to create account at this time. please retry later")
+	if user.TwoFactorEnabled {
+		if err := u.verifySecondFactor(user, code); err != nil {
+			if err == ErrInvalidTwoFactorCode {
+				u.failed(attempts)
+			}
+			return nil, err
+		}
+	}
+	u.succeeded(attempts)
+	if err := u.startSession(user, device); err != nil {
+		u.logger.WithError(err).Error("failed to create auth token for user")
+		return nil, errors.New(http.StatusInternalServerError, "failed to sign in at this time. please retry later")
 	}
 	return user, nil
 }
 
+// startSession stores a new session for user, keyed by its refresh token,
+// and sets the user's tokens.
+func (u *userOps) startSession(user *types.User, device *types.Device) error {
+	token := types.NewToken(secure.Token(), user.ID.String(), device)
+	if err := u.session.Create(token); err != nil {
+		return err
+	}
+	tokens, err := u.issue(token)
+	if err != nil {
+		return err
+	}
+	user.Token = tokens.AccessToken
+	user.RefreshToken = tokens.RefreshToken
+	user.ExpiresIn = tokens.ExpiresIn
+	return nil
+}
+
+// issue signs an access token for the session token is the refresh token
+// of.
+func (u *userOps) issue(token *types.Token) (*types.AuthTokens, error) {
+	accessToken, err := u.signer.Sign(token.UserId, token.ID, u.accessTtl)
+	if err != nil {
+		return nil, err
+	}
+	return &types.AuthTokens{
+		AccessToken:  accessToken,
+		RefreshToken: token.Key,
+		ExpiresIn:    int64(u.accessTtl / time.Second),
+	}, nil
+}
+
 func (u *userOps) GetUserByEmail(email string) (*types.User, error) {
 	return u.GetUserByAttr("email", email)
 }
 
-func (u *userOps) ActivateAccount(code, email string) error {
+// ActivateAccount activates the account of email with the latest code sent
+// to it. Activating an account twice succeeds.
+func (u *userOps) ActivateAccount(code, email, ip string) error {
+	attempts := u.attempts(types.AttemptActivation, email, ip)
+	if err := u.limiter.Check(attempts...); err != nil {
+		return err
+	}
+	err := u.activateAccount(code, email)
+	if err == ErrInvalidActivationCode {
+		u.failed(attempts)
+	} else if err == nil {
+		u.succeeded(attempts)
+	}
+	return err
+}
+
+func (u *userOps) activateAccount(code, email string) error {
+	user, err := u.GetUserByEmail(email)
+	if err != nil {
+		return ErrInvalidActivationCode
+	}
+	if user.Activated {
+		return nil
+	}
 	v := &types.Verification{}
-	err := u.db.Table("verifications").Where("code = ? AND email = ?", code, email).First(v).Error
+	err = u.db.Table("verifications").Where("email = ? AND activated = ?", email, false).Order("ts DESC").First(v).Error
+	if err == gorm.ErrRecordNotFound || (err == nil && v.Code != code) {
+		return ErrInvalidActivationCode
+	}
 	if err != nil {
+		u.logger.WithError(err).Error("failed to get verification")
+		return errors.New(http.StatusInternalServerError, "failed to activate account at this time. please retry")
+	}
+	if v.Expired(time.Now()) {
+		return ErrActivationCodeExpired
+	}
+
+	tx := u.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	if err := tx.Table("verifications").Where("email = ?", email).UpdateColumn("activated", true).Error; err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to update verifications")
+		return errors.New(http.StatusInternalServerError, "failed to activate account at this time. please retry")
+	}
+	if err := tx.Table("users").Where("id = ?", user.ID).UpdateColumn("activated", true).Error; err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to activate user")
+		return errors.New(http.StatusInternalServerError, "failed to activate account at this time. please retry")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.New(http.StatusInternalServerError, "failed to activate account at this time. please retry")
+	}
+	u.users.invalidate(user.ID.String())
+	return nil
+}
+
+// ResendActivation replaces the activation code of email, so only the new
+// code works. Unknown and already activated emails are not told apart from
+// others.
+func (u *userOps) ResendActivation(email string) error {
+	user, err := u.GetUserByEmail(email)
+	if err != nil || user.Activated {
+		return nil
+	}
+	tx := u.db.Begin()
+	if err := tx.Error; err != nil {
 		return err
 	}
-	return u.db.Table("verifications").Where("code = ? AND email = ?", code, email).UpdateColumn("activated", true).Error
+	// concurrent requests for the same user wait on its row, so each one
+	// counts the codes the others sent
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Table("users").
+		Where("id = ?", user.ID.String()).First(&types.User{}).Error; err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to lock user")
+		return errors.New(http.StatusInternalServerError, "failed to send activation code at this time. please retry")
+	}
+	now := time.Now()
+	recent := make([]types.Verification, 0)
+	err = tx.Table("verifications").Where("email = ? AND ts > ?", email, now.Add(-24*time.Hour)).
+		Order("ts DESC").Find(&recent).Error
+	if err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to list verifications")
+		return errors.New(http.StatusInternalServerError, "failed to send activation code at this time. please retry")
+	}
+	if len(recent) > 0 && now.Sub(recent[0].Ts) < activationResendInterval {
+		tx.Rollback()
+		return errors.New(http.StatusTooManyRequests, "an activation code was just sent. please wait a minute before requesting another")
+	}
+	if len(recent) >= maxActivationCodes {
+		tx.Rollback()
+		return errors.New(http.StatusTooManyRequests, "too many activation codes requested. please try again tomorrow")
+	}
+	verification := types.NewVerification(email, fn.GenRandomCode(), activationCodeTtl)
+	if err := tx.Table("verifications").Create(verification).Error; err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to create verification")
+		return errors.New(http.StatusInternalServerError, "failed to send activation code at this time. please retry")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.New(http.StatusInternalServerError, "failed to send activation code at this time. please retry")
+	}
+
+	go func(code, email, user string, logger *logrus.Logger) {
+		mailBody, err := fn.GenerateActivationEmail(user, code)
+		if err != nil {
+			logger.WithError(err).Error("failed to generate activation email")
+			return
+		}
+		if err := fn.SendEmail(&types.MailRequest{
+			User:  user,
+			Email: email,
+			Title: "Activate your CashTroops account",
+			Body:  mailBody,
+		}); err != nil {
+			logger.WithError(err).Error("failed to send email")
+		}
+	}(verification.Code, user.Email, user.Name(), u.logger)
+	return nil
 }
 
-func (u *userOps) GetSession(key string) (*types.User, error) {
-	return u.session.Get(key)
+// GetSession returns the current record of the user accessToken was
+// issued to.
+func (u *userOps) GetSession(accessToken string) (*types.User, error) {
+	claims, err := u.VerifyAccessToken(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if user, ok := u.users.get(claims.Subject); ok {
+		return user, nil
+	}
+	user, err := u.GetUserByAttr("id", claims.Subject)
+	if err != nil {
+		u.logger.WithError(err).WithField("user_id", claims.Subject).Error("failed to find session user")
+		return nil, session.ErrUnAuthenticated
+	}
+	u.users.set(user)
+	return user, nil
+}
+
+// VerifyAccessToken checks accessToken's signature and that its session
+// has not been revoked since it was issued, without reading any storage.
+// A session revoked by another instance is refused once this one has
+// synced its deny list.
+func (u *userOps) VerifyAccessToken(accessToken string) (*jwt.Claims, error) {
+	claims, err := u.signer.Verify(accessToken)
+	if err == jwt.ErrExpired {
+		return nil, ErrAccessTokenExpired
+	}
+	if err != nil {
+		return nil, session.ErrUnAuthenticated
+	}
+	if u.denied.contains(claims.Session) {
+		return nil, session.ErrUnAuthenticated
+	}
+	return claims, nil
 }
 
+// RefreshToken exchanges refreshToken for new access and refresh tokens.
+// Each refresh token can be used once. Using one again signs its session
+// out, as it has been copied.
+func (u *userOps) RefreshToken(refreshToken string) (*types.AuthTokens, error) {
+	next := types.NewToken(secure.Token(), "", nil)
+	revoked, err := u.session.Rotate(refreshToken, next)
+	switch err {
+	case nil:
+	case session.ErrTokenReused:
+		u.logger.WithField("session_id", revoked).Warn("refresh token reused. session revoked")
+		// access tokens already issued for the session may be the thief's
+		if denyErr := u.deny(revoked); denyErr != nil {
+			return nil, denyErr
+		}
+		return nil, errors.New(http.StatusUnauthorized, err.Error())
+	case session.ErrUnAuthenticated, session.ErrTokenExpired:
+		return nil, errors.New(http.StatusUnauthorized, err.Error())
+	default:
+		u.logger.WithError(err).Error("failed to rotate refresh token")
+		return nil, errors.New(http.StatusInternalServerError, "failed to refresh token at this time. please retry")
+	}
+	tokens, err := u.issue(next)
+	if err != nil {
+		u.logger.WithError(err).Error("failed to sign access token")
+		return nil, errors.New(http.StatusInternalServerError, "failed to refresh token at this time. please retry")
+	}
+	return tokens, nil
+}
+
+func (u *userOps) Logout(userId, sessionId string) error {
+	return u.RevokeSession(userId, sessionId)
+}
+
+func (u *userOps) ListSessions(userId, currentSessionId string) ([]*types.Session, error) {
+	tokens, err := u.session.ListForUser(userId)
+	if err != nil {
+		u.logger.WithError(err).Error("failed to list sessions")
+		return nil, errors.New(http.StatusInternalServerError, "failed to fetch sessions at this time. please retry")
+	}
+	values := make([]*types.Session, 0, len(tokens))
+	for _, next := range tokens {
+		values = append(values, &types.Session{
+			ID:        next.ID,
+			UserAgent: next.UserAgent,
+			IP:        next.IP,
+			Created:   next.Created,
+			LastSeen:  next.LastSeen,
+			Current:   next.ID == currentSessionId,
+		})
+	}
+	return values, nil
+}
+
+func (u *userOps) RevokeSession(userId, sessionId string) error {
+	err := u.session.Revoke(userId, sessionId)
+	if err == session.ErrSessionNotFound {
+		return errors.New(http.StatusNotFound, "session not found")
+	}
+	if err != nil {
+		u.logger.WithError(err).Error("failed to delete session")
+		return errors.New(http.StatusInternalServerError, "failed to revoke session at this time. please retry")
+	}
+	return u.deny(sessionId)
+}
+
+// revokeAll signs out every session of userId except the one with ID
+// except, which may be empty.
+func (u *userOps) revokeAll(userId, except string) error {
+	tokens, err := u.session.ListForUser(userId)
+	if err != nil {
+		return err
+	}
+	if err := u.session.RevokeAllForUser(userId, except); err != nil {
+		return err
+	}
+	ids := make([]string, 0, len(tokens))
+	for _, next := range tokens {
+		if next.ID != except {
+			ids = append(ids, next.ID)
+		}
+	}
+	return u.deny(ids...)
+}
+
+// deny stops the access tokens already issued for revoked sessions from
+// being accepted until they expire.
+func (u *userOps) deny(sessionIds ...string) error {
+	for _, next := range sessionIds {
+		if err := u.session.Deny(next, u.accessTtl); err != nil {
+			u.logger.WithError(err).WithField("session_id", next).Error("failed to deny revoked session")
+			return errors.New(http.StatusInternalServerError, "failed to revoke session at this time. please retry")
+		}
+		u.denied.add(next, time.Now().Add(u.accessTtl))
+	}
+	return nil
+}
+
+// RequestPasswordReset emails a reset code to email, replacing any code
+// sent before. Unknown emails get the same response as known ones.
 func (u *userOps) RequestPasswordReset(email string) error {
 	user, err := u.GetUserByEmail(email)
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
 	if err != nil {
+		u.logger.WithError(err).Error("failed to get user by email")
+		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
+	}
+	tk := types.NewPasswordResetToken(fn.GenRandomCode(), user.Email, user.ID.String(), passwordResetTtl)
+	tx := u.db.Begin()
+	if err := tx.Error; err != nil {
 		return err
 	}
-	tk := types.NewPasswordResetToken(fn.GenRandomCode(), email, user.ID.String())
-	if err := u.db.Table(passwordResetTokenTable).Create(tk).Error; err != nil {
+	if err := revokePasswordResets(tx, tk.OwnerId); err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to revoke password reset tokens")
+		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
+	}
+	if err := tx.Table(passwordResetTokenTable).Create(tk).Error; err != nil {
+		tx.Rollback()
 		u.logger.WithError(err).Error("failed to create password reset token")
 		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
 	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
+	}
 
 	go func(code, email string) {
 		emailBody, err := fn.GenerateResetPasswordEmail(code)
@@ -175,26 +540,112 @@ func (u *userOps) RequestPasswordReset(email string) error {
 	return nil
 }
 
-func (u *userOps) VerifyPasswordResetRequest(code, email string) (*types.PasswordResetToken, error) {
-	tk, err := u.GetPasswordResetToken(code, email)
+// VerifyPasswordResetRequest checks code against the latest reset code sent
+// to email. The returned token's ID is what ResetPassword takes. Too many
+// wrong codes revoke the token, so a new one has to be requested.
+func (u *userOps) VerifyPasswordResetRequest(code, email, ip string) (*types.PasswordResetToken, error) {
+	attempts := u.attempts(types.AttemptPasswordReset, email, ip)
+	if err := u.limiter.Check(attempts...); err != nil {
+		return nil, err
+	}
+	tk, err := u.verifyPasswordReset(code, email)
+	if err == ErrInvalidPasswordReset {
+		u.failed(attempts)
+	} else if err == nil {
+		u.succeeded(attempts)
+	}
+	return tk, err
+}
+
+func (u *userOps) verifyPasswordReset(code, email string) (*types.PasswordResetToken, error) {
+	tk := &types.PasswordResetToken{}
+	err := u.db.Table(passwordResetTokenTable).Where("email = ? AND used = ? AND revoked = ?", email, false, false).
+		Order("ts DESC").First(tk).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, ErrInvalidPasswordReset
+	}
 	if err != nil {
 		u.logger.WithError(err).Error("failed to get password reset token")
-		return nil, errors.New(http.StatusUnauthorized, "password reset request not found")
+		return nil, errors.New(http.StatusInternalServerError, "failed to verify code at this time. please retry")
 	}
-	return tk, u.db.Table(passwordResetTokenTable).Where("id = ?", tk.ID).UpdateColumn("verified", true).Error
+	if !tk.Usable(time.Now()) {
+		return nil, ErrInvalidPasswordReset
+	}
+	if subtle.ConstantTimeCompare([]byte(tk.Code), []byte(code)) != 1 {
+		err := u.db.Table(passwordResetTokenTable).Where("id = ?", tk.ID).UpdateColumns(map[string]interface{}{
+			"attempts": gorm.Expr("attempts + 1"),
+			"revoked":  gorm.Expr("attempts + 1 >= ?", maxPasswordResetAttempts),
+		}).Error
+		if err != nil {
+			u.logger.WithError(err).Error("failed to count password reset attempt")
+		}
+		return nil, ErrInvalidPasswordReset
+	}
+	if err := u.db.Table(passwordResetTokenTable).Where("id = ?", tk.ID).UpdateColumn("verified", true).Error; err != nil {
+		u.logger.WithError(err).Error("failed to verify password reset token")
+		return nil, errors.New(http.StatusInternalServerError, "failed to verify code at this time. please retry")
+	}
+	return tk, nil
 }
 
+// ResetPassword sets the password of whoever verified tokenId. The token
+// is used up, and every session of the user is signed out.
 func (u *userOps) ResetPassword(tokenId, newPassword string) error {
+	// a password that would be rejected must not use up the token
+	if err := fn.ValidatePassword(newPassword); err != nil {
+		return errors.New(http.StatusBadRequest, err.Error())
+	}
 	tk, err := u.GetPasswordResetTokenById(tokenId)
 	if err != nil {
 		u.logger.WithError(err).Error("failed to get password reset token")
-		return errors.New(http.StatusUnauthorized, "password reset request not found")
+		return ErrInvalidPasswordReset
 	}
-	if err := fn.ValidatePassword(newPassword); err != nil {
-		return errors.New(http.StatusBadRequest, err.Error())
+	if !tk.Verified || !tk.Usable(time.Now()) {
+		return ErrInvalidPasswordReset
+	}
+
+	tx := u.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	// only one reset can use the token
+	result := tx.Table(passwordResetTokenTable).Where("id = ? AND used = ? AND revoked = ?", tk.ID, false, false).
+		UpdateColumn("used", true)
+	if result.Error != nil {
+		tx.Rollback()
+		u.logger.WithError(result.Error).Error("failed to use password reset token")
+		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
+	}
+	if result.RowsAffected != 1 {
+		tx.Rollback()
+		return ErrInvalidPasswordReset
+	}
+	if err := tx.Table("users").Where("id = ?", tk.OwnerId).UpdateColumn("password", fn.HashPassword(newPassword)).Error; err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to update password")
+		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
+	}
+	if err := revokePasswordResets(tx, tk.OwnerId); err != nil {
+		tx.Rollback()
+		u.logger.WithError(err).Error("failed to revoke password reset tokens")
+		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.New(http.StatusInternalServerError, "failed to reset password at this time. please retry")
+	}
+	u.users.invalidate(tk.OwnerId)
+	// whoever asked for the reset may not be the one holding the sessions
+	if err := u.revokeAll(tk.OwnerId, ""); err != nil {
+		u.logger.WithError(err).WithField("user_id", tk.OwnerId).Error("failed to revoke sessions after password reset")
 	}
-	newHashedPassword := fn.HashPassword(newPassword)
-	return u.db.Table("users").Where("id = ?", tk.OwnerId).UpdateColumn("password", newHashedPassword).Error
+	return nil
+}
+
+// revokePasswordResets revokes every outstanding password reset token of
+// ownerId.
+func revokePasswordResets(tx *gorm.DB, ownerId string) error {
+	return tx.Table(passwordResetTokenTable).Where("owner_id = ? AND used = ? AND revoked = ?", ownerId, false, false).
+		UpdateColumn("revoked", true).Error
 }
 
 func (u *userOps) GetPasswordResetToken(code, email string) (*types.PasswordResetToken, error) {
@@ -209,7 +660,9 @@ func (u *userOps) GetPasswordResetTokenById(id string) (*types.PasswordResetToke
 	return tk, err
 }
 
-func (u *userOps) ChangePassword(userId, old, newPassword string) error {
+// ChangePassword signs out every session of userId except
+// currentSessionId, the one the password was changed from.
+func (u *userOps) ChangePassword(userId, old, newPassword, currentSessionId string) error {
 	user, err := u.GetUserByAttr("id", userId)
 	if err != nil {
 		u.logger.WithError(err).Error("failed to get userById")
@@ -221,7 +674,14 @@ func (u *userOps) ChangePassword(userId, old, newPassword string) error {
 	if err := fn.ValidatePassword(newPassword); err != nil {
 		return errors.New(http.StatusBadRequest, err.Error())
 	}
-	return u.db.Table("users").Where("id = ?", user.ID).UpdateColumn("password", fn.HashPassword(newPassword)).Error
+	if err := u.db.Table("users").Where("id = ?", user.ID).UpdateColumn("password", fn.HashPassword(newPassword)).Error; err != nil {
+		return err
+	}
+	u.users.invalidate(userId)
+	if err := u.revokeAll(userId, currentSessionId); err != nil {
+		u.logger.WithError(err).WithField("user_id", userId).Error("failed to revoke sessions after password change")
+	}
+	return nil
 }
 
 func (u *userOps) GetUserByAttr(attr string, value interface{}) (*types.User, error) {
@@ -229,3 +689,64 @@ func (u *userOps) GetUserByAttr(attr string, value interface{}) (*types.User, er
 	err := u.db.Table("users").Where(attr+" = ?", value).First(user).Error
 	return user, err
 }
+
+func (u *userOps) UnlockAccount(email, code string) error {
+	return u.limiter.Unlock(email, code)
+}
+
+// attempts are what a guess of kind for email from ip counts against. The
+// account comes first.
+func (u *userOps) attempts(kind, email, ip string) []Attempt {
+	attempts := []Attempt{AccountAttempt(kind, email)}
+	if ip != "" {
+		attempts = append(attempts, IpAttempt(kind, ip))
+	}
+	return attempts
+}
+
+// failed counts a failed guess, emailing the owner of any account it
+// locked a code to unlock it.
+func (u *userOps) failed(attempts []Attempt) {
+	locked, err := u.limiter.Fail(attempts...)
+	if err != nil {
+		u.logger.WithError(err).Error("failed to count failed attempt")
+	}
+	for _, next := range locked {
+		u.logger.WithFields(logrus.Fields{
+			"kind":    next.Kind,
+			"scope":   next.Scope,
+			"subject": next.Subject,
+		}).Warn("locked out after too many failed attempts")
+		if next.UnlockCode == "" {
+			continue
+		}
+		// subjects are lower cased emails
+		user, err := u.GetUserByAttr("LOWER(email)", next.Subject)
+		if err != nil {
+			continue
+		}
+		go func(code, email, user string, until time.Time, logger *logrus.Logger) {
+			mailBody, err := fn.GenerateAccountLockedEmail(user, code, until)
+			if err != nil {
+				logger.WithError(err).Error("failed to generate account locked email")
+				return
+			}
+			if err := fn.SendEmail(&types.MailRequest{
+				User:  user,
+				Email: email,
+				Title: "Your CashTroops account has been locked",
+				Body:  mailBody,
+			}); err != nil {
+				logger.WithError(err).Error("failed to send email")
+			}
+		}(next.UnlockCode, user.Email, user.Name(), *next.LockedUntil, u.logger)
+	}
+}
+
+// succeeded forgets the account's failures. The IP's are kept, so guessing
+// at other accounts from it stays limited.
+func (u *userOps) succeeded(attempts []Attempt) {
+	if err := u.limiter.Succeed(attempts[0]); err != nil {
+		u.logger.WithError(err).Error("failed to clear failed attempts")
+	}
+}
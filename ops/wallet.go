@@ -0,0 +1,461 @@
+package ops
+
+import (
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/errors"
+	"github.com/adigunhammedolalekan/cashtroops/ledger"
+	"github.com/adigunhammedolalekan/cashtroops/libs/bc"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/btcsuite/btcutil"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/sirupsen/logrus"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WalletOps manages custodial balances. Users deposit coin into a
+// persistent address, then pay beneficiaries from or withdraw their balance.
+type WalletOps interface {
+	GetBalances(userId string) ([]*types.Balance, error)
+	GetDepositAddress(userId, coin string) (*types.DepositAddress, error)
+	ReceiveDeposit(txHash, address string, amount int64) (bool, error)
+	ListDeposits(userId string) ([]*types.Deposit, error)
+	ListWithdrawals(userId string) ([]*types.Withdrawal, error)
+	Withdraw(userId string, req *types.WithdrawRequest) (*types.Withdrawal, error)
+	PayFromBalance(userId string, req *types.BalancePaymentRequest) (*types.Payment, error)
+	ReturnPayment(payment *types.Payment) error
+}
+
+type walletOps struct {
+	db         *gorm.DB
+	bcClient   bc.Client
+	accountOps AccountOps
+	paymentOps PaymentOps
+	ledger     *ledger.Ledger
+	logger     *logrus.Logger
+}
+
+func NewWalletOps(db *gorm.DB, bcClient bc.Client, accountOps AccountOps, paymentOps PaymentOps, ledger *ledger.Ledger, logger *logrus.Logger) WalletOps {
+	return &walletOps{
+		db:         db,
+		bcClient:   bcClient,
+		accountOps: accountOps,
+		paymentOps: paymentOps,
+		ledger:     ledger,
+		logger:     logger,
+	}
+}
+
+func (w *walletOps) GetBalances(userId string) ([]*types.Balance, error) {
+	data := make([]*types.Balance, 0)
+	err := w.db.Table("balances").Where("user_id = ?", userId).Order("coin asc").Find(&data).Error
+	return data, err
+}
+
+// GetDepositAddress returns userId's deposit address for coin, creating it
+// the first time it is asked for.
+func (w *walletOps) GetDepositAddress(userId, coin string) (*types.DepositAddress, error) {
+	coin = strings.ToUpper(strings.TrimSpace(coin))
+	if coin == "" {
+		return nil, errors.New(http.StatusBadRequest, "coin is required")
+	}
+	if existing, err := w.depositAddress(userId, coin); err == nil {
+		return &types.DepositAddress{Coin: coin, Address: existing.Address}, nil
+	}
+	addr, err := w.bcClient.GenerateAddress()
+	if err != nil {
+		w.logger.WithError(err).Error("failed to generate deposit address")
+		return nil, errors.New(http.StatusInternalServerError, "failed to create a deposit address at this time. please retry later.")
+	}
+	newEvent, err := w.bcClient.AddHook(bc.Event{
+		Event:   bc.EventTypeTxConfirmation,
+		URL:     txnWebhookUrl,
+		Address: addr.Address,
+	})
+	if err != nil {
+		w.logger.WithError(err).Error("failed to setup notification for deposit address")
+		return nil, errors.New(http.StatusInternalServerError, "failed to create a deposit address at this time. please retry later.")
+	}
+	tx := w.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Table("addresses").Create(&types.Address{
+		Address:  addr.Address,
+		Public:   addr.Public,
+		Private:  addr.Private,
+		Provider: "BLOCKCYPHER",
+		Coin:     coin,
+		UserId:   userId,
+		Deposit:  true,
+		Ts:       time.Now(),
+	}).Error; err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to create deposit address")
+		return nil, errors.New(http.StatusInternalServerError, "failed to create a deposit address at this time. please retry later.")
+	}
+	if err := tx.Table("hooks").Create(&types.Hook{
+		URL:     newEvent.URL,
+		HookId:  newEvent.ID,
+		Address: newEvent.Address,
+		Ts:      time.Now(),
+	}).Error; err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to create hook")
+		return nil, errors.New(http.StatusInternalServerError, "failed to create a deposit address at this time. please retry later.")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+	return &types.DepositAddress{Coin: coin, Address: addr.Address}, nil
+}
+
+// ReceiveDeposit credits amount received at address in the transaction
+// txHash to its owner's balance. It returns false when address is not a
+// deposit address. Each transaction is only credited once. Any address
+// receiving coin is marked active so reconciliation checks it.
+func (w *walletOps) ReceiveDeposit(txHash, address string, amount int64) (bool, error) {
+	if err := w.db.Table("addresses").Where("address = ?", address).
+		UpdateColumn("active_at", time.Now()).Error; err != nil {
+		w.logger.WithError(err).WithField("address", address).Error("failed to mark address active")
+	}
+	depositAddress := &types.Address{}
+	err := w.db.Table("addresses").Where("address = ? AND deposit = ?", address, true).First(depositAddress).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	logger := w.logger.WithFields(logrus.Fields{"tx_hash": txHash, "address": address})
+	existing := &types.Deposit{}
+	if err := w.db.Table("deposits").Where("tx_hash = ? AND address = ?", txHash, address).
+		First(existing).Error; err == nil {
+		logger.Info("deposit has already been credited")
+		return true, nil
+	}
+	tx := w.db.Begin()
+	if err := tx.Error; err != nil {
+		return true, err
+	}
+	deposit := &types.Deposit{
+		UserId:  depositAddress.UserId,
+		Coin:    depositAddress.Coin,
+		Address: address,
+		TxHash:  txHash,
+		Amount:  amount,
+		Ts:      time.Now(),
+	}
+	if err := tx.Table("deposits").Create(deposit).Error; err != nil {
+		tx.Rollback()
+		logger.WithError(err).Error("failed to record deposit")
+		return true, err
+	}
+	if err := credit(tx, depositAddress.UserId, depositAddress.Coin, amount); err != nil {
+		tx.Rollback()
+		logger.WithError(err).Error("failed to credit deposit")
+		return true, err
+	}
+	if err := w.ledger.PostTx(tx, ledger.KindDeposit, deposit.ID.String(), "deposit "+txHash,
+		ledger.Debit(ledger.DepositClearing, deposit.Coin, amount),
+		ledger.Credit(ledger.UserWallet(deposit.UserId), deposit.Coin, amount),
+	); err != nil {
+		tx.Rollback()
+		logger.WithError(err).Error("failed to post deposit to ledger")
+		return true, err
+	}
+	return true, tx.Commit().Error
+}
+
+func (w *walletOps) ListDeposits(userId string) ([]*types.Deposit, error) {
+	data := make([]*types.Deposit, 0)
+	err := w.db.Table("deposits").Where("user_id = ?", userId).Order("ts desc").Find(&data).Error
+	return data, err
+}
+
+func (w *walletOps) ListWithdrawals(userId string) ([]*types.Withdrawal, error) {
+	data := make([]*types.Withdrawal, 0)
+	err := w.db.Table("withdrawals").Where("user_id = ?", userId).Order("ts desc").Find(&data).Error
+	return data, err
+}
+
+// Withdraw sends req.Amount less the network fee from userId's deposit
+// address to req.Address. A withdrawal that may have been broadcast before
+// sending failed is left PENDING for reconciliation rather than returned to
+// the balance.
+func (w *walletOps) Withdraw(userId string, req *types.WithdrawRequest) (*types.Withdrawal, error) {
+	coin := strings.ToUpper(strings.TrimSpace(req.Coin))
+	if req.Amount <= 0 {
+		return nil, errors.New(http.StatusBadRequest, "The amount seems to be invalid")
+	}
+	if err := w.bcClient.ValidateAddress(req.Address); err != nil {
+		return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("address is not a valid %s address", coin))
+	}
+	// a one dollar quote carries the coin's price
+	quote, err := w.paymentOps.Quote(coin, "USD", 100)
+	if err != nil {
+		return nil, err
+	}
+	usdAmount := float64(req.Amount) / btcutil.SatoshiPerBitcoin * quote.CoinPrice
+	if err := w.paymentOps.StepUp(userId, req.TwoFactorCode, usdAmount); err != nil {
+		return nil, err
+	}
+	depositAddress, err := w.depositAddress(userId, coin)
+	if err != nil {
+		return nil, errors.New(http.StatusBadRequest, fmt.Sprintf("you do not have a %s balance", coin))
+	}
+	fee, err := w.bcClient.EstimateFee()
+	if err != nil {
+		w.logger.WithError(err).Error("failed to estimate network fee")
+		return nil, errors.New(http.StatusInternalServerError, "failed to withdraw at this time. please retry later")
+	}
+	if req.Amount <= fee {
+		return nil, errors.New(http.StatusBadRequest, "amount is too small to cover the network fee")
+	}
+
+	withdrawal := &types.Withdrawal{
+		UserId:  userId,
+		Coin:    coin,
+		Address: strings.TrimSpace(req.Address),
+		Amount:  req.Amount,
+		Fee:     fee,
+		Status:  types.WithdrawalPending,
+		Ts:      time.Now(),
+	}
+	tx := w.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+	if err := debit(tx, userId, coin, req.Amount); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Table("withdrawals").Create(withdrawal).Error; err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to create withdrawal")
+		return nil, errors.New(http.StatusInternalServerError, "failed to withdraw at this time. please retry later")
+	}
+	if err := w.ledger.PostTx(tx, ledger.KindWithdrawal, withdrawal.ID.String(), "withdrawal to "+withdrawal.Address,
+		ledger.Debit(ledger.UserWallet(userId), coin, req.Amount),
+		ledger.Credit(ledger.DepositClearing, coin, req.Amount),
+	); err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to post withdrawal to ledger")
+		return nil, errors.New(http.StatusInternalServerError, "failed to withdraw at this time. please retry later")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	txHash, err := w.bcClient.Send(&bc.Address{
+		Address: depositAddress.Address,
+		Public:  depositAddress.Public,
+		Private: depositAddress.Private,
+	}, withdrawal.Address, req.Amount-fee, fee)
+	if err != nil {
+		if !bc.IsNotSent(err) {
+			w.logger.WithError(err).WithField("withdrawal_id", withdrawal.ID.String()).
+				Error("withdrawal may have been broadcast. leaving it pending for reconciliation")
+			return withdrawal, nil
+		}
+		w.logger.WithError(err).WithField("withdrawal_id", withdrawal.ID.String()).Error("failed to broadcast withdrawal")
+		w.failWithdrawal(withdrawal)
+		return nil, errors.New(http.StatusInternalServerError, "failed to withdraw at this time. please retry later")
+	}
+	withdrawal.TxHash, withdrawal.Status = txHash, types.WithdrawalSent
+	if err := w.db.Table("withdrawals").Where("id = ?", withdrawal.ID.String()).
+		Updates(map[string]interface{}{"tx_hash": txHash, "status": withdrawal.Status}).Error; err != nil {
+		w.logger.WithError(err).WithField("tx_hash", txHash).Error("withdrawal was sent but could not be updated")
+	}
+	return withdrawal, nil
+}
+
+// failWithdrawal returns a withdrawal that could not be sent to the balance.
+func (w *walletOps) failWithdrawal(withdrawal *types.Withdrawal) {
+	tx := w.db.Begin()
+	if err := tx.Table("withdrawals").Where("id = ?", withdrawal.ID.String()).
+		UpdateColumn("status", types.WithdrawalFailed).Error; err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to mark withdrawal as failed")
+		return
+	}
+	if err := credit(tx, withdrawal.UserId, withdrawal.Coin, withdrawal.Amount); err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to return withdrawal to balance")
+		return
+	}
+	if err := w.ledger.ReverseTx(tx, ledger.KindWithdrawal, withdrawal.ID.String(), ledger.KindWithdrawalFailed,
+		"withdrawal could not be sent"); err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to post failed withdrawal to ledger")
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		w.logger.WithError(err).Error("failed to return withdrawal to balance")
+	}
+}
+
+// PayFromBalance pays req.Amount to a beneficiary with coin taken from
+// userId's balance at the current quote.
+func (w *walletOps) PayFromBalance(userId string, req *types.BalancePaymentRequest) (*types.Payment, error) {
+	beneficiary, err := w.accountOps.GetBeneficiaryByAttr("id", req.BeneficiaryId)
+	if err != nil || beneficiary.Owner != userId || beneficiary.Removed {
+		return nil, errors.New(http.StatusNotFound, "beneficiary not found")
+	}
+	if !beneficiary.Payable() {
+		return nil, ErrBeneficiaryNameUnconfirmed
+	}
+	corridor := beneficiary.PayoutCorridor()
+	if !w.accountOps.IsSupportedBank(corridor.Code, beneficiary.BankCode) {
+		return nil, errors.New(http.StatusBadRequest, "the beneficiary's bank is no longer supported. please add a new beneficiary")
+	}
+	amount := req.AmountMinor()
+	if amount <= 0 {
+		return nil, errors.New(http.StatusBadRequest, "The amount seems to be invalid")
+	}
+	coin := strings.ToUpper(strings.TrimSpace(req.Coin))
+	if coin == "" {
+		return nil, errors.New(http.StatusBadRequest, "coin is required")
+	}
+	quote, err := w.paymentOps.Quote(coin, corridor.Currency, amount)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.paymentOps.StepUp(userId, req.TwoFactorCode, quote.UsdAmount); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	payment := &types.Payment{
+		UserId:        userId,
+		Amount:        int64(math.Ceil(quote.UsdAmount)),
+		Coin:          coin,
+		CoinPrice:     int64(quote.CoinPrice),
+		BeneficiaryId: beneficiary.ID.String(),
+		Status:        types.INITIALIZED,
+		Ts:            now,
+		KoboAmount:    amount,
+		Currency:      corridor.Currency,
+		UsdAmount:     quote.UsdAmount,
+		BtcAmount:     float64(quote.CoinAmount) / 1e8,
+		CoinAmount:    quote.CoinAmount,
+		FromBalance:   true,
+	}
+	tx := w.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, err
+	}
+	if err := debit(tx, userId, coin, quote.CoinAmount); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Table("payments").Create(payment).Error; err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to create payment body")
+		return nil, errors.New(http.StatusInternalServerError, "failed to process transaction at this time. please retry later.")
+	}
+	if err := w.ledger.PostTx(tx, ledger.KindBalancePayment, payment.ID.String(), "payment from balance",
+		ledger.Debit(ledger.UserWallet(userId), coin, quote.CoinAmount),
+		ledger.Credit(ledger.Fx, coin, quote.CoinAmount),
+		ledger.Debit(ledger.Fx, corridor.Currency, amount),
+		ledger.Credit(ledger.PayoutClearing, corridor.Currency, amount),
+	); err != nil {
+		tx.Rollback()
+		w.logger.WithError(err).Error("failed to post payment to ledger")
+		return nil, errors.New(http.StatusInternalServerError, "failed to process transaction at this time. please retry later.")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, errors.New(http.StatusInternalServerError, "failed to process transaction at this time. please retry later.")
+	}
+
+	if err := w.paymentOps.ProcessPayment(payment); err != nil {
+		// a payout that may have been initiated is left for an operator
+		// rather than paid for twice
+		if err != ErrPayoutNotStarted {
+			if updateErr := w.db.Table("payments").Where("id = ? AND status = ?", payment.ID.String(), types.INITIALIZED).
+				UpdateColumn("status", types.REVIEW).Error; updateErr != nil {
+				w.logger.WithError(updateErr).WithField("payment_id", payment.ID.String()).Error("failed to mark payment for review")
+			}
+			return nil, err
+		}
+		if updateErr := w.db.Table("payments").Where("id = ?", payment.ID.String()).
+			UpdateColumn("status", types.FAILED).Error; updateErr == nil {
+			payment.Status = types.FAILED
+			if err := w.ReturnPayment(payment); err != nil {
+				w.logger.WithError(err).WithField("payment_id", payment.ID.String()).Error("failed to return payment to balance")
+			}
+		}
+		return nil, err
+	}
+	return payment, nil
+}
+
+// ReturnPayment puts the coin a failed or reversed balance payment took back
+// into the balance. A payment is only returned once.
+func (w *walletOps) ReturnPayment(payment *types.Payment) error {
+	tx := w.db.Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+	result := tx.Table("payments").
+		Where("id = ? AND from_balance = ? AND status IN (?)", payment.ID.String(), true,
+			[]types.PaymentStatus{types.FAILED, types.REVERSED}).
+		Updates(map[string]interface{}{
+			"status":        types.REFUNDED,
+			"refund_amount": payment.CoinAmount,
+			"time_updated":  time.Now(),
+		})
+	if result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return errors.New(http.StatusConflict, "payment cannot be returned to balance")
+	}
+	if err := credit(tx, payment.UserId, payment.Coin, payment.CoinAmount); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := w.ledger.ReverseTx(tx, ledger.KindBalancePayment, payment.ID.String(), ledger.KindReturnToBalance,
+		"payment returned to balance"); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	payment.Status, payment.RefundAmount = types.REFUNDED, payment.CoinAmount
+	return nil
+}
+
+func (w *walletOps) depositAddress(userId, coin string) (*types.Address, error) {
+	addr := &types.Address{}
+	err := w.db.Table("addresses").Where("user_id = ? AND coin = ? AND deposit = ?", userId, coin, true).
+		First(addr).Error
+	return addr, err
+}
+
+// credit adds amount to userId's coin balance, creating the balance if it
+// does not exist yet.
+func credit(tx *gorm.DB, userId, coin string, amount int64) error {
+	return tx.Exec(`INSERT INTO balances (id, user_id, coin, value, ts) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, coin) DO UPDATE SET value = balances.value + EXCLUDED.value, ts = EXCLUDED.ts`,
+		uuid.New().String(), userId, coin, amount, time.Now()).Error
+}
+
+// debit takes amount from userId's coin balance, failing when the balance
+// cannot cover it.
+func debit(tx *gorm.DB, userId, coin string, amount int64) error {
+	result := tx.Table("balances").Where("user_id = ? AND coin = ? AND value >= ?", userId, coin, amount).
+		Updates(map[string]interface{}{"value": gorm.Expr("value - ?", amount), "ts": time.Now()})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New(http.StatusBadRequest, fmt.Sprintf("your %s balance is not enough for this transaction", coin))
+	}
+	return nil
+}
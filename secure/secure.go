@@ -0,0 +1,63 @@
+// Package secure mints secrets such as session tokens and one time codes
+// from crypto/rand. Characters and digits are picked without modulo bias,
+// so every value is equally likely.
+package secure
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+)
+
+const (
+	Letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	Digits  = "0123456789"
+	// tokenBytes gives tokens 256 bits of entropy
+	tokenBytes = 32
+)
+
+// Bytes returns n random bytes. It panics if the system's secure random
+// source fails, as nothing minted afterwards could be trusted.
+func Bytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic("secure: failed to read random bytes: " + err.Error())
+	}
+	return b
+}
+
+// Token returns a URL safe token of 256 random bits.
+func Token() string {
+	return base64.RawURLEncoding.EncodeToString(Bytes(tokenBytes))
+}
+
+// String returns n characters picked uniformly from alphabet.
+func String(n int, alphabet string) string {
+	size := big.NewInt(int64(len(alphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		// rand.Int rejects values that would favour part of the alphabet
+		index, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			panic("secure: failed to read random bytes: " + err.Error())
+		}
+		b[i] = alphabet[index.Int64()]
+	}
+	return string(b)
+}
+
+// Code returns a numeric code of n digits. Leading zeros are kept, so
+// every code of n digits is possible.
+func Code(n int) string {
+	return String(n, Digits)
+}
+
+// Hash returns the hex SHA-256 of token, for storing tokens without being
+// able to use what is stored. Tokens carry enough entropy that no salt or
+// slow hash is needed.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
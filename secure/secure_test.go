@@ -0,0 +1,73 @@
+package secure
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestLength(t *testing.T) {
+	for _, n := range []int{0, 1, 6, 64} {
+		assert.Len(t, String(n, Letters), n)
+		assert.Len(t, Code(n), n)
+	}
+	assert.Len(t, Token(), 43)
+	assert.Len(t, Bytes(16), 16)
+	assert.Len(t, Hash("token"), 64)
+}
+
+func TestAlphabet(t *testing.T) {
+	for _, c := range String(1000, Letters) {
+		assert.True(t, strings.ContainsRune(Letters, c))
+	}
+	for _, c := range Code(1000) {
+		assert.True(t, strings.ContainsRune(Digits, c))
+	}
+	for _, c := range Token() {
+		assert.True(t, strings.ContainsRune(Letters+Digits+"-_", c))
+	}
+}
+
+func TestUnique(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 10000; i++ {
+		token := Token()
+		assert.False(t, seen[token])
+		seen[token] = true
+	}
+}
+
+// TestDistribution checks every digit turns up about as often as the
+// others, including in the first position of a code.
+func TestDistribution(t *testing.T) {
+	const samples = 100000
+	counts := make(map[byte]int)
+	leading := make(map[byte]int)
+	for i := 0; i < samples/10; i++ {
+		code := Code(10)
+		leading[code[0]]++
+		for j := 0; j < len(code); j++ {
+			counts[code[j]]++
+		}
+	}
+	// a chi-squared statistic above 27.88 for 9 degrees of freedom happens
+	// by chance once in a thousand runs
+	assert.Less(t, chiSquared(counts, samples), 27.88)
+	assert.Less(t, chiSquared(leading, samples/10), 27.88)
+}
+
+func chiSquared(counts map[byte]int, samples int) float64 {
+	expected := float64(samples) / float64(len(Digits))
+	value := 0.0
+	for i := 0; i < len(Digits); i++ {
+		diff := float64(counts[Digits[i]]) - expected
+		value += diff * diff / expected
+	}
+	return value
+}
+
+func TestHash(t *testing.T) {
+	assert.Equal(t, Hash("token"), Hash("token"))
+	assert.NotEqual(t, Hash("token"), Hash("other"))
+	assert.NotContains(t, Hash("token"), "token")
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/adigunhammedolalekan/cashtroops/config"
 	"github.com/adigunhammedolalekan/cashtroops/database"
 	"github.com/adigunhammedolalekan/cashtroops/http"
+	"github.com/adigunhammedolalekan/cashtroops/jwt"
+	"github.com/adigunhammedolalekan/cashtroops/ledger"
 	"github.com/adigunhammedolalekan/cashtroops/libs/bc"
+	"github.com/adigunhammedolalekan/cashtroops/libs/flutterwaveclient"
 	"github.com/adigunhammedolalekan/cashtroops/libs/paystackclient"
+	"github.com/adigunhammedolalekan/cashtroops/libs/rails"
 	"github.com/adigunhammedolalekan/cashtroops/ops"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
 	"github.com/adigunhammedolalekan/cashtroops/session"
 	"github.com/adigunhammedolalekan/cashtroops/types"
 	"github.com/go-chi/chi"
@@ -16,7 +22,10 @@ import (
 	"io/ioutil"
 	nethttp "net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -30,7 +39,7 @@ func main() {
 		logger.WithField("database_url", cfg.DatabaseUrl).
 			WithError(err).Fatal("failed to open database")
 	}
-	sess, err := session.New(cfg.SessionCacheDir)
+	sess, err := newSessionStore(cfg)
 	if err != nil {
 		logger.WithError(err).Fatal("failed to init session store")
 	}
@@ -44,43 +53,207 @@ func main() {
 	}
 
 	ps := paystackclient.New(cfg.PayStackKey, logger)
-	userOps := ops.NewUserOps(db, sess, logger)
-	accountOps := ops.NewAccountOps(db, ps, logger)
-	accountOps.SetBanks(banks)
+	payouts, err := newPayoutRouter(cfg, ps, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to init payout providers")
+	}
+	signer, err := newSigner(cfg, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to init access token signer")
+	}
+	limiter := ops.NewAttemptLimiter(db, logger)
+	rateLimiter := ops.NewRateLimiter(db, logger)
+	userOps := ops.NewUserOps(db, sess, signer, cfg.AccessTokenTtl, limiter, logger)
+	policy := ops.NewPolicy()
+	accountOps := ops.NewAccountOps(db, payouts, logger)
+	bankDirectory := ops.NewBankDirectory(db, ps, banks, logger)
+	if err := bankDirectory.Load(); err != nil {
+		logger.WithError(err).Error("failed to load saved banks")
+	}
+	bankDirectory.Start(cfg.BankSyncInterval)
+	accountOps.SetBankDirectory(bankDirectory)
 
-	paymentOpts := ops.NewPaymentOps(db, bcClient, userOps, accountOps, ps, logger)
+	journal := ledger.New(db)
+	paymentOpts := ops.NewPaymentOps(db, bcClient, userOps, accountOps, ps, payouts, journal, logger)
+	var batcher *ops.PayoutBatcher
+	if cfg.PayoutBatchWindow > 0 {
+		batcher = ops.NewPayoutBatcher(db, ps, journal, cfg.PayoutBatchWindow, logger)
+		batcher.Start()
+		paymentOpts.SetPayoutBatcher(batcher)
+	}
+	balanceMonitor := ops.NewBalanceMonitor(ps, cfg.PayoutBalanceFloor, cfg.BalanceCheckInterval, cfg.AlertEmail, logger)
+	balanceMonitor.SetRecoveryHandler(paymentOpts.ProcessQueuedPayments)
+	balanceMonitor.Start(cfg.BalanceCheckInterval)
+	paymentOpts.SetBalanceMonitor(balanceMonitor)
+	invoiceOps := ops.NewInvoiceOps(db, userOps, accountOps, paymentOpts, logger)
+	paymentOpts.SetInvoiceOps(invoiceOps)
+	walletOps := ops.NewWalletOps(db, bcClient, accountOps, paymentOpts, journal, logger)
+	paymentOpts.SetWalletOps(walletOps)
+	paymentOpts.SetStepUpThreshold(cfg.StepUpThreshold)
+	scheduleOps := ops.NewScheduleOps(db, userOps, accountOps, paymentOpts, logger)
+	scheduler := ops.NewScheduler(scheduleOps)
+	scheduler.Start(cfg.ScheduleInterval)
 	userHandler := http.NewUserHandler(userOps, logger)
 	accountHandler := http.NewAccountHandler(accountOps, userOps, logger)
-	paymentHandler := http.NewPaymentHandler(paymentOpts, userOps, logger)
+	paymentHandler := http.NewPaymentHandler(paymentOpts, walletOps, userOps, logger)
+	walletHandler := http.NewWalletHandler(walletOps, userOps, logger)
+	invoiceHandler := http.NewInvoiceHandler(invoiceOps, userOps, logger)
+	scheduleHandler := http.NewScheduleHandler(scheduleOps, userOps, logger)
+	reconciler := ops.NewReconciler(db, bcClient, ps, cfg.AlertEmail, logger)
+	reconciler.Start(cfg.ReconciliationInterval)
+	adminHandler := http.NewAdminHandler(paymentOpts, journal, reconciler, limiter, cfg.AdminKey, logger)
 
-	if err := paymentOpts.InitRate("USD-NGN", 490); err != nil {
-		logger.WithError(err).Fatal("failed to init rate")
+	for pair, rate := range cfg.FxRates {
+		if err := paymentOpts.InitRate(pair, rate); err != nil {
+			logger.WithError(err).WithField("pair", pair).Fatal("failed to init rate")
+		}
 	}
 
+	trustProxies, err := http.TrustProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.WithError(err).Fatal("failed to parse trusted proxies")
+	}
+	router.Use(trustProxies)
 	router.Route("/api", func(r chi.Router) {
 		r.Post("/user/new", userHandler.CreateUser)
 		r.Post("/user/authenticate", userHandler.AuthenticateUser)
+		r.Post("/token/refresh", userHandler.RefreshToken)
 		r.Post("/user/activate", userHandler.ActivateAccount)
-		r.Get("/me", userHandler.Me)
+		r.Post("/user/activation/resend", userHandler.ResendActivation)
+		r.Post("/user/unlock", userHandler.UnlockAccount)
 		r.Get("/user/{email}/resetpassword", userHandler.RequestPasswordReset)
 		r.Post("/user/verifypasswordreset", userHandler.VerifyPasswordResetRequest)
 		r.Post("/user/changepassword", userHandler.ResetPassword)
-		r.Put("/me/changepassword", userHandler.ChangePassword)
-		r.Post("/me/beneficiary/new", accountHandler.AddBeneficiary)
-		r.Delete("/me/beneficiary/{id}/remove", accountHandler.RemoveBeneficiary)
-		r.Get("/me/beneficiaries", accountHandler.ListBeneficiaries)
-		r.Post("/payment/init", paymentHandler.InitializePayment)
 		r.Post("/txn/events", paymentHandler.TxnEventHandler)
-		r.Get("/me/payments", paymentHandler.ListPayments)
 		r.Post("/transfer/events", paymentHandler.TransferEventHandler)
-		r.Get("/banks", accountHandler.Banks)
+		r.Post("/transfer/events/{provider}", paymentHandler.TransferEventHandler)
+		r.Get("/invoice/{code}", invoiceHandler.GetInvoice)
+		r.With(http.RateLimit(rateLimiter, "pay_invoice", 20, time.Hour, http.IpKey)).
+			Post("/invoice/{code}/pay", invoiceHandler.PayInvoice)
+		r.Get("/admin/transfers/otp", adminHandler.PendingOtpTransfers)
+		r.Get("/admin/balance", adminHandler.PayoutBalance)
+		r.Get("/admin/ledger/balances", adminHandler.LedgerBalances)
+		r.Get("/admin/ledger/check", adminHandler.LedgerCheck)
+		r.Get("/admin/reconciliation", adminHandler.Reconciliation)
+		r.Get("/admin/lockouts", adminHandler.Lockouts)
+		r.Post("/admin/lockouts/clear", adminHandler.ClearLockout)
+		r.Post("/admin/transfers/finalize", adminHandler.FinalizeTransfers)
+		r.Post("/admin/transfers/{code}/finalize", adminHandler.FinalizeTransfer)
+		r.Post("/admin/transfers/{code}/resendotp", adminHandler.ResendTransferOtp)
+		r.Group(func(r chi.Router) {
+			r.Use(http.RequireAccessToken(userOps))
+			r.Get("/me", userHandler.Me)
+			r.Post("/me/logout", userHandler.Logout)
+			r.Get("/me/sessions", userHandler.ListSessions)
+			r.Delete("/me/sessions/{id}", userHandler.RevokeSession)
+			r.Put("/me/changepassword", userHandler.ChangePassword)
+			r.Post("/me/2fa/setup", userHandler.SetupTwoFactor)
+			r.Post("/me/2fa/confirm", userHandler.ConfirmTwoFactor)
+			r.Post("/me/2fa/disable", userHandler.DisableTwoFactor)
+			beneficiaries := http.Authorize(userOps, policy, ops.ActionManageBeneficiaries)
+			r.With(beneficiaries, http.RequireStepUp(userOps)).Post("/me/beneficiary/new", accountHandler.AddBeneficiary)
+			r.With(beneficiaries).Delete("/me/beneficiary/{id}/remove", accountHandler.RemoveBeneficiary)
+			r.With(beneficiaries).Put("/me/beneficiary/{id}", accountHandler.UpdateBeneficiary)
+			r.With(beneficiaries).Post("/me/beneficiary/{id}/confirm", accountHandler.ConfirmBeneficiaryName)
+			r.Get("/me/beneficiaries", accountHandler.ListBeneficiaries)
+			r.With(http.Authorize(userOps, policy, ops.ActionPay)).Post("/payment/init", paymentHandler.InitializePayment)
+			r.Post("/payment/{id}/refund", paymentHandler.RefundPayment)
+			r.Get("/me/payments", paymentHandler.ListPayments)
+			r.Get("/me/balances", walletHandler.Balances)
+			r.Get("/me/wallet/{coin}/address", walletHandler.DepositAddress)
+			r.Get("/me/wallet/deposits", walletHandler.Deposits)
+			r.Get("/me/wallet/withdrawals", walletHandler.Withdrawals)
+			r.With(http.Authorize(userOps, policy, ops.ActionWithdraw)).Post("/me/wallet/withdraw", walletHandler.Withdraw)
+			r.With(http.Authorize(userOps, policy, ops.ActionPay)).Post("/me/wallet/pay", walletHandler.PayFromBalance)
+			r.With(http.Authorize(userOps, policy, ops.ActionPay)).Post("/me/invoice/new", invoiceHandler.CreateInvoice)
+			r.Get("/me/invoices", invoiceHandler.ListInvoices)
+			r.Post("/me/invoice/{id}/cancel", invoiceHandler.CancelInvoice)
+			r.With(http.Authorize(userOps, policy, ops.ActionSchedulePayments)).Post("/me/schedule/new", scheduleHandler.CreateSchedule)
+			r.Get("/me/schedules", scheduleHandler.ListSchedules)
+			r.Post("/me/schedule/{id}/pause", scheduleHandler.PauseSchedule)
+			r.With(http.Authorize(userOps, policy, ops.ActionSchedulePayments)).Post("/me/schedule/{id}/resume", scheduleHandler.ResumeSchedule)
+			r.Post("/me/schedule/{id}/cancel", scheduleHandler.CancelSchedule)
+			r.Get("/banks", accountHandler.Banks)
+			r.With(http.RateLimit(rateLimiter, "resolve_account", 30, time.Hour, http.UserKey)).
+				Get("/banks/{code}/resolve/{account}", accountHandler.ResolveAccount)
+			r.Get("/corridors", accountHandler.Corridors)
+		})
 	})
 
 	addr := fmt.Sprintf(":%s", cfg.Addr)
-	logger.Infof("API running at %s", addr)
-	if err := nethttp.ListenAndServe(addr, router); err != nil {
-		logger.WithError(err).Fatal("failed to start API server")
+	server := &nethttp.Server{Addr: addr, Handler: router}
+	go func() {
+		logger.Infof("API running at %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != nethttp.ErrServerClosed {
+			logger.WithError(err).Fatal("failed to start API server")
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	logger.Info("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("failed to drain API server")
+	}
+	// background jobs are stopped after requests drain, as requests may
+	// queue work on them
+	scheduler.Stop()
+	reconciler.Stop()
+	balanceMonitor.Stop()
+	bankDirectory.Stop()
+	if batcher != nil {
+		batcher.Stop()
+	}
+	if err := sess.Close(); err != nil {
+		logger.WithError(err).Error("failed to close session store")
+	}
+	if err := db.Close(); err != nil {
+		logger.WithError(err).Error("failed to close database")
+	}
+}
+
+func newSessionStore(cfg config.Config) (session.Store, error) {
+	switch cfg.SessionStore {
+	case "", "badger":
+		return session.New(cfg.SessionCacheDir)
+	case "redis":
+		return session.NewRedis(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDb)
+	}
+	return nil, fmt.Errorf("unknown session store %s", cfg.SessionStore)
+}
+
+// newSigner signs access tokens with the configured keys. Without any, a
+// random key is used, which logs everyone out on restart and cannot be
+// shared between instances.
+func newSigner(cfg config.Config, logger *logrus.Logger) (*jwt.Signer, error) {
+	if len(cfg.JwtKeys) > 0 {
+		return jwt.NewSigner(cfg.JwtKeys, cfg.JwtKeyId)
+	}
+	logger.Warn("JWT_KEYS is not set, signing access tokens with a random key")
+	return jwt.NewSigner(map[string]string{"ephemeral": secure.Token()}, "ephemeral")
+}
+
+func newPayoutRouter(cfg config.Config, ps paystackclient.Client, logger *logrus.Logger) (*rails.Router, error) {
+	providers := make([]rails.PayoutProvider, 0, len(cfg.PayoutProviders))
+	for _, name := range cfg.PayoutProviders {
+		switch name {
+		case rails.Paystack:
+			providers = append(providers, rails.NewPaystack(ps, cfg.PayStackKey))
+		case rails.Flutterwave:
+			fw := flutterwaveclient.New(cfg.FlutterwaveKey, logger)
+			providers = append(providers, rails.NewFlutterwave(fw, cfg.FlutterwaveWebhookHash))
+		default:
+			return nil, fmt.Errorf("unknown payout provider %s", name)
+		}
+	}
+	router := rails.NewRouter(5*time.Minute, providers...)
+	for bankCode, provider := range cfg.PayoutBankProviders {
+		router.PinBank(bankCode, provider)
 	}
+	return router, nil
 }
 
 func loadBanks() ([]types.Bank, error) {
@@ -0,0 +1,382 @@
+package session
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/dgraph-io/badger/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcInterval = 10 * time.Minute
+	// userIndexPrefix keys map a user's session IDs to their token keys, as
+	// userIndexPrefix + userId + ":" + sessionId
+	userIndexPrefix = "sessions:"
+)
+
+// badgerStore keeps sessions in an embedded Badger database, so they are
+// only visible to the process that opened it.
+type badgerStore struct {
+	db   *badger.DB
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New opens the store at path and garbage collects its value log in the
+// background until Close is called. Sessions saved under their plain key
+// are rekeyed by its hash first.
+func New(path string) (Store, error) {
+	db, err := badger.Open(badger.DefaultOptions(path))
+	if err != nil {
+		return nil, err
+	}
+	store := &badgerStore{db: db, done: make(chan struct{})}
+	if err := store.hashKeys(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	store.wg.Add(1)
+	go store.collectGarbage(gcInterval)
+	return store, nil
+}
+
+func (store *badgerStore) Create(token *types.Token) error {
+	prepare(token)
+	return store.save(hashed(token))
+}
+
+func (store *badgerStore) save(token *types.Token) error {
+	return store.db.Update(func(txn *badger.Txn) error {
+		return save(txn, token)
+	})
+}
+
+// save writes token and its index entry to expire when token does.
+func save(txn *badger.Txn, token *types.Token) error {
+	ttl := time.Until(expiresAt(token))
+	if ttl <= 0 {
+		return ErrTokenExpired
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if err := txn.SetEntry(badger.NewEntry([]byte(token.Key), data).WithTTL(ttl)); err != nil {
+		return err
+	}
+	return txn.SetEntry(badger.NewEntry(indexKey(token.UserId, token.ID), []byte(token.Key)).WithTTL(ttl))
+}
+
+func (store *badgerStore) Delete(key string) error {
+	token, err := store.token(secure.Hash(key))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(txn *badger.Txn) error {
+		return store.delete(txn, token)
+	})
+}
+
+// ListForUser returns the unexpired sessions of userId, oldest first.
+func (store *badgerStore) ListForUser(userId string) ([]*types.Token, error) {
+	values := make([]*types.Token, 0)
+	err := store.db.View(func(txn *badger.Txn) error {
+		keys, err := indexedKeys(txn, userId)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			token, err := get(txn, key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if expired(token) {
+				continue
+			}
+			values = append(values, token)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortByCreated(values)
+	return values, nil
+}
+
+func (store *badgerStore) Revoke(userId, sessionId string) error {
+	return store.db.Update(func(txn *badger.Txn) error {
+		return revoke(txn, userId, sessionId)
+	})
+}
+
+func (store *badgerStore) RevokeAllForUser(userId, except string) error {
+	return store.db.Update(func(txn *badger.Txn) error {
+		keys, err := indexedKeys(txn, userId)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			token, err := get(txn, key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if token.ID == except {
+				continue
+			}
+			if err := store.delete(txn, token); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *badgerStore) Deny(sessionId string, ttl time.Duration) error {
+	return store.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte(deniedPrefix+sessionId), nil).WithTTL(ttl))
+	})
+}
+
+func (store *badgerStore) ListDenied() (map[string]time.Time, error) {
+	denied := make(map[string]time.Time)
+	err := store.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(deniedPrefix)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			sessionId := strings.TrimPrefix(string(item.Key()), deniedPrefix)
+			denied[sessionId] = time.Unix(int64(item.ExpiresAt()), 0)
+		}
+		return nil
+	})
+	return denied, err
+}
+
+func (store *badgerStore) Rotate(key string, next *types.Token) (string, error) {
+	key = secure.Hash(key)
+	revoked := ""
+	err := store.db.Update(func(txn *badger.Txn) error {
+		token, err := get(txn, key)
+		if err == badger.ErrKeyNotFound {
+			revoked, err = revokeRotated(txn, key)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if expired(token) {
+			return ErrTokenExpired
+		}
+		inherit(next, token)
+		ttl := time.Until(expiresAt(token))
+		marker := badger.NewEntry([]byte(rotatedPrefix+key), []byte(rotatedValue(token))).WithTTL(ttl)
+		if err := txn.SetEntry(marker); err != nil {
+			return err
+		}
+		// the index entry is shared with next, which save overwrites
+		if err := txn.Delete([]byte(key)); err != nil {
+			return err
+		}
+		return save(txn, hashed(next))
+	})
+	if err != nil {
+		return "", err
+	}
+	if revoked != "" {
+		return revoked, ErrTokenReused
+	}
+	return "", nil
+}
+
+// revokeRotated deletes the session key was rotated into and returns its
+// ID, or ErrUnAuthenticated when key was never rotated.
+func revokeRotated(txn *badger.Txn, key string) (string, error) {
+	item, err := txn.Get([]byte(rotatedPrefix + key))
+	if err == badger.ErrKeyNotFound {
+		return "", ErrUnAuthenticated
+	}
+	if err != nil {
+		return "", err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return "", err
+	}
+	userId, sessionId := parseRotated(string(value))
+	if err := revoke(txn, userId, sessionId); err != nil && err != ErrSessionNotFound {
+		return "", err
+	}
+	return sessionId, nil
+}
+
+func revoke(txn *badger.Txn, userId, sessionId string) error {
+	item, err := txn.Get(indexKey(userId, sessionId))
+	if err == badger.ErrKeyNotFound {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	key, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	if err := txn.Delete(key); err != nil {
+		return err
+	}
+	return txn.Delete(indexKey(userId, sessionId))
+}
+
+// hashKeys rekeys sessions saved under their plain key, before stores kept
+// only hashes, by the hash of it. Expired ones are dropped.
+func (store *badgerStore) hashKeys() error {
+	keys := make([]string, 0)
+	err := store.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			key := string(it.Item().Key())
+			if !strings.HasPrefix(key, userIndexPrefix) && !strings.HasPrefix(key, rotatedPrefix) &&
+				!strings.HasPrefix(key, deniedPrefix) && !isHash(key) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := store.db.Update(func(txn *badger.Txn) error {
+			token, err := get(txn, key)
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				// nothing unreadable can be signed in with
+				return txn.Delete([]byte(key))
+			}
+			token.Key = key
+			if err := store.delete(txn, token); err != nil {
+				return err
+			}
+			if expired(token) {
+				return nil
+			}
+			prepare(token)
+			return save(txn, hashed(token))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isHash(key string) bool {
+	_, err := hex.DecodeString(key)
+	return err == nil && len(key) == len(secure.Hash(""))
+}
+
+func (store *badgerStore) Close() error {
+	close(store.done)
+	store.wg.Wait()
+	return store.db.Close()
+}
+
+// collectGarbage reclaims value log space held by deleted and expired
+// sessions every interval. Each pass rewrites files until none is worth
+// rewriting.
+func (store *badgerStore) collectGarbage(interval time.Duration) {
+	defer store.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for store.db.RunValueLogGC(0.5) == nil {
+			}
+		case <-store.done:
+			return
+		}
+	}
+}
+
+func (store *badgerStore) delete(txn *badger.Txn, token *types.Token) error {
+	if err := txn.Delete([]byte(token.Key)); err != nil {
+		return err
+	}
+	if token.ID == "" {
+		return nil
+	}
+	return txn.Delete(indexKey(token.UserId, token.ID))
+}
+
+func (store *badgerStore) token(key string) (*types.Token, error) {
+	var token *types.Token
+	err := store.db.View(func(txn *badger.Txn) error {
+		var err error
+		token, err = get(txn, key)
+		return err
+	})
+	return token, err
+}
+
+func get(txn *badger.Txn, key string) (*types.Token, error) {
+	item, err := txn.Get([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	err = item.Value(func(val []byte) error {
+		value = append(value, val...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return decode(value)
+}
+
+// indexedKeys returns the token keys of every session indexed for userId.
+// Index entries of deleted tokens are removed by delete, so each key
+// usually still has a token.
+func indexedKeys(txn *badger.Txn, userId string) ([]string, error) {
+	prefix := []byte(userIndexPrefix + userId + ":")
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+	keys := make([]string, 0)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		err := it.Item().Value(func(val []byte) error {
+			keys = append(keys, string(val))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func indexKey(userId, sessionId string) []byte {
+	return []byte(userIndexPrefix + userId + ":" + sessionId)
+}
@@ -0,0 +1,277 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"strconv"
+	"time"
+)
+
+const (
+	redisPoolSize = 16
+	redisTimeout  = 5 * time.Second
+	// sessions are kept as redisTokenPrefix + hash and each user's hashes
+	// in the set redisUserPrefix + userId
+	redisTokenPrefix = "session:"
+	redisUserPrefix  = "sessions:"
+	// denied sessions are also kept in the set redisDeniedKey, so they
+	// can be listed
+	redisDeniedKey = redisTokenPrefix + "denied"
+)
+
+// redisStore keeps sessions in Redis, or anything speaking its protocol, so
+// every API instance sees the same sessions.
+type redisStore struct {
+	pool *respPool
+}
+
+// NewRedis returns a Store backed by the Redis server at addr. It checks
+// the server can be reached before returning.
+func NewRedis(addr, password string, db int) (Store, error) {
+	store := &redisStore{pool: newRespPool(addr, password, db, redisPoolSize, redisTimeout)}
+	if _, err := store.pool.do("PING"); err != nil {
+		store.pool.close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *redisStore) Create(token *types.Token) error {
+	prepare(token)
+	return store.save(hashed(token))
+}
+
+// save writes token to expire when it does and adds it to its user's set.
+// The set lives as long as the longest session it can hold.
+func (store *redisStore) save(token *types.Token) error {
+	ttl := time.Until(expiresAt(token))
+	if ttl <= 0 {
+		return ErrTokenExpired
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	if _, err := store.pool.do("SET", redisTokenPrefix+token.Key, string(data), "PX", milliseconds(ttl)); err != nil {
+		return err
+	}
+	userKey := redisUserPrefix + token.UserId
+	if _, err := store.pool.do("SADD", userKey, token.Key); err != nil {
+		return err
+	}
+	_, err = store.pool.do("PEXPIRE", userKey, milliseconds(MaxLifetime))
+	return err
+}
+
+func (store *redisStore) Delete(key string) error {
+	token, err := store.token(secure.Hash(key))
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	return store.delete(token.UserId, token.Key)
+}
+
+// ListForUser returns the unexpired sessions of userId, oldest first.
+// Keys in the user's set whose session has expired are removed from it.
+func (store *redisStore) ListForUser(userId string) ([]*types.Token, error) {
+	keys, err := store.members(redisUserPrefix + userId)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]*types.Token, 0, len(keys))
+	for _, key := range keys {
+		token, err := store.token(key)
+		if err != nil {
+			return nil, err
+		}
+		if token == nil {
+			if _, err := store.pool.do("SREM", redisUserPrefix+userId, key); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if expired(token) {
+			continue
+		}
+		values = append(values, token)
+	}
+	sortByCreated(values)
+	return values, nil
+}
+
+func (store *redisStore) Revoke(userId, sessionId string) error {
+	tokens, err := store.ListForUser(userId)
+	if err != nil {
+		return err
+	}
+	for _, next := range tokens {
+		if next.ID == sessionId {
+			return store.delete(userId, next.Key)
+		}
+	}
+	return ErrSessionNotFound
+}
+
+func (store *redisStore) RevokeAllForUser(userId, except string) error {
+	tokens, err := store.ListForUser(userId)
+	if err != nil {
+		return err
+	}
+	for _, next := range tokens {
+		if next.ID == except {
+			continue
+		}
+		if err := store.delete(userId, next.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deny keeps when the mark expires as its value. Every mark lasts about
+// as long, so the set lives as long as the latest one.
+func (store *redisStore) Deny(sessionId string, ttl time.Duration) error {
+	until := strconv.FormatInt(time.Now().Add(ttl).UnixNano()/int64(time.Millisecond), 10)
+	if _, err := store.pool.do("SET", redisTokenPrefix+deniedPrefix+sessionId, until, "PX", milliseconds(ttl)); err != nil {
+		return err
+	}
+	if _, err := store.pool.do("SADD", redisDeniedKey, sessionId); err != nil {
+		return err
+	}
+	_, err := store.pool.do("PEXPIRE", redisDeniedKey, milliseconds(ttl))
+	return err
+}
+
+// ListDenied removes sessions whose mark has expired from the set.
+func (store *redisStore) ListDenied() (map[string]time.Time, error) {
+	sessionIds, err := store.members(redisDeniedKey)
+	if err != nil {
+		return nil, err
+	}
+	denied := make(map[string]time.Time, len(sessionIds))
+	for _, sessionId := range sessionIds {
+		reply, err := store.pool.do("GET", redisTokenPrefix+deniedPrefix+sessionId)
+		if err != nil {
+			return nil, err
+		}
+		value, ok := reply.(string)
+		if !ok {
+			if _, err := store.pool.do("SREM", redisDeniedKey, sessionId); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed denied session %s", sessionId)
+		}
+		denied[sessionId] = time.Unix(0, ms*int64(time.Millisecond))
+	}
+	return denied, nil
+}
+
+func (store *redisStore) Rotate(key string, next *types.Token) (string, error) {
+	key = secure.Hash(key)
+	token, err := store.token(key)
+	if err != nil {
+		return "", err
+	}
+	if token == nil {
+		return store.revokeRotated(key)
+	}
+	if expired(token) {
+		return "", ErrTokenExpired
+	}
+	// only one rotation of a key can set its marker, any other is reuse
+	ttl := time.Until(expiresAt(token))
+	reply, err := store.pool.do("SET", redisRotatedKey(key), rotatedValue(token), "NX", "PX", milliseconds(ttl))
+	if err != nil {
+		return "", err
+	}
+	if reply == nil {
+		return store.revokeRotated(key)
+	}
+	inherit(next, token)
+	if err := store.delete(token.UserId, key); err != nil {
+		return "", err
+	}
+	return "", store.save(hashed(next))
+}
+
+// revokeRotated deletes the session key was rotated into and returns its
+// ID with ErrTokenReused, or ErrUnAuthenticated when key was never rotated.
+func (store *redisStore) revokeRotated(key string) (string, error) {
+	reply, err := store.pool.do("GET", redisRotatedKey(key))
+	if err != nil {
+		return "", err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", ErrUnAuthenticated
+	}
+	userId, sessionId := parseRotated(value)
+	if err := store.Revoke(userId, sessionId); err != nil && err != ErrSessionNotFound {
+		return "", err
+	}
+	return sessionId, ErrTokenReused
+}
+
+func (store *redisStore) Close() error {
+	store.pool.close()
+	return nil
+}
+
+func (store *redisStore) delete(userId, key string) error {
+	if _, err := store.pool.do("DEL", redisTokenPrefix+key); err != nil {
+		return err
+	}
+	_, err := store.pool.do("SREM", redisUserPrefix+userId, key)
+	return err
+}
+
+// token returns the session with key, or nil when there is none.
+func (store *redisStore) token(key string) (*types.Token, error) {
+	reply, err := store.pool.do("GET", redisTokenPrefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, nil
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return decode([]byte(value))
+}
+
+func (store *redisStore) members(key string) ([]string, error) {
+	reply, err := store.pool.do("SMEMBERS", key)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected SMEMBERS reply %T", reply)
+	}
+	keys := make([]string, 0, len(values))
+	for _, next := range values {
+		if key, ok := next.(string); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func redisRotatedKey(key string) string {
+	return redisTokenPrefix + rotatedPrefix + key
+}
+
+func milliseconds(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Millisecond), 10)
+}
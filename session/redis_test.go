@@ -0,0 +1,400 @@
+package session
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
+	"github.com/adigunhammedolalekan/cashtroops/types"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking enough of the Redis protocol
+// for redisStore.
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu      sync.Mutex
+	strings map[string]string
+	sets    map[string]map[string]bool
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeRedis{
+		listener: listener,
+		password: password,
+		strings:  make(map[string]string),
+		sets:     make(map[string]map[string]bool),
+		expires:  make(map[string]time.Time),
+	}
+	go server.serve()
+	return server
+}
+
+func (s *fakeRedis) addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) close() {
+	s.listener.Close()
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		values, _ := reply.([]interface{})
+		args := make([]string, 0, len(values))
+		for _, next := range values {
+			args = append(args, next.(string))
+		}
+		var response string
+		switch {
+		case len(args) == 0:
+			response = "-ERR empty command\r\n"
+		case strings.ToUpper(args[0]) == "AUTH":
+			authenticated = len(args) == 2 && args[1] == s.password
+			response = "+OK\r\n"
+			if !authenticated {
+				response = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			response = "-NOAUTH Authentication required.\r\n"
+		default:
+			response = s.exec(args)
+		}
+		if _, err := conn.Write([]byte(response)); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeRedis) exec(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, at := range s.expires {
+		if !time.Now().Before(at) {
+			delete(s.strings, key)
+			delete(s.sets, key)
+			delete(s.expires, key)
+		}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, ok := s.strings[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "SET":
+		var expires time.Time
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if _, ok := s.strings[args[1]]; ok {
+					return "$-1\r\n"
+				}
+			case "PX":
+				i++
+				ms, _ := strconv.Atoi(args[i])
+				expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			}
+		}
+		s.strings[args[1]] = args[2]
+		delete(s.expires, args[1])
+		if !expires.IsZero() {
+			s.expires[args[1]] = expires
+		}
+		return "+OK\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.strings[key]; ok {
+				deleted++
+			}
+			delete(s.strings, key)
+			delete(s.sets, key)
+			delete(s.expires, key)
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	case "SADD":
+		if s.sets[args[1]] == nil {
+			s.sets[args[1]] = make(map[string]bool)
+		}
+		for _, member := range args[2:] {
+			s.sets[args[1]][member] = true
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-2)
+	case "SREM":
+		for _, member := range args[2:] {
+			delete(s.sets[args[1]], member)
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-2)
+	case "SMEMBERS":
+		members := s.sets[args[1]]
+		response := fmt.Sprintf("*%d\r\n", len(members))
+		for member := range members {
+			response += bulk(member)
+		}
+		return response
+	case "PEXPIRE":
+		ms, _ := strconv.Atoi(args[2])
+		s.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func newTestRedisStore(t *testing.T) (Store, *fakeRedis) {
+	server := newFakeRedis(t, "secret")
+	store, err := NewRedis(server.addr(), "secret", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, server
+}
+
+// lookup returns the session of userId with key, or nil when there is none.
+func lookup(t *testing.T, store Store, userId, key string) *types.Token {
+	tokens, err := store.ListForUser(userId)
+	assert.Nil(t, err)
+	for _, next := range tokens {
+		if next.Key == secure.Hash(key) {
+			return next
+		}
+	}
+	return nil
+}
+
+func TestRedisStore(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	defer server.close()
+	defer store.Close()
+
+	ids := make(map[string]string)
+	for _, key := range []string{"first", "second", "third", "fourth"} {
+		token := types.NewToken(key, "user", &types.Device{UserAgent: "test", IP: "127.0.0.1"})
+		assert.Nil(t, store.Create(token))
+		assert.NotEmpty(t, token.ID)
+		assert.Equal(t, key, token.Key)
+		ids[key] = token.ID
+	}
+	assert.Nil(t, store.Create(types.NewToken("other", "another user", nil)))
+
+	token := lookup(t, store, "user", "second")
+	assert.NotNil(t, token)
+	assert.Equal(t, "user", token.UserId)
+	assert.Equal(t, "test", token.UserAgent)
+	assert.Nil(t, lookup(t, store, "user", "unknown"))
+
+	sessions, err := store.ListForUser("user")
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 4)
+
+	// only hashes of keys are stored
+	server.mu.Lock()
+	for key, value := range server.strings {
+		assert.NotContains(t, key, "second")
+		assert.NotContains(t, value, `"second"`)
+	}
+	server.mu.Unlock()
+
+	assert.Nil(t, store.Revoke("user", ids["fourth"]))
+	assert.Equal(t, ErrSessionNotFound, store.Revoke("user", ids["fourth"]))
+	assert.Nil(t, lookup(t, store, "user", "fourth"))
+
+	assert.Nil(t, store.Delete("first"))
+	assert.Nil(t, store.Delete("first"))
+	assert.Nil(t, lookup(t, store, "user", "first"))
+
+	assert.Nil(t, store.RevokeAllForUser("user", ids["third"]))
+	assert.Nil(t, lookup(t, store, "user", "second"))
+	assert.NotNil(t, lookup(t, store, "user", "third"))
+	assert.NotNil(t, lookup(t, store, "another user", "other"))
+	sessions, err = store.ListForUser("user")
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, secure.Hash("third"), sessions[0].Key)
+}
+
+func TestRedisStoreShared(t *testing.T) {
+	first, server := newTestRedisStore(t)
+	defer server.close()
+	defer first.Close()
+	second, err := NewRedis(server.addr(), "secret", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	// a session started on one replica is usable and revocable on another
+	assert.Nil(t, first.Create(types.NewToken("shared", "user", nil)))
+	assert.NotNil(t, lookup(t, second, "user", "shared"))
+	assert.Nil(t, second.Delete("shared"))
+	assert.Nil(t, lookup(t, first, "user", "shared"))
+
+	// and so is a revoked session's denial
+	assert.Nil(t, first.Deny("session", time.Minute))
+	denied, err := second.ListDenied()
+	assert.Nil(t, err)
+	assert.Contains(t, denied, "session")
+}
+
+func TestRedisStoreRotate(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	defer server.close()
+	defer store.Close()
+
+	first := types.NewToken("first", "user", nil)
+	assert.Nil(t, store.Create(first))
+	second := types.NewToken("second", "", nil)
+	_, err := store.Rotate("first", second)
+	assert.Nil(t, err)
+	assert.Equal(t, first.ID, second.ID)
+	assert.Equal(t, "user", second.UserId)
+	assert.Nil(t, lookup(t, store, "user", "first"))
+	sessions, err := store.ListForUser("user")
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, secure.Hash("second"), sessions[0].Key)
+
+	// presenting the rotated key again revokes the whole session
+	revoked, err := store.Rotate("first", types.NewToken("third", "", nil))
+	assert.Equal(t, ErrTokenReused, err)
+	assert.Equal(t, first.ID, revoked)
+	assert.Nil(t, lookup(t, store, "user", "second"))
+	_, err = store.Rotate("unknown", types.NewToken("fourth", "", nil))
+	assert.Equal(t, ErrUnAuthenticated, err)
+}
+
+func TestRedisStoreExpiry(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	defer server.close()
+	defer store.Close()
+
+	// reaching MaxLifetime expires a session however recently it was used
+	token := types.NewToken("old", "user", nil)
+	token.Created = time.Now().Add(-MaxLifetime + 100*time.Millisecond)
+	token.LastSeen = time.Now()
+	assert.Nil(t, store.Create(token))
+	time.Sleep(200 * time.Millisecond)
+	sessions, err := store.ListForUser("user")
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 0)
+
+	expired := types.NewToken("expired", "user", nil)
+	expired.Created = time.Now().Add(-MaxLifetime)
+	assert.Equal(t, ErrTokenExpired, store.Create(expired))
+}
+
+func TestRedisStoreSlidingExpiry(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	defer server.close()
+	defer store.Close()
+
+	// refreshing a session extends it by IdleTimeout
+	token := types.NewToken("idle", "user", nil)
+	token.Created = time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, store.Create(token))
+	next := types.NewToken("refreshed", "", nil)
+	_, err := store.Rotate("idle", next)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now(), next.LastSeen, time.Minute)
+
+	server.mu.Lock()
+	expiresAt := server.expires[redisTokenPrefix+secure.Hash("refreshed")]
+	server.mu.Unlock()
+	assert.WithinDuration(t, time.Now().Add(IdleTimeout), expiresAt, time.Minute)
+}
+
+func TestRedisStoreLegacyToken(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	defer server.close()
+	defer store.Close()
+
+	// a token written before sessions held only a user ID
+	server.mu.Lock()
+	server.strings[redisTokenPrefix+secure.Hash("legacy")] = fmt.Sprintf(`{"key":%q,"created":%q,"user":{"id":"6ba7b810-9dad-11d1-80b4-00c04fd430c8"}}`,
+		secure.Hash("legacy"), time.Now().Format(time.RFC3339Nano))
+	server.mu.Unlock()
+
+	next := types.NewToken("next", "", nil)
+	_, err := store.Rotate("legacy", next)
+	assert.Nil(t, err)
+	assert.Equal(t, "6ba7b810-9dad-11d1-80b4-00c04fd430c8", next.UserId)
+	assert.NotEmpty(t, next.ID)
+	sessions, err := store.ListForUser(next.UserId)
+	assert.Nil(t, err)
+	assert.Len(t, sessions, 1)
+}
+
+func TestRedisStoreDeny(t *testing.T) {
+	store, server := newTestRedisStore(t)
+	defer server.close()
+	defer store.Close()
+
+	denied, err := store.ListDenied()
+	assert.Nil(t, err)
+	assert.Empty(t, denied)
+	assert.Nil(t, store.Deny("session", 100*time.Millisecond))
+	assert.Nil(t, store.Deny("other", time.Minute))
+	denied, err = store.ListDenied()
+	assert.Nil(t, err)
+	assert.Len(t, denied, 2)
+	assert.WithinDuration(t, time.Now().Add(100*time.Millisecond), denied["session"], 50*time.Millisecond)
+	time.Sleep(200 * time.Millisecond)
+	denied, err = store.ListDenied()
+	assert.Nil(t, err)
+	assert.Len(t, denied, 1)
+	assert.Contains(t, denied, "other")
+}
+
+func TestRedisStoreAuth(t *testing.T) {
+	server := newFakeRedis(t, "secret")
+	defer server.close()
+	_, err := NewRedis(server.addr(), "wrong", 0)
+	assert.Error(t, err)
+	_, err = NewRedis(server.addr(), "", 0)
+	assert.Error(t, err)
+}
+
+func TestRedisStoreUnreachable(t *testing.T) {
+	server := newFakeRedis(t, "")
+	server.close()
+	_, err := NewRedis(server.addr(), "", 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,213 @@
+package session
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisError is an error reply. The connection that returned it is still
+// usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// respConn is a connection speaking the Redis serialization protocol.
+type respConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+	timeout time.Duration
+}
+
+func dialResp(addr string, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		writer:  bufio.NewWriter(conn),
+		timeout: timeout,
+	}, nil
+}
+
+// do sends a command and reads its reply, which is a string, an int64, a
+// []interface{} of replies or nil for a missing value.
+func (c *respConn) do(args ...string) (interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if err := writeCommand(c.writer, args); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(c.reader)
+}
+
+func (c *respConn) close() error {
+	return c.conn.Close()
+}
+
+func writeCommand(w *bufio.Writer, args []string) error {
+	if _, err := fmt.Fprintf(w, "*%d\r\n", len(args)); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if _, err := fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			value, err := readReply(r)
+			if err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				value = err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
+
+// respPool reuses connections to one server. Connections that fail with
+// anything other than an error reply are closed rather than reused.
+type respPool struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	conns    chan *respConn
+}
+
+func newRespPool(addr, password string, db, size int, timeout time.Duration) *respPool {
+	return &respPool{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  timeout,
+		conns:    make(chan *respConn, size),
+	}
+}
+
+func (p *respPool) get() (*respConn, error) {
+	select {
+	case conn := <-p.conns:
+		return conn, nil
+	default:
+	}
+	conn, err := dialResp(p.addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.password != "" {
+		if _, err := conn.do("AUTH", p.password); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if p.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(p.db)); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (p *respPool) put(conn *respConn, err error) {
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.close()
+		return
+	}
+	select {
+	case p.conns <- conn:
+	default:
+		conn.close()
+	}
+}
+
+// do runs a command on a pooled connection.
+func (p *respPool) do(args ...string) (interface{}, error) {
+	conn, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(args...)
+	p.put(conn, err)
+	return reply, err
+}
+
+func (p *respPool) close() {
+	for {
+		select {
+		case conn := <-p.conns:
+			conn.close()
+		default:
+			return
+		}
+	}
+}
@@ -3,73 +3,153 @@ package session
 import (
 	"encoding/json"
 	"errors"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
 	"github.com/adigunhammedolalekan/cashtroops/types"
-	"github.com/dgraph-io/badger/v2"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
 	"time"
 )
 
 const (
-	sevenDays = time.Hour * 24 * 7
+	// IdleTimeout is how long a session lasts without being refreshed.
+	// Refreshing it extends it, up to MaxLifetime after it was created.
+	IdleTimeout = time.Hour * 24 * 7
+	MaxLifetime = time.Hour * 24 * 30
 )
 
 var (
 	ErrTokenExpired    = errors.New("token has expired. please re-authenticate")
 	ErrUnAuthenticated = errors.New("unauthenticated user. token not found")
+	ErrTokenReused     = errors.New("token has already been used. please re-authenticate")
+	ErrSessionNotFound = errors.New("session not found")
 )
 
+// Store keeps sessions by the hash of their key, so the keys themselves
+// cannot be read back from it. Tokens returned by a Store hold that hash
+// in Key.
 type Store interface {
 	Create(token *types.Token) error
-	Get(key string) (*types.User, error)
+	Delete(key string) error
+	ListForUser(userId string) ([]*types.Token, error)
+	// Revoke deletes the session of userId with sessionId, returning
+	// ErrSessionNotFound when there is none.
+	Revoke(userId, sessionId string) error
+	// RevokeAllForUser deletes every session of userId except the one
+	// with ID except, which may be empty.
+	RevokeAllForUser(userId, except string) error
+	// Rotate replaces the session with key by next, which takes over its
+	// ID, user and creation time. Rotating a key that was already rotated
+	// deletes the session it was rotated into and returns its ID with
+	// ErrTokenReused, since either copy of the key may be stolen.
+	Rotate(key string, next *types.Token) (string, error)
+	// Deny marks sessionId as revoked for ttl, long enough for every access
+	// token issued for it to expire.
+	Deny(sessionId string, ttl time.Duration) error
+	// ListDenied returns the sessions marked as revoked with when their
+	// mark expires.
+	ListDenied() (map[string]time.Time, error)
+	// Close stops background work and closes the store.
+	Close() error
 }
 
-type sessionStore struct {
-	db *badger.DB
+// prepare fills in what Create needs before a token is first saved.
+func prepare(token *types.Token) {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	if token.LastSeen.IsZero() {
+		token.LastSeen = token.Created
+	}
 }
 
-func New(path string) (Store, error) {
-	db, err := badger.Open(badger.DefaultOptions(path))
-	if err != nil {
-		return nil, err
+// hashed returns a copy of token keyed by the hash of its key, as stores
+// save it.
+func hashed(token *types.Token) *types.Token {
+	value := *token
+	value.Key = secure.Hash(token.Key)
+	return &value
+}
+
+// expiresAt is when token expires: IdleTimeout after it was last used, but
+// never later than MaxLifetime after it was created.
+func expiresAt(token *types.Token) time.Time {
+	idle := lastSeen(token).Add(IdleTimeout)
+	absolute := token.Created.Add(MaxLifetime)
+	if idle.After(absolute) {
+		return absolute
 	}
-	return &sessionStore{db: db}, nil
+	return idle
+}
+
+func expired(token *types.Token) bool {
+	return !time.Now().Before(expiresAt(token))
 }
 
-func (store *sessionStore) Create(token *types.Token) error {
-	data, err := json.Marshal(token)
-	if err != nil {
-		return err
+func lastSeen(token *types.Token) time.Time {
+	if token.LastSeen.IsZero() {
+		return token.Created
 	}
-	return store.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(token.Key), data)
-	})
+	return token.LastSeen
+}
+
+// rotatedPrefix keys mark rotated keys, as rotatedPrefix + hash, with the
+// value userId + ":" + sessionId. deniedPrefix keys mark revoked sessions,
+// as deniedPrefix + sessionId.
+const (
+	rotatedPrefix = "rotated:"
+	deniedPrefix  = "denied:"
+)
+
+// inherit makes next the successor of token. Tokens created before
+// sessions were indexed get an ID when they are first refreshed, so they
+// can be listed and revoked.
+func inherit(next, token *types.Token) {
+	next.ID = token.ID
+	if next.ID == "" {
+		next.ID = uuid.New().String()
+	}
+	next.UserId = token.UserId
+	next.Created = token.Created
+	next.LastSeen = time.Now()
+}
+
+func rotatedValue(token *types.Token) string {
+	return token.UserId + ":" + token.ID
 }
 
-func (store *sessionStore) Get(key string) (*types.User, error) {
+// parseRotated returns the user and session ID a rotated key belonged to.
+func parseRotated(value string) (string, string) {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return value, ""
+	}
+	return value[:i], value[i+1:]
+}
+
+func decode(value []byte) (*types.Token, error) {
 	token := &types.Token{}
-	err := store.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(key))
-		if err != nil {
-			return err
+	if err := json.Unmarshal(value, token); err != nil {
+		return nil, err
+	}
+	if token.UserId == "" {
+		// tokens used to hold a copy of the whole user
+		var legacy struct {
+			User *types.User `json:"user"`
 		}
-		var value []byte
-		err = item.Value(func(val []byte) error {
-			value = append(value, val...)
-			return nil
-		})
-		if err != nil {
-			return err
+		if err := json.Unmarshal(value, &legacy); err != nil {
+			return nil, err
 		}
-		if err := json.Unmarshal(value, token); err != nil {
-			return err
+		if legacy.User == nil {
+			return nil, ErrUnAuthenticated
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, ErrUnAuthenticated
-	}
-	diff := time.Now().Sub(token.Created)
-	if diff > sevenDays {
-		return nil, ErrTokenExpired
+		token.UserId = legacy.User.ID.String()
 	}
-	return token.User, nil
+	return token, nil
+}
+
+func sortByCreated(tokens []*types.Token) {
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
 }
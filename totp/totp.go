@@ -0,0 +1,106 @@
+// Package totp generates and checks time-based one time passwords as
+// described in RFC 6238, with the parameters authenticator apps assume:
+// HMAC-SHA1, six digits and a thirty second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/adigunhammedolalekan/cashtroops/secure"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// secretBytes is the secret length RFC 4226 recommends
+	secretBytes = 20
+	// skew is how many periods a code may be early or late, to allow for
+	// clock drift and slow typing
+	skew = 1
+)
+
+var ErrInvalidSecret = errors.New("totp: secret is not valid base32")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new base32 encoded secret.
+func GenerateSecret() string {
+	return encoding.EncodeToString(secure.Bytes(secretBytes))
+}
+
+// URI returns the otpauth URI authenticator apps enrol secret from, usually
+// shown as a QR code.
+func URI(issuer, account, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprintf("%d", Digits))
+	values.Set("period", fmt.Sprintf("%d", int(Period/time.Second)))
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// Step returns the time step t falls in.
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of secret at t.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decode(secret)
+	if err != nil {
+		return "", err
+	}
+	return code(key, Step(t)), nil
+}
+
+// Validate reports whether value is a code of secret within skew of t, and
+// the step it belongs to. Callers should reject steps at or before the last
+// one accepted, so a code cannot be replayed.
+func Validate(secret, value string, t time.Time) (int64, bool) {
+	key, err := decode(secret)
+	if err != nil || len(value) != Digits {
+		return 0, false
+	}
+	current := Step(t)
+	for step := current - skew; step <= current+skew; step++ {
+		if subtle.ConstantTimeCompare([]byte(code(key, step)), []byte(value)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func decode(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := encoding.DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
+
+// code is the HOTP value of key for counter, as in RFC 4226.
+func code(key []byte, counter int64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < Digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", Digits, value%modulus)
+}
@@ -0,0 +1,63 @@
+package totp
+
+import (
+	"encoding/base32"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 secret of the RFC 6238 test vectors
+var rfcSecret = base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCode(t *testing.T) {
+	// the RFC's eight digit values, cut to six
+	values := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for ts, expected := range values {
+		code, err := Code(rfcSecret, time.Unix(ts, 0))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, code)
+	}
+	_, err := Code("not base32!", time.Now())
+	assert.Equal(t, ErrInvalidSecret, err)
+}
+
+func TestValidate(t *testing.T) {
+	secret := GenerateSecret()
+	now := time.Now()
+	code, _ := Code(secret, now)
+	step, ok := Validate(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	// a code from the previous period is still accepted, older ones are not
+	previous, _ := Code(secret, now.Add(-Period))
+	step, ok = Validate(secret, previous, now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now)-1, step)
+	old, _ := Code(secret, now.Add(-3*Period))
+	_, ok = Validate(secret, old, now)
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "", now)
+	assert.False(t, ok)
+	_, ok = Validate(secret, code+"0", now)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	secret := GenerateSecret()
+	assert.Len(t, secret, 32)
+	uri := URI("CashTroops", "user@cashtroops.africa", secret)
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/CashTroops:user@cashtroops.africa?"))
+	assert.Contains(t, uri, "secret="+secret)
+	assert.Contains(t, uri, "issuer=CashTroops")
+}
@@ -3,6 +3,7 @@ package types
 import (
 	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
+	"time"
 )
 
 type Beneficiary struct {
@@ -11,12 +12,45 @@ type Beneficiary struct {
 	AccountNumber       string    `json:"account_number"`
 	BankName            string    `json:"bank_name"`
 	BankCode            string    `json:"bank_code"`
+	Corridor            string    `json:"corridor"`
+	Currency            string    `json:"currency"`
 	TransferRecipientId string    `json:"transfer_recipient_id"`
 	Owner               string    `json:"owner"`
 	Hidden              bool      `json:"hidden"`
+	// SuppliedName is the account name the user entered, kept when it
+	// differs from the name the bank resolved.
+	SuppliedName string `json:"supplied_name"`
+	NameVerified bool   `json:"name_verified"`
+	NameMismatch bool   `json:"name_mismatch"`
+	// NameConfirmed is set once the user accepts a mismatched name
+	NameConfirmed bool       `json:"name_confirmed" gorm:"default:false"`
+	Nickname      string     `json:"nickname"`
+	Favourite     bool       `json:"favourite" gorm:"default:false"`
+	IsDefault     bool       `json:"is_default" gorm:"default:false"`
+	LastPaidAt    *time.Time `json:"last_paid_at"`
+	// Removed beneficiaries are kept so past payments can still refer to them
+	Removed   bool       `json:"-" gorm:"default:false"`
+	RemovedAt *time.Time `json:"-"`
+}
+
+type UpdateBeneficiaryOpts struct {
+	Nickname  *string `json:"nickname"`
+	Favourite *bool   `json:"favourite"`
+	IsDefault *bool   `json:"is_default"`
+}
+
+type BeneficiaryQuery struct {
+	Search  string
+	Sort    string
+	Page    int
+	PerPage int
 }
 
 func NewBeneficiary(opts *CreateBeneficiaryOpts, owner string) *Beneficiary {
+	corridor, ok := CorridorFor(opts.Corridor)
+	if !ok {
+		corridor, _ = CorridorFor(DefaultCorridor)
+	}
 	return &Beneficiary{
 		ID:            uuid.New(),
 		AccountName:   opts.AccountName,
@@ -24,9 +58,27 @@ func NewBeneficiary(opts *CreateBeneficiaryOpts, owner string) *Beneficiary {
 		BankName:      opts.BankName,
 		Owner:         owner,
 		BankCode:      opts.BankCode,
+		Corridor:      corridor.Code,
+		Currency:      corridor.Currency,
+		Hidden:        opts.Hidden,
 	}
 }
 
+// PayoutCorridor returns the corridor payouts to this beneficiary use.
+func (b *Beneficiary) PayoutCorridor() *Corridor {
+	if corridor, ok := CorridorFor(b.Corridor); ok {
+		return corridor
+	}
+	corridor, _ := CorridorFor(DefaultCorridor)
+	return corridor
+}
+
+// Payable reports whether payouts can be made to this beneficiary. One whose
+// name did not match the bank's record has to be confirmed first.
+func (b *Beneficiary) Payable() bool {
+	return !b.NameMismatch || b.NameConfirmed
+}
+
 func (b *Beneficiary) BeforeCreate(scope *gorm.Scope) error {
 	return scope.SetColumn("ID", uuid.New().String())
 }
@@ -0,0 +1,43 @@
+package types
+
+import "time"
+
+const (
+	AttemptLogin         = "login"
+	AttemptPasswordReset = "password_reset"
+	AttemptActivation    = "activation"
+	AttemptStepUp        = "step_up"
+
+	AttemptScopeAccount = "account"
+	AttemptScopeIp      = "ip"
+)
+
+// AttemptCounter counts recent failed guesses at one kind of secret, made
+// against an account or from an IP.
+type AttemptCounter struct {
+	// Key is Kind:Scope:Subject
+	Key         string     `json:"key" gorm:"primary_key"`
+	Kind        string     `json:"kind"`
+	Scope       string     `json:"scope"`
+	Subject     string     `json:"subject"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"last_failure"`
+	LockedUntil *time.Time `json:"locked_until"`
+	// UnlockHash is the hash of the code emailed to unlock an account
+	UnlockHash string `json:"-"`
+	// UnlockCode is only set on a counter that was just locked
+	UnlockCode string `json:"-" gorm:"-" sql:"-"`
+}
+
+// Locked reports whether the counter is locked at now.
+func (c *AttemptCounter) Locked(now time.Time) bool {
+	return c.LockedUntil != nil && now.Before(*c.LockedUntil)
+}
+
+// RateCounter counts the requests made under Key in the window that started
+// at WindowStart.
+type RateCounter struct {
+	Key         string    `json:"key" gorm:"primary_key"`
+	WindowStart time.Time `json:"window_start"`
+	Count       int       `json:"count"`
+}
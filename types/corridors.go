@@ -0,0 +1,98 @@
+package types
+
+import "regexp"
+
+const (
+	DefaultCorridor = "NG_NUBAN"
+)
+
+// Corridor is a country, currency and recipient type that payouts can be
+// made to.
+type Corridor struct {
+	Code          string `json:"code"`
+	Country       string `json:"country"`
+	Currency      string `json:"currency"`
+	RecipientType string `json:"recipient_type"`
+	Description   string `json:"description"`
+	// Resolvable corridors can look up the name on an account before paying
+	Resolvable bool `json:"resolvable"`
+	// AccountHint describes the expected account number format
+	AccountHint    string         `json:"account_hint"`
+	accountPattern *regexp.Regexp `json:"-"`
+}
+
+var Corridors = []*Corridor{
+	{
+		Code:           "NG_NUBAN",
+		Country:        "NG",
+		Currency:       "NGN",
+		RecipientType:  "nuban",
+		Description:    "Nigerian bank account",
+		Resolvable:     true,
+		AccountHint:    "10 digit NUBAN account number",
+		accountPattern: regexp.MustCompile(`^\d{10}$`),
+	},
+	{
+		Code:           "GH_MOBILE_MONEY",
+		Country:        "GH",
+		Currency:       "GHS",
+		RecipientType:  "mobile_money",
+		Description:    "Ghana mobile money wallet",
+		AccountHint:    "mobile number e.g 0241234567 or 233241234567",
+		accountPattern: regexp.MustCompile(`^(?:233|0)(?:2[03456789]|5[034579])\d{7}$`),
+	},
+	{
+		Code:           "KE_MPESA",
+		Country:        "KE",
+		Currency:       "KES",
+		RecipientType:  "mobile_money",
+		Description:    "Kenya M-Pesa wallet",
+		AccountHint:    "Safaricom number e.g 0712345678 or 254712345678",
+		accountPattern: regexp.MustCompile(`^(?:254|0)(?:7\d{8}|1[01]\d{7})$`),
+	},
+	{
+		Code:           "ZA_BASA",
+		Country:        "ZA",
+		Currency:       "ZAR",
+		RecipientType:  "basa",
+		Description:    "South African bank account",
+		AccountHint:    "9 to 11 digit account number",
+		accountPattern: regexp.MustCompile(`^\d{9,11}$`),
+	},
+}
+
+// CorridorFor returns the corridor with code. Records created before
+// corridors existed have no code and belong to the default corridor.
+func CorridorFor(code string) (*Corridor, bool) {
+	if code == "" {
+		code = DefaultCorridor
+	}
+	for _, next := range Corridors {
+		if next.Code == code {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// CorridorForCurrency returns the first corridor paying out in currency.
+func CorridorForCurrency(currency string) (*Corridor, bool) {
+	for _, next := range Corridors {
+		if next.Currency == currency {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// ValidAccountNumber reports whether accountNumber has the format this
+// corridor expects.
+func (c *Corridor) ValidAccountNumber(accountNumber string) bool {
+	return c.accountPattern.MatchString(accountNumber)
+}
+
+// RatePair is the currency pair used to convert USD into this corridor's
+// currency.
+func (c *Corridor) RatePair() string {
+	return "USD-" + c.Currency
+}
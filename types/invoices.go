@@ -0,0 +1,98 @@
+package types
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"math"
+	"time"
+)
+
+type InvoiceStatus string
+
+const (
+	InvoiceOpen      InvoiceStatus = "OPEN"
+	InvoicePaid      InvoiceStatus = "PAID"
+	InvoiceExpired   InvoiceStatus = "EXPIRED"
+	InvoiceCancelled InvoiceStatus = "CANCELLED"
+)
+
+// Invoice is a request for payment into one of the requester's
+// beneficiaries. Anyone with its Code can pay it.
+type Invoice struct {
+	ID            uuid.UUID     `json:"id" gorm:"primary_key"`
+	Code          string        `json:"code" gorm:"unique_index"`
+	UserId        string        `json:"user_id"`
+	BeneficiaryId string        `json:"beneficiary_id"`
+	Amount        int64         `json:"amount"` // In Currency's minor unit
+	Currency      string        `json:"currency"`
+	Memo          string        `json:"memo"`
+	Status        InvoiceStatus `json:"status"`
+	ExpiresAt     time.Time     `json:"expires_at"`
+	PaymentId     string        `json:"payment_id"`
+	AmountPaid    int64         `json:"amount_paid"` // In the payout currency's minor unit
+	PaidAt        *time.Time    `json:"paid_at"`
+	Ts            time.Time     `json:"ts"`
+}
+
+func (i *Invoice) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
+// Payable reports whether the invoice can still be paid at now.
+func (i *Invoice) Payable(now time.Time) bool {
+	return i.Status == InvoiceOpen && now.Before(i.ExpiresAt)
+}
+
+type CreateInvoiceOpts struct {
+	BeneficiaryId string      `json:"beneficiary_id"`
+	Amount        json.Number `json:"amount"` // In Currency's major unit e.g 2500.50
+	Currency      string      `json:"currency"`
+	Memo          string      `json:"memo"`
+	ExpiresAt     *time.Time  `json:"expires_at"`
+}
+
+// AmountMinor returns the requested amount in Currency's minor unit.
+func (opts *CreateInvoiceOpts) AmountMinor() int64 {
+	if value, err := opts.Amount.Float64(); err == nil {
+		return int64(math.Round(value * 100))
+	}
+	return 0
+}
+
+// InvoiceView is what a payer sees when they open an invoice.
+type InvoiceView struct {
+	Code          string        `json:"code"`
+	RequestedBy   string        `json:"requested_by"`
+	Amount        int64         `json:"amount"`
+	Currency      string        `json:"currency"`
+	Memo          string        `json:"memo"`
+	Status        InvoiceStatus `json:"status"`
+	ExpiresAt     time.Time     `json:"expires_at"`
+	AccountName   string        `json:"account_name"`
+	BankName      string        `json:"bank_name"`
+	PayoutCountry string        `json:"payout_country"`
+}
+
+type PayInvoiceRequest struct {
+	Coin          string `json:"coin"`
+	Email         string `json:"email"`
+	RefundAddress string `json:"refund_address"`
+}
+
+// Quote is how much of a coin has to be sent to cover an amount.
+type Quote struct {
+	Currency   string    `json:"currency"`
+	Amount     int64     `json:"amount"` // In Currency's minor unit
+	UsdAmount  float64   `json:"usd_amount"`
+	Coin       string    `json:"coin"`
+	CoinPrice  float64   `json:"coin_price"`  // In USD
+	CoinAmount int64     `json:"coin_amount"` // In the coin's smallest unit e.g SATOSHI
+	Rate       int64     `json:"rate"`        // Currency per USD, 1 for USD
+	Ts         time.Time `json:"ts"`
+}
+
+type PayInvoiceResponse struct {
+	*InitPaymentResponse
+	Quote *Quote `json:"quote"`
+}
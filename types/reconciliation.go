@@ -0,0 +1,66 @@
+package types
+
+import (
+	"encoding/csv"
+	"io"
+	"time"
+)
+
+// Kinds of reconciliation issue
+const (
+	IssueMissingDeposit    = "missing_deposit"
+	IssueUnrecordedDeposit = "unrecorded_deposit"
+	IssueMultipleDeposits  = "multiple_deposits"
+	IssueMissingPayout     = "missing_payout"
+	IssueDuplicatePayout   = "duplicate_payout"
+	IssueOrphanTransfer    = "orphan_transfer"
+	IssueAmountMismatch    = "amount_mismatch"
+	IssueStatusMismatch    = "status_mismatch"
+	IssuePendingWithdrawal = "pending_withdrawal"
+	IssueCheckFailed       = "check_failed"
+)
+
+// ReconciliationIssue is a difference between our records and Paystack or
+// the blockchain. Expected is what our records say, Actual is what the
+// provider or chain says.
+type ReconciliationIssue struct {
+	Kind      string `json:"kind"`
+	PaymentId string `json:"payment_id,omitempty"`
+	Reference string `json:"reference,omitempty"`
+	Address   string `json:"address,omitempty"`
+	TxHash    string `json:"tx_hash,omitempty"`
+	Expected  string `json:"expected,omitempty"`
+	Actual    string `json:"actual,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+type ReconciliationReport struct {
+	From              time.Time              `json:"from"`
+	To                time.Time              `json:"to"`
+	Payments          int                    `json:"payments"`
+	Deposits          int                    `json:"deposits"`
+	ProviderTransfers int                    `json:"provider_transfers"`
+	Issues            []*ReconciliationIssue `json:"issues"`
+	Ts                time.Time              `json:"ts"`
+}
+
+func (r *ReconciliationReport) Add(issue *ReconciliationIssue) {
+	r.Issues = append(r.Issues, issue)
+}
+
+// WriteCSV writes one row per issue, with a header row.
+func (r *ReconciliationReport) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"kind", "payment_id", "reference", "address", "tx_hash",
+		"expected", "actual", "detail"}); err != nil {
+		return err
+	}
+	for _, next := range r.Issues {
+		if err := writer.Write([]string{next.Kind, next.PaymentId, next.Reference, next.Address, next.TxHash,
+			next.Expected, next.Actual, next.Detail}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
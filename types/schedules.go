@@ -0,0 +1,91 @@
+package types
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"math"
+	"time"
+)
+
+type ScheduleStatus string
+
+const (
+	ScheduleActive    ScheduleStatus = "ACTIVE"
+	SchedulePaused    ScheduleStatus = "PAUSED"
+	ScheduleCancelled ScheduleStatus = "CANCELLED"
+)
+
+const (
+	CadenceWeekly   = "weekly"
+	CadenceBiweekly = "biweekly"
+	CadenceMonthly  = "monthly"
+)
+
+// Schedule starts a payment to a beneficiary on every due date. Runs are
+// counted from StartAt so monthly schedules keep their day of the month.
+type Schedule struct {
+	ID            uuid.UUID      `json:"id" gorm:"primary_key"`
+	UserId        string         `json:"user_id"`
+	BeneficiaryId string         `json:"beneficiary_id"`
+	Amount        int64          `json:"amount"` // In the payout currency's minor unit
+	Currency      string         `json:"currency"`
+	Coin          string         `json:"coin"`
+	Cadence       string         `json:"cadence"`
+	Status        ScheduleStatus `json:"status"`
+	StartAt       time.Time      `json:"start_at"`
+	NextRunAt     time.Time      `json:"next_run_at"`
+	Runs          int            `json:"runs"` // Due dates passed so far, NextRunAt is RunAt(Runs)
+	LastRunAt     *time.Time     `json:"last_run_at"`
+	LastPaymentId string         `json:"last_payment_id"`
+	LastError     string         `json:"last_error"`
+	Ts            time.Time      `json:"ts"`
+}
+
+func (s *Schedule) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
+// RunAt returns when the nth run, counting from zero, is due.
+func (s *Schedule) RunAt(n int) time.Time {
+	switch s.Cadence {
+	case CadenceWeekly:
+		return s.StartAt.AddDate(0, 0, 7*n)
+	case CadenceBiweekly:
+		return s.StartAt.AddDate(0, 0, 14*n)
+	default:
+		return addMonths(s.StartAt, n)
+	}
+}
+
+// addMonths adds n months to t, moving to the last day of the month when t's
+// day does not exist in it e.g Jan 31 becomes Feb 28.
+func addMonths(t time.Time, n int) time.Time {
+	firstOfMonth := time.Date(t.Year(), t.Month()+time.Month(n), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	day := t.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return firstOfMonth.AddDate(0, 0, day-1)
+}
+
+func ValidCadence(cadence string) bool {
+	return cadence == CadenceWeekly || cadence == CadenceBiweekly || cadence == CadenceMonthly
+}
+
+type CreateScheduleOpts struct {
+	BeneficiaryId string      `json:"beneficiary_id"`
+	Amount        json.Number `json:"amount"` // In the payout currency's major unit e.g NAIRA
+	Coin          string      `json:"coin"`
+	Cadence       string      `json:"cadence"`
+	StartAt       *time.Time  `json:"start_at"`
+}
+
+// AmountMinor returns the amount in the payout currency's minor unit.
+func (opts *CreateScheduleOpts) AmountMinor() int64 {
+	if value, err := opts.Amount.Float64(); err == nil {
+		return int64(math.Round(value * 100))
+	}
+	return 0
+}
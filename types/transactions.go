@@ -8,11 +8,24 @@ import (
 
 type PaymentStatus string
 
+const (
+	TransferStatusOtp = "otp"
+
+	PayoutEventSuccess  = "success"
+	PayoutEventFailed   = "failed"
+	PayoutEventReversed = "reversed"
+)
+
 const (
 	INITIALIZED PaymentStatus = "INITIALIZED"
 	FAILED      PaymentStatus = "FAILED"
 	REVERSED    PaymentStatus = "REVERSED"
 	DONE        PaymentStatus = "DONE"
+	QUEUED      PaymentStatus = "QUEUED"
+	BATCHED     PaymentStatus = "BATCHED" // waiting for the next bulk transfer
+	REVIEW      PaymentStatus = "REVIEW"  // payout outcome unknown, left for an operator
+	REFUNDING   PaymentStatus = "REFUNDING"
+	REFUNDED    PaymentStatus = "REFUNDED"
 )
 
 type Payment struct {
@@ -25,12 +38,24 @@ type Payment struct {
 	AddressUsed   string        `json:"address_used"`
 	Status        PaymentStatus `json:"status"`
 	Ts            time.Time     `json:"ts"`
-	KoboAmount    int64         `json:"kobo_amount"`
+	KoboAmount    int64         `json:"kobo_amount"` // In the payout currency's minor unit
+	Currency      string        `json:"currency"`
 	UsdAmount     float64       `json:"usd_amount"`
 	BtcAmount     float64       `json:"btc_amount"`
-	TimeUpdated   time.Time     `json:"time_updated"`
+	CoinAmount    int64         `json:"coin_amount"` // In the coin's smallest unit e.g SATOSHI
+	RefundAddress string        `json:"refund_address"`
+	RefundAmount  int64         `json:"refund_amount"`
+	RefundTxHash  string        `json:"refund_tx_hash"`
+	InvoiceId     string        `json:"invoice_id"`
+	PayerEmail    string        `json:"payer_email"` // Set when someone paid an invoice
+	ScheduleId    string        `json:"schedule_id"`
+	// FromBalance payments are paid from the user's custodial balance and
+	// are returned to it rather than refunded on chain
+	FromBalance bool      `json:"from_balance" gorm:"default:false"`
+	TimeUpdated time.Time `json:"time_updated"`
 }
 
+// Balance is what a user holds of a coin, in its smallest unit e.g SATOSHI
 type Balance struct {
 	ID     uuid.UUID `json:"id" gorm:"primary_key"`
 	UserId string    `json:"user_id"`
@@ -42,11 +67,17 @@ type Balance struct {
 type Address struct {
 	ID       uuid.UUID `json:"id" gorm:"primary_key"`
 	UserId   string    `json:"user_id"`
+	Address  string    `json:"address"`
 	Public   string    `json:"public"`
 	Private  string    `json:"private"`
 	Provider string    `json:"provider"`
 	Coin     string    `json:"coin"`
-	Ts       time.Time `json:"ts"`
+	// Deposit addresses are kept for a user's custodial balance instead of
+	// being used for a single payment
+	Deposit bool `json:"deposit" gorm:"default:false"`
+	// ActiveAt is when a transaction to the address was last confirmed
+	ActiveAt *time.Time `json:"active_at"`
+	Ts       time.Time  `json:"ts"`
 }
 
 type Rate struct {
@@ -77,11 +108,34 @@ type Transfer struct {
 	Recipient    int       `json:"recipient"`
 	Status       string    `json:"status"`
 	TransferCode string    `json:"transfer_code"`
+	Provider     string    `json:"provider"`
 	ID           int       `json:"id"`
 	CreatedAt    time.Time `json:"createdAt"`
 	UpdatedAt    time.Time `json:"updatedAt"`
 }
 
+// PayoutRecipient is the recipient a payout provider issued for a
+// beneficiary.
+type PayoutRecipient struct {
+	ID            uuid.UUID `json:"id" gorm:"primary_key"`
+	BeneficiaryId string    `json:"beneficiary_id"`
+	Provider      string    `json:"provider"`
+	Code          string    `json:"code"`
+	Ts            time.Time `json:"ts"`
+}
+
+// PayoutEvent is a transfer webhook normalised across payout providers.
+type PayoutEvent struct {
+	Provider     string `json:"provider"`
+	Reference    string `json:"reference"`
+	TransferCode string `json:"transfer_code"`
+	Status       string `json:"status"`
+}
+
+func (r *PayoutRecipient) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
 func (a *Address) BeforeCreate(scope *gorm.Scope) error {
 	return scope.SetColumn("ID", uuid.New().String())
 }
@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/json"
+	"github.com/jinzhu/gorm"
 	"time"
 )
 
@@ -17,7 +18,11 @@ type CreateBeneficiaryOpts struct {
 	AccountNumber string `json:"account_number"`
 	BankName      string `json:"bank_name"`
 	BankCode      string `json:"bank_code"`
+	Corridor      string `json:"corridor"`
 	Hidden        bool   `json:"hidden"`
+	// ConfirmName accepts the name the bank has on record when it does not
+	// match AccountName
+	ConfirmName bool `json:"confirm_name"`
 }
 
 type MailRequest struct {
@@ -38,6 +43,8 @@ type PaymentBeneficiary struct {
 	AccountNumber string `json:"account_number"`
 	BankName      string `json:"bank_name"`
 	BankCode      string `json:"bank_code"`
+	Corridor      string `json:"corridor"`
+	ConfirmName   bool   `json:"confirm_name"`
 }
 
 type InitPaymentRequest struct {
@@ -45,15 +52,46 @@ type InitPaymentRequest struct {
 	Beneficiary   *PaymentBeneficiary `json:"beneficiary"`
 	Amount        json.Number         `json:"amount"`
 	Coin          string              `json:"coin"`
+	RefundAddress string              `json:"refund_address"`
+	// InvoiceId and PayerEmail are set when the payment pays an invoice
+	InvoiceId  string `json:"-"`
+	PayerEmail string `json:"-"`
+	ScheduleId string `json:"-"`
+	// TwoFactorCode is the second factor sent with the request, needed for
+	// large payments and new beneficiaries
+	TwoFactorCode string `json:"-"`
+}
+
+type FinalizeTransferResult struct {
+	TransferCode string `json:"transfer_code"`
+	Status       string `json:"status"`
+	Error        string `json:"error,omitempty"`
+}
+
+type PayoutBalanceStatus struct {
+	Balance   int64     `json:"balance"` // In KOBO
+	Floor     int64     `json:"floor"`   // In KOBO
+	Tripped   bool      `json:"tripped"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+type RefundRequest struct {
+	Address string `json:"address"`
 }
 
 type Bank struct {
-	Name     string `json:"name"`
-	Slug     string `json:"slug"`
-	Code     string `json:"code"`
-	Currency string `json:"currency"`
-	ID       int64  `json:"id"`
-	Longcode string `json:"longcode"`
+	Key       string    `json:"-" gorm:"primary_key"`
+	Name      string    `json:"name"`
+	Slug      string    `json:"slug"`
+	Code      string    `json:"code"`
+	Currency  string    `json:"currency"`
+	Country   string    `json:"country"`
+	Type      string    `json:"type"`
+	ID        int64     `json:"id"`
+	Longcode  string    `json:"longcode"`
+	Active    bool      `json:"active"`
+	IsDeleted bool      `json:"is_deleted"`
+	UpdatedAt time.Time `json:"updatedAt"`
 }
 
 type BankAccount struct {
@@ -125,3 +163,13 @@ func (req *InitPaymentRequest) AmountInt() int64 {
 	}
 	return 0
 }
+
+// BankKey identifies a bank within a currency and recipient type. Bank codes
+// are only unique within those.
+func BankKey(currency, bankType, code string) string {
+	return currency + "/" + bankType + "/" + code
+}
+
+func (b *Bank) BeforeSave(scope *gorm.Scope) error {
+	return scope.SetColumn("Key", BankKey(b.Currency, b.Type, b.Code))
+}
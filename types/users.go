@@ -13,14 +13,77 @@ type User struct {
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Password  string    `json:"-"`
-	Token     string    `json:"token" gorm:"-" sql:"-"`
-	Ts        time.Time `json:"ts"`
+	// Activated is set once the user confirms their email, money cannot
+	// be moved before then
+	Activated bool `json:"activated" gorm:"default:false"`
+	// TwoFactorEnabled is set once the user confirmed a code of TotpSecret.
+	// TotpLastStep is the time step of the last code accepted, so codes
+	// cannot be used twice.
+	TwoFactorEnabled bool   `json:"two_factor_enabled" gorm:"default:false"`
+	TotpSecret       string `json:"-"`
+	TotpLastStep     int64  `json:"-" gorm:"default:0"`
+	// Token is an access token, sent as X-Account-Token, and RefreshToken
+	// exchanges for a new one before it expires in ExpiresIn seconds
+	Token        string    `json:"token" gorm:"-" sql:"-"`
+	RefreshToken string    `json:"refresh_token,omitempty" gorm:"-" sql:"-"`
+	ExpiresIn    int64     `json:"expires_in,omitempty" gorm:"-" sql:"-"`
+	Ts           time.Time `json:"ts"`
+}
+
+type AuthTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
 }
 
+// Token is a session, keyed by its refresh token. It holds only the user's
+// ID, the user is looked up whenever the session is used so changes to them
+// apply immediately.
 type Token struct {
-	Key     string    `json:"key"`
-	Created time.Time `json:"created"`
-	User    *User     `json:"user"`
+	// ID identifies the session without revealing Key
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	UserId    string    `json:"user_id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+}
+
+// Device describes where a session was started from.
+type Device struct {
+	UserAgent string
+	IP        string
+}
+
+// Session is a signed in device as shown to its user.
+type Session struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last_seen"`
+	Current   bool      `json:"current"`
+}
+
+// BackupCode lets a user with two factor authentication sign in once
+// without their authenticator. Only its hash is kept.
+type BackupCode struct {
+	ID       uuid.UUID `json:"id" gorm:"primary_key"`
+	UserId   string    `json:"user_id"`
+	CodeHash string    `json:"-"`
+	Used     bool      `json:"used" gorm:"default:false"`
+	Ts       time.Time `json:"ts"`
+}
+
+func (b *BackupCode) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
+// TwoFactorSetup is what an authenticator app is enrolled with.
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
 }
 
 type Verification struct {
@@ -28,16 +91,36 @@ type Verification struct {
 	Code      string    `json:"code"`
 	Email     string    `json:"email"`
 	Activated bool      `json:"activated"`
+	// ExpiresAt is zero for codes sent before they expired
+	ExpiresAt time.Time `json:"expires_at"`
 	Ts        time.Time `json:"ts"`
 }
 
+// Expired reports whether the code can no longer be used at now.
+func (v *Verification) Expired(now time.Time) bool {
+	return !v.ExpiresAt.IsZero() && !now.Before(v.ExpiresAt)
+}
+
 type PasswordResetToken struct {
 	ID       uuid.UUID `json:"id" gorm:"primary_key"`
 	Code     string    `json:"code"`
 	Email    string    `json:"email"`
 	OwnerId  string    `json:"owner"`
 	Verified bool      `json:"verified"`
-	Ts       time.Time `json:"ts"`
+	// Attempts counts wrong codes tried against the token
+	Attempts int `json:"attempts" gorm:"default:0"`
+	// Used is set once the password has been reset with the token, Revoked
+	// when a newer token replaced it or too many wrong codes were tried
+	Used      bool      `json:"used" gorm:"default:false"`
+	Revoked   bool      `json:"revoked" gorm:"default:false"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Ts        time.Time `json:"ts"`
+}
+
+// Usable reports whether the token can still be verified or used at now.
+// Tokens created before they expired have no ExpiresAt and are not.
+func (ps *PasswordResetToken) Usable(now time.Time) bool {
+	return !ps.Used && !ps.Revoked && now.Before(ps.ExpiresAt)
 }
 
 func (ps *PasswordResetToken) BeforeCreate(scope *gorm.Scope) error {
@@ -56,8 +139,13 @@ func (user *User) Name() string {
 	return fmt.Sprintf("%s %s", user.FirstName, user.LastName)
 }
 
-func NewToken(key string, account *User) *Token {
-	return &Token{Key: key, User: account, Created: time.Now()}
+func NewToken(key, userId string, device *Device) *Token {
+	token := &Token{Key: key, UserId: userId, Created: time.Now()}
+	if device != nil {
+		token.UserAgent = device.UserAgent
+		token.IP = device.IP
+	}
+	return token
 }
 
 func NewUser(user *CreateUserOpts) *User {
@@ -70,21 +158,25 @@ func NewUser(user *CreateUserOpts) *User {
 	}
 }
 
-func NewVerification(email, code string) *Verification {
+func NewVerification(email, code string, ttl time.Duration) *Verification {
+	now := time.Now()
 	return &Verification{
 		Code:      code,
 		Email:     email,
 		Activated: false,
-		Ts:        time.Now(),
+		ExpiresAt: now.Add(ttl),
+		Ts:        now,
 	}
 }
 
-func NewPasswordResetToken(code, email, owner string) *PasswordResetToken {
+func NewPasswordResetToken(code, email, owner string, ttl time.Duration) *PasswordResetToken {
+	now := time.Now()
 	return &PasswordResetToken{
-		Code:     code,
-		Email:    email,
-		OwnerId:  owner,
-		Verified: false,
-		Ts:       time.Now(),
+		Code:      code,
+		Email:     email,
+		OwnerId:   owner,
+		Verified:  false,
+		ExpiresAt: now.Add(ttl),
+		Ts:        now,
 	}
 }
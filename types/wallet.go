@@ -0,0 +1,80 @@
+package types
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"math"
+	"time"
+)
+
+type WithdrawalStatus string
+
+const (
+	WithdrawalPending WithdrawalStatus = "PENDING"
+	WithdrawalSent    WithdrawalStatus = "SENT"
+	WithdrawalFailed  WithdrawalStatus = "FAILED"
+)
+
+// Deposit is coin received at a user's deposit address. Amounts are in the
+// coin's smallest unit e.g SATOSHI
+type Deposit struct {
+	ID      uuid.UUID `json:"id" gorm:"primary_key"`
+	UserId  string    `json:"user_id"`
+	Coin    string    `json:"coin"`
+	Address string    `json:"address" gorm:"unique_index:idx_deposits_tx_address"`
+	TxHash  string    `json:"tx_hash" gorm:"unique_index:idx_deposits_tx_address"`
+	Amount  int64     `json:"amount"`
+	Ts      time.Time `json:"ts"`
+}
+
+func (d *Deposit) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
+// Withdrawal is coin sent from a user's balance to an external address.
+// Amount is what was taken from the balance, the network fee included.
+type Withdrawal struct {
+	ID      uuid.UUID        `json:"id" gorm:"primary_key"`
+	UserId  string           `json:"user_id"`
+	Coin    string           `json:"coin"`
+	Address string           `json:"address"`
+	Amount  int64            `json:"amount"`
+	Fee     int64            `json:"fee"`
+	TxHash  string           `json:"tx_hash"`
+	Status  WithdrawalStatus `json:"status"`
+	Ts      time.Time        `json:"ts"`
+}
+
+func (w *Withdrawal) BeforeCreate(scope *gorm.Scope) error {
+	return scope.SetColumn("ID", uuid.New().String())
+}
+
+type DepositAddress struct {
+	Coin    string `json:"coin"`
+	Address string `json:"address"`
+}
+
+type WithdrawRequest struct {
+	Coin    string `json:"coin"`
+	Address string `json:"address"`
+	Amount  int64  `json:"amount"` // In the coin's smallest unit e.g SATOSHI
+	// TwoFactorCode is the second factor sent with the request
+	TwoFactorCode string `json:"-"`
+}
+
+type BalancePaymentRequest struct {
+	BeneficiaryId string      `json:"beneficiary_id"`
+	Amount        json.Number `json:"amount"` // In the payout currency's major unit e.g NAIRA
+	Coin          string      `json:"coin"`
+	// TwoFactorCode is the second factor sent with the request
+	TwoFactorCode string `json:"-"`
+}
+
+// AmountMinor returns the amount in the payout currency's minor unit.
+func (req *BalancePaymentRequest) AmountMinor() int64 {
+	if value, err := req.Amount.Float64(); err == nil {
+		return int64(math.Round(value * 100))
+	}
+	return 0
+}